@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/QFServer/log"
+	"github.com/QFServer/server"
 )
 
 func ClientLoop() {
@@ -18,6 +19,21 @@ func ClientLoop() {
 	logger := log.GetInstance()
 	logger.BeginDebugLogger()
 
+	// The prompt says when something is waiting in the inbox
+	logger.SetPromptInfo(func() string {
+		notes, offers := server.InboxUnread()
+		_, locked := server.InboxVault()
+		switch {
+		case notes+offers == 0 && locked:
+			return "locked"
+		case notes+offers == 0:
+			return ""
+		case locked:
+			return fmt.Sprintf("%d unread, locked", notes+offers)
+		}
+		return fmt.Sprintf("%d unread", notes+offers)
+	})
+
 	// Quit channel
 	exitclient := make(chan bool, 1)
 
@@ -36,6 +52,11 @@ func ClientLoop() {
 			default:
 				if logger.CheckModule() == "DEFAULT" {
 					time.Sleep(time.Second * 1)
+
+					// Learning: A command that was just started may have taken the input over while we slept
+					if logger.CheckModule() != "DEFAULT" {
+						continue
+					}
 					input := logger.InputFromUser()
 
 					// Default exit TODO: (Should be moved to a command)
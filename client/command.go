@@ -2,8 +2,11 @@ package client
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/QFServer/log"
 	"github.com/QFServer/server"
@@ -14,6 +17,10 @@ type CMethodSig interface {
 	help(chan bool)
 	inbox(chan bool)
 	draft(chan bool)
+	chat(chan bool)
+	send(chan bool)
+	receive(chan bool)
+	outbox(chan bool)
 	util(chan bool)
 	redirect(chan bool)
 }
@@ -37,37 +44,447 @@ func (c *Command) debugshow(alive chan bool) {
 // Command methods signed by commandcontrol
 func (c *Command) help(alive chan bool) {
 
-	fmt.Printf("\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s",
+	fmt.Printf("\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s\n%s",
 		"\n***HELP***",
-		"Inbox: Show incoming mail on LAN (inbox)",
-		"Draft: Draft some message and select a destination on LAN (draft [ip])",
+		"Inbox: The notes and file offers other nodes sent you, * is unread (inbox [list], inbox read [n], inbox save [n] [path], inbox delete [n], inbox lock, inbox unlock)",
+		"Draft: Write a note to a node on LAN, a line with only . sends it (draft [alias/address/@group] [...])",
+		"Chat: Talk to a node as long as you both like. /file [path] drops a file in, /accept takes theirs, /quit leaves (chat [alias/address])",
+		"Send: Open a wormhole for files and get a code like 7-crossword-apple to read out (send [files...])",
+		"Receive: Get the files from a wormhole on the LAN with its code, no picking addresses (receive [code])",
+		"Outbox: Notes and offers waiting for a peer that wasn't reachable, and sent notes with their receipts (outbox [list], outbox cancel [n/id], outbox receipts [n/id/transfer id], outbox retract [n/id/transfer id] takes back an offer nobody answered yet)",
 		"Util: Scanning, checking to see where an open receiver sits (util)",
 		"      - server open: This would start the server and get it ready for scanning",
 		"      - server close: This would be closing the server",
 		"      - server broadcast: This would start broadcasting your server. Other node pools can pick it up and add it on LAN",
 		"      - server pool: This will tell you which addresses are in your pool",
-		"      - server request: This starts the request process. You can send another node a request or accept an incoming connection",
+		"      - server request: This starts the request process. Send a request with [index]/[alias] [files...] (several as 1,3,alice or @group), ttl=30m and/or downloads=3 among the files share them for pull instead, answer one with C[index] (accept), R[index] (reject) or I[index] (details)",
 		"      - server request > quit: When you're in the request module, you can type quit to come back to the main module",
+		"      - server add [host:port] [alias]: Add a peer that can't be discovered to the address book. Requests can use the alias",
+		"      - server note [peer] [text...]: Write something about an address book entry, it shows in the pool. No text clears it",
+		"      - server pin [peer] [sign key] [box key]: Pin a peer's keys by hand instead of trusting the first ones seen. server pin alone shows your own",
+		"      - server group [name] [members...]: Name a few aliases or addresses, @name sends to all of them. A name alone drops it, nothing lists them",
+		"      - server scan [cidr]: Look for nodes on a subnet (all of yours without a cidr). server scan cancel stops it",
+		"      - server relay: Turn relay mode on or off. A relay passes peers and sealed transfers between its networks",
+		"      - server transfers: List every transfer going in or out with its id, state, progress, speed and ETA",
+		"      - server limit [global|peer] [rate] or limit [id] [high|normal|low]: Show or change the bandwidth limits (500K, 2M, off) and transfer priorities",
+		"      - transfer pause|resume|cancel [id]: Pause, resume or cancel a transfer on both ends. Cancel deletes the partial files",
+		"      - transfer pull [id]: Fetch a share that came to you again, while it has time and downloads left",
+		"      - transfer history: Show how the last transfers ended, and what the receivers signed for",
 		"DebugShow: Turn debugging logs on or off. By default they're on.",
 		"Quit: This will quit the program\n")
 
 	alive <- false
 }
 
+// The inbox keeps notes and file offers on disk, so it works with the server closed too
+// inbox [list], inbox read [n], inbox save [n] [path], inbox delete [n], inbox lock, inbox unlock
 func (c *Command) inbox(alive chan bool) {
 	logger := log.GetInstance()
 	// We would have to just check for connections pooled?
 	// Then when the connections are pooled we can either open them with a token
 	// Or choose to receive them. We can also see the contents before we download
-	logger.Debug("COMMAND", "Inbox!")
+	args := make([]string, 0, len(c.args))
+	for _, arg := range c.args {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			args = append(args, arg)
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	// Locking and unlocking don't need an item
+	switch args[0] {
+	case "lock":
+		if err := server.InboxLock(); err != nil {
+			logger.Output("ERROR", "Could not lock it: "+err.Error())
+		} else {
+			logger.Output("INBOX", "Inbox locked")
+		}
+		alive <- false
+		return
+	case "unlock":
+		inboxunlock()
+		alive <- false
+		return
+	}
+
+	// Everything but list works on an item number
+	n := 0
+	if args[0] != "list" {
+		if len(args) < 2 {
+			logger.Output("ERROR", "Usage: inbox [list], inbox read|delete [n], inbox save [n] [path], inbox lock|unlock")
+			alive <- false
+			return
+		}
+		number, err := strconv.Atoi(args[1])
+		if err != nil {
+			logger.Output("ERROR", "Not an item number: "+args[1])
+			alive <- false
+			return
+		}
+		n = number
+	}
+
+	switch args[0] {
+	case "list":
+		items, err := server.InboxList()
+		notes, offers := server.InboxUnread()
+		if err != nil {
+			logger.Output("INBOX", fmt.Sprintf("%d unread notes, %d unread offers. %v", notes, offers, err))
+			break
+		}
+		if configured, _ := server.InboxVault(); !configured {
+			logger.Output("INBOX", "The inbox isn't encrypted on disk, inbox unlock picks a passphrase")
+		}
+		logger.Output("INBOX", fmt.Sprintf("%d items, %d unread notes, %d unread offers", len(items), notes, offers))
+		for i, item := range items {
+			logger.Output("INBOX", fmt.Sprintf("%d %s", i+1, item.Summary()))
+		}
+
+	case "read":
+		item, err := server.InboxRead(n)
+		if err != nil {
+			logger.Output("ERROR", err.Error())
+			break
+		}
+		logger.Output("INBOX", fmt.Sprintf("%s from %s (%s, %s) at %s", item.Kind, item.From.Hostname, item.From.NodeID, item.Address, item.Sent.Format(time.DateTime)))
+		for _, f := range item.Files {
+			logger.Output("INBOX", fmt.Sprintf("  %s | %s | %s", f.Name, server.HumanSize(f.Size), f.Hash))
+		}
+		if item.Kind == server.KindOffer {
+			state := item.State
+			if state == "" {
+				state = "gone from the server"
+			}
+			logger.Output("INBOX", fmt.Sprintf("Transfer %s is %s, util server request to answer it", item.ID, state))
+		}
+		if item.Text != "" {
+			logger.Output("INBOX", "\n"+item.Text)
+		}
+
+	case "save":
+		if len(args) < 3 {
+			logger.Output("ERROR", "Usage: inbox save [n] [path]")
+			break
+		}
+		if err := server.InboxSave(n, args[2]); err != nil {
+			logger.Output("ERROR", "Could not save it: "+err.Error())
+		} else {
+			logger.Output("INBOX", "Saved to "+args[2])
+		}
+
+	case "delete":
+		if err := server.InboxDelete(n); err != nil {
+			logger.Output("ERROR", "Could not delete it: "+err.Error())
+		} else {
+			logger.Output("INBOX", fmt.Sprintf("Deleted %d", n))
+		}
+
+	default:
+		logger.Output("ERROR", "Unknown inbox command "+args[0]+", use list, read, save, delete, lock or unlock")
+	}
 
 	alive <- false
 }
 
+// Ask for the passphrase and open the inbox. The first time it picks the passphrase instead
+func inboxunlock() {
+	logger := log.GetInstance()
+
+	configured, locked := server.InboxVault()
+	if configured && !locked {
+		logger.Output("INBOX", "The inbox is already unlocked")
+		return
+	}
+
+	// Learning: There's no way to hide what's typed without a terminal package, so say so
+	logger.SwitchModule("SECRET")
+	defer logger.SwitchModule("DEFAULT")
+
+	if configured {
+		logger.Output("INBOX", "Passphrase (it shows while you type):")
+		passphrase, ok := logger.WaitInputFromUser()
+		if !ok {
+			return
+		}
+		logger.Output("INBOX", "Checking it...")
+		if err := server.InboxUnlock(passphrase); err != nil {
+			logger.Output("ERROR", "Could not unlock it: "+err.Error())
+			return
+		}
+		logger.Output("INBOX", "Inbox unlocked, inbox lock or a while without using it locks it again")
+		return
+	}
+
+	logger.Output("INBOX", "Pick a passphrase for the inbox and outbox (it shows while you type). There's no getting it back, lose it and they're gone:")
+	passphrase, ok := logger.WaitInputFromUser()
+	if !ok {
+		return
+	}
+	logger.Output("INBOX", "Once more:")
+	again, ok := logger.WaitInputFromUser()
+	if !ok {
+		return
+	}
+	if passphrase != again {
+		logger.Output("ERROR", "Those weren't the same, nothing changed")
+		return
+	}
+
+	logger.Output("INBOX", "Encrypting...")
+	if err := server.InboxSetPassphrase(passphrase); err != nil {
+		logger.Output("ERROR", err.Error())
+		return
+	}
+	logger.Output("INBOX", "Inbox and outbox are encrypted on disk and unlocked for now")
+}
+
+// Write a note, as many lines as it takes, and send it sealed to a peer
 func (c *Command) draft(alive chan bool) {
 	// This is where we would have a pool of known nodes on the network.
 	logger := log.GetInstance()
-	logger.Debug("COMMAND", "Draft!")
+
+	// Everyone it goes to: draft alice bob, draft alice,bob or draft @standup
+	peers, err := server.ExpandTargets(c.args)
+	if err != nil {
+		logger.Output("ERROR", "Usage: draft <alias, address or @group> [...], util server pool shows who is around. "+err.Error())
+		alive <- false
+		return
+	}
+	peer := strings.Join(peers, ", ")
+
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	// The composer has the input to itself until the note is done
+	logger.SwitchModule("DRAFT")
+	logger.Output("DRAFT", fmt.Sprintf("Note to %s. A line with only . sends it, .quit throws it away", peer))
+
+	lines := make([]string, 0)
+	for {
+		line, ok := logger.WaitInputFromUser()
+		if !ok || line == ".quit" {
+			logger.SwitchModule("DEFAULT")
+			logger.Output("DRAFT", "Note thrown away")
+			alive <- false
+			return
+		}
+		if line == "." {
+			break
+		}
+		lines = append(lines, line)
+	}
+	logger.SwitchModule("DEFAULT")
+
+	for _, result := range serverInstance.SendNotes(peers, strings.Join(lines, "\n")) {
+		switch {
+		case result.Err != nil:
+			logger.Output("ERROR", fmt.Sprintf("Could not send the note to %s: %v", result.To, result.Err))
+		case result.Queued != "":
+			logger.Output("DRAFT", fmt.Sprintf("%s isn't reachable, note %s waits in the outbox", result.To, result.Queued))
+		default:
+			logger.Output("DRAFT", fmt.Sprintf("Note %s is in %s's inbox", result.Note, result.To))
+		}
+	}
+
+	alive <- false
+}
+
+// Talk to one peer until one of you leaves. Their lines show up as they come, with the time they were written
+func (c *Command) chat(alive chan bool) {
+	logger := log.GetInstance()
+
+	peer := ""
+	if len(c.args) > 0 {
+		peer = strings.TrimSpace(c.args[0])
+	}
+	if peer == "" {
+		logger.Output("ERROR", "Usage: chat <alias or address>, util server pool shows who is around")
+		alive <- false
+		return
+	}
+
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	session, err := serverInstance.Chat(peer)
+	if err != nil {
+		logger.Output("ERROR", fmt.Sprintf("Could not chat with %s: %v", peer, err))
+		alive <- false
+		return
+	}
+
+	logger.SwitchModule("CHAT")
+	logger.Output("CHAT", fmt.Sprintf("Chatting with %s. /file [path] drops a file in, /accept takes the last one they dropped, /quit leaves", session.Peer()))
+
+	for {
+		line, ok := logger.WaitInputFromUser()
+		select {
+		case <-session.Done():
+			ok = false
+		default:
+		}
+		if !ok || line == "/quit" {
+			break
+		}
+
+		switch {
+		case strings.HasPrefix(line, "/file "):
+			err = session.SendFile(strings.TrimSpace(strings.TrimPrefix(line, "/file ")))
+		case line == "/accept":
+			err = session.Accept()
+		default:
+			err = session.Say(line)
+		}
+		if err != nil {
+			logger.Output("ERROR", err.Error())
+		}
+	}
+
+	session.Close("left the chat")
+	logger.SwitchModule("DEFAULT")
+	alive <- false
+}
+
+// Open a wormhole for files, the code is all the other side needs. send [files...]
+func (c *Command) send(alive chan bool) {
+	logger := log.GetInstance()
+
+	paths := make([]string, 0, len(c.args))
+	for _, arg := range c.args {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 {
+		logger.Output("ERROR", "Usage: send <files...>")
+		alive <- false
+		return
+	}
+
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	code, err := serverInstance.SendCode(paths)
+	if err != nil {
+		logger.Output("ERROR", "Could not open a wormhole: "+err.Error())
+	} else {
+		logger.Output("WORMHOLE", fmt.Sprintf("Wormhole code is %s, on the other machine: receive %s", code, code))
+	}
+
+	alive <- false
+}
+
+// Go through a wormhole someone opened with send. receive [code]
+func (c *Command) receive(alive chan bool) {
+	logger := log.GetInstance()
+
+	code := ""
+	if len(c.args) > 0 {
+		code = strings.TrimSpace(c.args[0])
+	}
+	if code == "" {
+		logger.Output("ERROR", "Usage: receive <code>, the sender got it from send")
+		alive <- false
+		return
+	}
+
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	sender, err := serverInstance.ReceiveCode(code)
+	if err != nil {
+		logger.Output("ERROR", "Could not go through the wormhole: "+err.Error())
+	} else {
+		logger.Output("WORMHOLE", fmt.Sprintf("Code accepted by %s, the files come in on their own", sender))
+	}
+
+	alive <- false
+}
+
+// What couldn't go out yet. outbox [list], outbox cancel [n or id], outbox receipts|retract [n, id or transfer id]
+func (c *Command) outbox(alive chan bool) {
+	logger := log.GetInstance()
+
+	args := make([]string, 0, len(c.args))
+	for _, arg := range c.args {
+		if arg = strings.TrimSpace(arg); arg != "" {
+			args = append(args, arg)
+		}
+	}
+	if len(args) == 0 {
+		args = []string{"list"}
+	}
+
+	switch {
+	case args[0] == "list":
+		items := server.OutboxList()
+		if len(items) == 0 {
+			logger.Output("OUTBOX", "Nothing in the outbox")
+		}
+		now := time.Now()
+		for i, item := range items {
+			logger.Output("OUTBOX", fmt.Sprintf("%d | %s", i+1, item.Summary(now)))
+		}
+
+	case args[0] == "cancel" && len(args) > 1:
+		item, err := server.OutboxCancel(args[1])
+		if err != nil {
+			logger.Output("ERROR", "Could not cancel it: "+err.Error())
+		} else {
+			logger.Output("OUTBOX", fmt.Sprintf("%s to %s won't be sent", item.Kind, item.To))
+		}
+
+	case args[0] == "receipts" && len(args) > 1:
+		receipts, err := server.Receipts(args[1])
+		if err != nil {
+			logger.Output("ERROR", err.Error())
+		} else if len(receipts) == 0 {
+			logger.Output("OUTBOX", "No receipts for it yet")
+		}
+		for _, receipt := range receipts {
+			line := fmt.Sprintf("%s | %s | signed by node %s | ", receipt.Kind, receipt.At.Format(time.DateTime), receipt.Node)
+			if who, err := receipt.Verify(); err != nil {
+				line += err.Error()
+			} else {
+				line += "signature checks out with the key pinned for " + who
+			}
+			logger.Output("OUTBOX", line)
+		}
+
+	case args[0] == "retract" && len(args) > 1:
+		transfer, heard, err := server.OutboxRetract(args[1])
+		switch {
+		case err != nil:
+			logger.Output("ERROR", "Could not retract it: "+err.Error())
+		case transfer == "":
+			logger.Output("OUTBOX", "It never went out, and now it won't")
+		case !heard:
+			logger.Output("OUTBOX", fmt.Sprintf("Offer %s is retracted here, the peer wasn't there to hear it. Its copy expires on its own", transfer))
+		default:
+			logger.Output("OUTBOX", fmt.Sprintf("Offer %s is taken back, the peer dropped it", transfer))
+		}
+
+	default:
+		logger.Output("ERROR", "Usage: outbox [list], outbox cancel [n or id], outbox receipts|retract [n, id or transfer id]")
+	}
 
 	alive <- false
 }
@@ -90,6 +507,19 @@ func (c *Command) srvbroadcast(alive chan bool) {
 	alive <- false
 }
 
+// SERVER: relay; Pass peers and transfers between the networks this node is on
+func (c *Command) srvrelay(alive chan bool) {
+	logger := log.GetInstance()
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+	} else {
+		logger.Output("SERVER", fmt.Sprintf("Relaying: %v", serverInstance.RelayStateChange()))
+	}
+
+	alive <- false
+}
+
 // SERVER: Open; This should open the server
 func (c *Command) srvopen(alive chan bool) {
 	logger := log.GetInstance()
@@ -125,9 +555,348 @@ func (c *Command) srvpool(alive chan bool) {
 	logger.Debug("COMMAND", "Showing the pool!")
 	poollist := server.GetInstance().GetPingPool()
 
-	logger.Debug("OUTPUT", "Address | Host")
+	logger.Debug("OUTPUT", "Address | Host | Interface | Alias")
 	for i, v := range poollist {
-		logger.Debug("OUTPUT", fmt.Sprintf("%d | %s", i, v))
+		source := v.Interface
+		if v.Manual {
+			source = "address book"
+		}
+		logger.Debug("OUTPUT", fmt.Sprintf("%s | %s | %s | %s %s", i, v.Hostname, source, v.Alias, v.Notes))
+	}
+
+	alive <- false
+}
+
+// SERVER: group; Groups in the address book (util server group [name] [members...])
+// No name lists them, a name alone drops that group
+func (c *Command) srvgroup(alive chan bool) {
+	logger := log.GetInstance()
+
+	args := make([]string, 0, len(c.args))
+	for _, arg := range c.args[2:] {
+		for _, part := range strings.Split(arg, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				args = append(args, part)
+			}
+		}
+	}
+
+	if len(args) == 0 {
+		groups := server.GetGroups()
+		names := make([]string, 0, len(groups))
+		for name := range groups {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		if len(names) == 0 {
+			logger.Output("GROUP", "No groups yet, util server group [name] [aliases or addresses...] makes one")
+		}
+		for _, name := range names {
+			logger.Output("GROUP", fmt.Sprintf("@%s | %s", name, strings.Join(groups[name], ", ")))
+		}
+		alive <- false
+		return
+	}
+
+	if err := server.SetGroup(args[0], args[1:]); err != nil {
+		logger.Output("ERROR", "Could not change the group: "+err.Error())
+	} else if len(args) == 1 {
+		logger.Output("GROUP", "Dropped @"+strings.TrimPrefix(args[0], "@"))
+	} else {
+		logger.Output("GROUP", fmt.Sprintf("@%s is %s", strings.TrimPrefix(args[0], "@"), strings.Join(args[1:], ", ")))
+	}
+
+	alive <- false
+}
+
+// SERVER: add; Add a peer to the address book by hand (util server add <host[:port]> [alias])
+func (c *Command) srvadd(alive chan bool) {
+	logger := log.GetInstance()
+
+	if len(c.args) < 3 {
+		logger.Output("ERROR", "Usage: util server add <host[:port]> [alias]")
+		alive <- false
+		return
+	}
+
+	alias := ""
+	if len(c.args) > 3 {
+		alias = strings.TrimSpace(c.args[3])
+	}
+
+	if err := server.AddPeer(strings.TrimSpace(c.args[2]), alias); err != nil {
+		logger.Output("ERROR", "Could not add the peer: "+err.Error())
+	} else {
+		logger.Output("SERVER", "Added "+c.args[2]+" to the address book")
+	}
+
+	alive <- false
+}
+
+// SERVER: note; Write something about a peer in the address book (util server note <peer> [text...])
+// No text clears it
+func (c *Command) srvnote(alive chan bool) {
+	logger := log.GetInstance()
+
+	if len(c.args) < 3 {
+		logger.Output("ERROR", "Usage: util server note <alias or address> [text...]")
+		alive <- false
+		return
+	}
+
+	peer := strings.TrimSpace(c.args[2])
+	notes := strings.Join(c.args[3:], " ")
+	if err := server.SetPeerNotes(peer, notes); err != nil {
+		logger.Output("ERROR", "Could not change the notes: "+err.Error())
+	} else if strings.TrimSpace(notes) == "" {
+		logger.Output("SERVER", "Cleared the notes for "+peer)
+	} else {
+		logger.Output("SERVER", "Noted down for "+peer)
+	}
+
+	alive <- false
+}
+
+// SERVER: pin; Pin a peer's keys by hand (util server pin <peer> <sign key> [box key])
+// Without a peer it shows our own keys, for the other side to pin
+func (c *Command) srvpin(alive chan bool) {
+	logger := log.GetInstance()
+
+	if len(c.args) < 3 {
+		keys, nodeid := server.GetOwnKeys()
+		logger.Output("KEYS", "Node id: "+nodeid)
+		logger.Output("KEYS", "Sign key: "+keys.Sign)
+		logger.Output("KEYS", "Box key: "+keys.Box)
+		logger.Output("KEYS", "Someone can pin them with util server pin <your alias> <sign key> <box key>")
+		alive <- false
+		return
+	}
+	if len(c.args) < 4 {
+		logger.Output("ERROR", "Usage: util server pin <alias or address> <sign key> [box key]")
+		alive <- false
+		return
+	}
+
+	peer := strings.TrimSpace(c.args[2])
+	box := ""
+	if len(c.args) > 4 {
+		box = strings.TrimSpace(c.args[4])
+	}
+
+	// Learning: A hand pinned key beats trust on first use, a hello signed with anything else is refused from now on
+	if err := server.PinPeer(peer, strings.TrimSpace(c.args[3]), box); err != nil {
+		logger.Output("ERROR", "Could not pin the keys: "+err.Error())
+	} else {
+		logger.Output("SERVER", "Pinned the keys for "+peer)
+	}
+
+	alive <- false
+}
+
+// SERVER: scan; Probe a subnet for other nodes (util server scan [cidr]) or stop it (util server scan cancel)
+func (c *Command) srvscan(alive chan bool) {
+	logger := log.GetInstance()
+
+	cidr := ""
+	if len(c.args) > 2 {
+		cidr = strings.TrimSpace(c.args[2])
+	}
+
+	if cidr == "cancel" {
+		if server.CancelScan() {
+			logger.Output("SCAN", "Cancelling the scan")
+		} else {
+			logger.Output("SCAN", "No scan is running")
+		}
+		alive <- false
+		return
+	}
+
+	logger.Output("SCAN", "Starting the scan, util server scan cancel to stop it")
+	err := server.Scan(cidr, func(done int, total int, found int) {
+		logger.Output("SCAN", fmt.Sprintf("%d/%d probed | %d found", done, total, found))
+	})
+
+	if err != nil {
+		logger.Output("SCAN", "Scan stopped: "+err.Error())
+	} else {
+		logger.Output("SCAN", "Scan done! util server pool shows what was found")
+	}
+
+	alive <- false
+}
+
+// SERVER: transfers; Every transfer in and out with how far along it is
+func (c *Command) srvtransfers(alive chan bool) {
+	logger := log.GetInstance()
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	transfers := serverInstance.Transfers()
+	if len(transfers) == 0 {
+		logger.Output("TRANSFER", "No transfers")
+	}
+
+	logger.Output("TRANSFER", "Id | Way | Peer | State | Priority | Progress | Speed | ETA")
+	for _, t := range transfers {
+		progress := fmt.Sprintf("%s/%s", server.HumanSize(t.Done), server.HumanSize(t.Total))
+		if t.Total > 0 {
+			progress += fmt.Sprintf(" (%d%%)", t.Done*100/t.Total)
+		}
+
+		speed := "-"
+		if t.Speed > 0 {
+			speed = server.HumanSize(int64(t.Speed)) + "/s"
+		}
+
+		eta := "-"
+		if t.ETA > 0 {
+			eta = t.ETA.Round(time.Second).String()
+		}
+
+		state := t.State
+		if t.Share != "" {
+			state += " (share " + t.Share + ")"
+		}
+
+		logger.Output("TRANSFER", fmt.Sprintf("%s | %s | %s | %s | %s | %s | %s | %s", t.ID, t.Direction, t.Peer, state, t.Priority, progress, speed, eta))
+	}
+
+	alive <- false
+}
+
+// SERVER: limit; Show the bandwidth limits (util server limit), change one (util server limit global 2M)
+// or change the priority of a transfer (util server limit <id> high)
+func (c *Command) srvlimit(alive chan bool) {
+	logger := log.GetInstance()
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	showrate := func(rate int64) string {
+		if rate == 0 {
+			return "off"
+		}
+		return server.HumanSize(rate) + "/s"
+	}
+
+	target, value := "", ""
+	if len(c.args) > 3 {
+		target, value = strings.TrimSpace(c.args[2]), strings.TrimSpace(c.args[3])
+	}
+
+	switch {
+	case value == "":
+		global, peer := serverInstance.Limits()
+		logger.Output("LIMIT", fmt.Sprintf("Global: %s | Per peer: %s", showrate(global), showrate(peer)))
+		logger.Output("LIMIT", "Usage: util server limit <global|peer> <rate> or util server limit <id> <high|normal|low>")
+
+	case target == "global" || target == "peer":
+		rate, err := server.ParseRate(value)
+		if err == nil {
+			err = serverInstance.SetLimit(target, rate)
+		}
+		if err != nil {
+			logger.Output("ERROR", "Could not change the limit: "+err.Error())
+		} else {
+			logger.Output("LIMIT", fmt.Sprintf("%s limit is now %s", target, showrate(rate)))
+		}
+
+	default:
+		if err := serverInstance.SetPriority(target, value); err != nil {
+			logger.Output("ERROR", "Could not change the priority: "+err.Error())
+		} else {
+			logger.Output("LIMIT", fmt.Sprintf("Transfer %s is now %s priority", target, value))
+		}
+	}
+
+	alive <- false
+}
+
+// TRANSFER ARGS
+
+// TRANSFER: pause, resume, cancel; Change a running transfer on both ends (util transfer pause <id>)
+func (c *Command) trcontrol(alive chan bool) {
+	logger := log.GetInstance()
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	if len(c.args) < 3 {
+		logger.Output("ERROR", "Usage: util transfer pause|resume|cancel <id>, util server transfers lists the ids")
+		alive <- false
+		return
+	}
+
+	action := strings.TrimSpace(c.args[1])
+	id := strings.TrimSpace(c.args[2])
+	if err := serverInstance.ControlTransfer(id, action); err != nil {
+		logger.Output("ERROR", fmt.Sprintf("Could not %s %s: %v", action, id, err))
+	} else {
+		logger.Output("TRANSFER", fmt.Sprintf("Transfer %s: %s", id, action))
+	}
+
+	alive <- false
+}
+
+// TRANSFER: pull; Fetch a share that came to us again, it uses up one of its downloads (util transfer pull <id>)
+func (c *Command) trpull(alive chan bool) {
+	logger := log.GetInstance()
+	serverInstance := server.GetInstance()
+	if serverInstance == nil {
+		logger.Output("SERVER", "Server is not on!")
+		alive <- false
+		return
+	}
+
+	if len(c.args) < 3 {
+		logger.Output("ERROR", "Usage: util transfer pull <id>, util server transfers lists the ids")
+		alive <- false
+		return
+	}
+
+	id := strings.TrimSpace(c.args[2])
+	if err := serverInstance.PullShare(id); err != nil {
+		logger.Output("ERROR", fmt.Sprintf("Could not pull %s: %v", id, err))
+	} else {
+		logger.Output("TRANSFER", "Pulling share "+id)
+	}
+
+	alive <- false
+}
+
+// TRANSFER: history; How the last transfers ended
+func (c *Command) trhistory(alive chan bool) {
+	logger := log.GetInstance()
+
+	entries, err := server.History(20)
+	if err != nil {
+		logger.Output("ERROR", "Could not read the history: "+err.Error())
+	}
+	if len(entries) == 0 {
+		logger.Output("HISTORY", "Nothing yet")
+	}
+
+	for _, e := range entries {
+		line := fmt.Sprintf("%s | %s | %s | %s | %s | %d files, %s of %s", e.Ended.Format("2006-01-02 15:04"), e.ID, e.Direction, e.Peer, e.Outcome, len(e.Files), server.HumanSize(e.Done), server.HumanSize(e.Total))
+		if e.Reason != "" {
+			line += " | " + e.Reason
+		}
+		if receipts := server.ReceiptSummary(e.Receipts); receipts != "" {
+			line += " | " + receipts
+		}
+		logger.Output("HISTORY", line)
 	}
 
 	alive <- false
@@ -155,6 +924,10 @@ func (c *Command) redirect(alive chan bool) (func(chan bool), func(chan bool)) {
 		"help":      c.help,
 		"inbox":     c.inbox,
 		"draft":     c.draft,
+		"chat":      c.chat,
+		"send":      c.send,
+		"receive":   c.receive,
+		"outbox":    c.outbox,
 		"util":      c.util,
 	}
 
@@ -165,10 +938,27 @@ func (c *Command) redirect(alive chan bool) (func(chan bool), func(chan bool)) {
 		"pool":      c.srvpool,
 		"request":   c.srvreq,
 		"alive":     c.srvcheckalive,
+		"add":       c.srvadd,
+		"group":     c.srvgroup,
+		"note":      c.srvnote,
+		"pin":       c.srvpin,
+		"scan":      c.srvscan,
+		"relay":     c.srvrelay,
+		"transfers": c.srvtransfers,
+		"limit":     c.srvlimit,
+	}
+
+	cmaptransfer := map[string]func(chan bool){
+		"pause":   c.trcontrol,
+		"resume":  c.trcontrol,
+		"cancel":  c.trcontrol,
+		"pull":    c.trpull,
+		"history": c.trhistory,
 	}
 
 	cmaprouteutil := map[string]map[string]func(chan bool){
-		"server": cmapserver,
+		"server":   cmapserver,
+		"transfer": cmaptransfer,
 	}
 
 	// Method call
@@ -223,7 +1013,7 @@ func Parse(input string) *Command {
 	c.command = strings.TrimSpace(args[0])
 
 	// Validate check
-	cmap := map[string]bool{"debugshow": true, "help": true, "inbox": true, "draft": true, "util": true, "redirect": true}
+	cmap := map[string]bool{"debugshow": true, "help": true, "inbox": true, "draft": true, "chat": true, "send": true, "receive": true, "outbox": true, "util": true, "redirect": true}
 
 	// ERROR
 	_, ok := cmap[strings.TrimSpace(c.command)]
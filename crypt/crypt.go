@@ -1,6 +1,95 @@
 package Crypt
 
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
 // Function to create assymetric private key
 // Function to encrypt
 
 // Function to decrypt
+
+// Sealed boxes. Anyone with a node's X25519 public key can encrypt to it, only the node can open it.
+// Layout: [ephemeral public key 32][nonce 12][AES-GCM ciphertext]
+// Learning: A fresh ephemeral key per message means two boxes to the same node never share a key
+
+const (
+	keyLength   = 32
+	nonceLength = 12
+	sealInfo    = "qfserver sealed box v1"
+)
+
+var ErrSealed = errors.New("sealed box is damaged or not for us")
+
+// Encrypt plaintext so only the owner of recipient can read it
+func Seal(recipient *ecdh.PublicKey, plaintext []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := sealAEAD(ephemeral, recipient, ephemeral.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, keyLength+nonceLength, keyLength+nonceLength+len(plaintext)+aead.Overhead())
+	copy(out, ephemeral.PublicKey().Bytes())
+	rand.Read(out[keyLength:])
+
+	return aead.Seal(out, out[keyLength:], plaintext, out[:keyLength]), nil
+}
+
+// Open a box sealed to us
+func Open(private *ecdh.PrivateKey, sealed []byte) ([]byte, error) {
+	if len(sealed) < keyLength+nonceLength {
+		return nil, ErrSealed
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(sealed[:keyLength])
+	if err != nil {
+		return nil, ErrSealed
+	}
+
+	aead, err := sealAEAD(private, ephemeral, ephemeral)
+	if err != nil {
+		return nil, ErrSealed
+	}
+
+	plaintext, err := aead.Open(nil, sealed[keyLength:keyLength+nonceLength], sealed[keyLength+nonceLength:], sealed[:keyLength])
+	if err != nil {
+		return nil, ErrSealed
+	}
+
+	return plaintext, nil
+}
+
+// Both sides end up here with the same shared secret. The salt binds it to this exact ephemeral key
+func sealAEAD(private *ecdh.PrivateKey, public *ecdh.PublicKey, ephemeral *ecdh.PublicKey) (cipher.AEAD, error) {
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hkdf.Key(sha256.New, shared, ephemeral.Bytes(), sealInfo, keyLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewAEAD(key)
+}
+
+// AES-256-GCM from a 32 byte key
+func NewAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,144 @@
+package Crypt
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// Password authenticated key exchange (SPAKE2), for wormhole codes.
+// Both sides know a short code and nothing else about each other. Each sends one message, and both get
+// the same key only if they used the same code. Someone listening learns nothing, and someone guessing
+// gets one guess per exchange, there's nothing to try more codes on offline.
+// Learning: This runs in the 2048 bit MODP group from RFC 3526 with math/big. SPAKE2 has to multiply
+// group elements, and crypto/ecdh only does Diffie-Hellman, it doesn't let us add points
+
+const (
+	pakeElement = 256 // Bytes of one group element
+	pakeInfo    = "qfserver spake2 v1"
+)
+
+var ErrPAKE = errors.New("not a valid key exchange message")
+
+var (
+	pakePrime = mustHex(strings.Join([]string{
+		"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74",
+		"020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F1437",
+		"4FE1356D6D51C245E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED",
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3DC2007CB8A163BF05",
+		"98DA48361C55D39A69163FA8FD24CF5F83655D23DCA3AD961C62F356208552BB",
+		"9ED529077096966D670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B",
+		"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9DE2BCBF695581718",
+		"3995497CEA956AE515D2261898FA051015728E5A8AACAA68FFFFFFFFFFFFFFFF",
+	}, ""))
+	pakeOrder = new(big.Int).Rsh(pakePrime, 1) // (p-1)/2, prime. 2 and every square have this order
+	pakeG     = big.NewInt(2)
+
+	// One fixed element per side. Nobody knows their logarithm, that's what the whole thing rests on
+	pakeM = hashToGroup("qfserver spake2 M")
+	pakeN = hashToGroup("qfserver spake2 N")
+)
+
+// One side of an exchange. The side that starts (the receiver of a wormhole) is first
+type PAKE struct {
+	first   bool
+	w       *big.Int
+	x       *big.Int
+	message *big.Int
+}
+
+// Start an exchange with the code both sides were told
+func NewPAKE(code string, first bool) (*PAKE, error) {
+	w, err := hashToScalar([]byte(code), "qfserver spake2 w")
+	if err != nil {
+		return nil, err
+	}
+	x, err := rand.Int(rand.Reader, pakeOrder)
+	if err != nil {
+		return nil, err
+	}
+
+	// X = g^x * M^w for the first side, Y = g^y * N^w for the other
+	blind := pakeN
+	if first {
+		blind = pakeM
+	}
+	message := new(big.Int).Exp(pakeG, x, pakePrime)
+	message.Mul(message, new(big.Int).Exp(blind, w, pakePrime))
+	message.Mod(message, pakePrime)
+
+	return &PAKE{first: first, w: w, x: x, message: message}, nil
+}
+
+// What goes to the other side
+func (p *PAKE) Message() []byte {
+	return p.message.FillBytes(make([]byte, pakeElement))
+}
+
+// The shared key from the other side's message. context is mixed in, both sides have to use the same.
+// A wrong code gives a different key, not an error, the confirmation after this is what tells
+func (p *PAKE) Key(other []byte, context []byte) ([]byte, error) {
+	if len(other) != pakeElement {
+		return nil, ErrPAKE
+	}
+	theirs := new(big.Int).SetBytes(other)
+
+	// Learning: Anything outside the subgroup (0, 1, p-1 and the non-squares) could leak bits of x
+	if theirs.Cmp(big.NewInt(1)) <= 0 || theirs.Cmp(pakePrime) >= 0 || new(big.Int).Exp(theirs, pakeOrder, pakePrime).Cmp(big.NewInt(1)) != 0 {
+		return nil, ErrPAKE
+	}
+
+	// K = (Y / N^w)^x, dividing is raising to q-w since N has order q
+	blind := pakeM
+	if p.first {
+		blind = pakeN
+	}
+	unblind := new(big.Int).Exp(blind, new(big.Int).Sub(pakeOrder, p.w), pakePrime)
+	shared := new(big.Int).Mul(theirs, unblind)
+	shared.Mod(shared, pakePrime)
+	shared.Exp(shared, p.x, pakePrime)
+
+	first, second := p.Message(), other
+	if !p.first {
+		first, second = other, p.Message()
+	}
+
+	// Everything that went into it gets hashed, so the key belongs to this exchange and nothing else
+	transcript := sha256.New()
+	for _, part := range [][]byte{context, first, second, shared.FillBytes(make([]byte, pakeElement)), p.w.Bytes()} {
+		binary.Write(transcript, binary.BigEndian, uint32(len(part)))
+		transcript.Write(part)
+	}
+	return transcript.Sum(nil), nil
+}
+
+// A number below the group order from some bytes
+func hashToScalar(secret []byte, info string) (*big.Int, error) {
+	wide, err := hkdf.Key(sha256.New, secret, nil, pakeInfo+" "+info, pakeElement+32)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).Mod(new(big.Int).SetBytes(wide), pakeOrder), nil
+}
+
+// An element of the subgroup from a label. Squaring lands in it
+func hashToGroup(label string) *big.Int {
+	wide, err := hkdf.Key(sha256.New, []byte(label), nil, pakeInfo, pakeElement+32)
+	if err != nil {
+		panic(err)
+	}
+	element := new(big.Int).Mod(new(big.Int).SetBytes(wide), pakePrime)
+	return element.Exp(element, big.NewInt(2), pakePrime)
+}
+
+func mustHex(s string) *big.Int {
+	n, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("bad constant " + s)
+	}
+	return n
+}
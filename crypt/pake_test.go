@@ -0,0 +1,154 @@
+package Crypt
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+// Both sides of one exchange, the receiver starts
+func exchange(t *testing.T, first, second string, context []byte) ([]byte, []byte) {
+	t.Helper()
+	a, err := NewPAKE(first, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewPAKE(second, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ka, err := a.Key(b.Message(), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := b.Key(a.Message(), context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ka, kb
+}
+
+func TestPAKESameCode(t *testing.T) {
+	ka, kb := exchange(t, "7-apple-river", "7-apple-river", []byte("context"))
+	if !bytes.Equal(ka, kb) {
+		t.Fatal("same code, different keys")
+	}
+	if len(ka) != 32 {
+		t.Fatalf("key of %d bytes", len(ka))
+	}
+
+	// A new exchange with the same code is a new key
+	again, _ := exchange(t, "7-apple-river", "7-apple-river", []byte("context"))
+	if bytes.Equal(ka, again) {
+		t.Fatal("two exchanges gave the same key")
+	}
+}
+
+func TestPAKEDifferentCode(t *testing.T) {
+	ka, kb := exchange(t, "7-apple-river", "7-apple-rover", []byte("context"))
+	if bytes.Equal(ka, kb) {
+		t.Fatal("different codes, same key")
+	}
+}
+
+func TestPAKEContext(t *testing.T) {
+	a, _ := NewPAKE("7-apple-river", true)
+	b, _ := NewPAKE("7-apple-river", false)
+
+	ka, err := a.Key(b.Message(), []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := b.Key(a.Message(), []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ka, kb) {
+		t.Fatal("different contexts, same key")
+	}
+}
+
+func TestPAKESameRole(t *testing.T) {
+	// Both think they started, M and N don't cancel out
+	for _, first := range []bool{true, false} {
+		a, _ := NewPAKE("7-apple-river", first)
+		b, _ := NewPAKE("7-apple-river", first)
+		ka, err := a.Key(b.Message(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kb, err := b.Key(a.Message(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(ka, kb) {
+			t.Fatalf("both first=%v, same key", first)
+		}
+	}
+}
+
+func TestPAKESwappedTranscript(t *testing.T) {
+	// The messages go into the transcript in a fixed order. The same shared secret with them the other way
+	// around can't give the same key
+	a, _ := NewPAKE("7-apple-river", true)
+	b, _ := NewPAKE("7-apple-river", false)
+	ka, err := a.Key(b.Message(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.first = false
+	swapped, err := a.Key(b.Message(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(ka, swapped) {
+		t.Fatal("swapped roles, same key")
+	}
+}
+
+func TestPAKERejects(t *testing.T) {
+	element := func(n *big.Int) []byte {
+		return n.FillBytes(make([]byte, pakeElement))
+	}
+	minusone := new(big.Int).Sub(pakePrime, big.NewInt(1))
+
+	// Learning: With p = 7 mod 8, 2 is a square and -1 isn't, so -2 is outside the subgroup
+	nonsquare := new(big.Int).Sub(pakePrime, big.NewInt(2))
+	if new(big.Int).Exp(nonsquare, pakeOrder, pakePrime).Cmp(big.NewInt(1)) == 0 {
+		t.Fatal("test value is in the subgroup after all")
+	}
+
+	valid, _ := NewPAKE("7-apple-river", false)
+
+	tests := []struct {
+		name  string
+		other []byte
+	}{
+		{"zero", element(big.NewInt(0))},
+		{"one", element(big.NewInt(1))},
+		{"p-1", element(minusone)},
+		{"p", element(pakePrime)},
+		{"above p", bytes.Repeat([]byte{0xff}, pakeElement)},
+		{"not in the subgroup", element(nonsquare)},
+		{"empty", nil},
+		{"short", valid.Message()[1:]},
+		{"long", append(valid.Message(), 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPAKE("7-apple-river", true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := p.Key(tt.other, nil); !errors.Is(err, ErrPAKE) {
+				t.Fatalf("got %v, want %v", err, ErrPAKE)
+			}
+		})
+	}
+
+	p, _ := NewPAKE("7-apple-river", true)
+	if _, err := p.Key(valid.Message(), nil); err != nil {
+		t.Fatalf("a real message got %v", err)
+	}
+}
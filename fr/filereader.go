@@ -1,7 +1,10 @@
 package FR
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -49,8 +52,9 @@ func ReadFromFile(filePath string) []byte {
 				EOF = true
 			}
 
-			fileReadObj.inputCache = append(fileReadObj.inputCache, fileReadObj.inputBuffer)
-			number = int64(readInt)
+			// Learning: ReadAt wants the absolute offset, and only readInt bytes of the buffer are real
+			fileReadObj.inputCache = append(fileReadObj.inputCache, fileReadObj.inputBuffer[:readInt])
+			number += int64(readInt)
 		}
 
 		out := make([]byte, 0, countKB+1)
@@ -64,3 +68,20 @@ func ReadFromFile(filePath string) []byte {
 
 	return nil
 }
+
+// Size and sha256 (hex) of a file, read as a stream so big files don't end up in memory
+func HashFile(filePath string) (int64, string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -7,8 +7,10 @@ replace github.com/QFServer/client => ./client
 require github.com/QFServer/client v0.0.0-00010101000000-000000000000
 
 require (
+	github.com/QFServer/crypt v0.0.0-00010101000000-000000000000 // indirect
 	github.com/QFServer/fr v0.0.0-00010101000000-000000000000 // indirect
 	github.com/QFServer/log v0.0.0-00010101000000-000000000000 // indirect
+	github.com/QFServer/protocol v0.0.0-00010101000000-000000000000 // indirect
 	github.com/QFServer/server v0.0.0-00010101000000-000000000000 // indirect
 )
 
@@ -17,3 +19,7 @@ replace github.com/QFServer/log => ./log
 replace github.com/QFServer/server => ./server
 
 replace github.com/QFServer/fr => ./fr
+
+replace github.com/QFServer/crypt => ./crypt
+
+replace github.com/QFServer/protocol => ./protocol
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // A structure which stores the logs
@@ -22,6 +23,8 @@ type logMessage struct {
 type logdb struct {
 	logdictstorage    map[string][]string
 	outputBuffer      *OutBuffer
+	reader            *bufio.Reader
+	promptinfo        func() string
 	inputcheckchannel chan bool
 	debuggeralive     bool
 	debuglogshow      bool
@@ -47,6 +50,10 @@ func (l *logdb) BeginDebugLogger() {
 	l.outputBuffer = &OutBuffer{}
 	l.outputBuffer.Init()
 
+	// Learning: One reader for the whole program. A new bufio.Reader per line drops whatever it buffered
+	// past the newline, so pasting a few lines at once lost all but the first
+	l.reader = bufio.NewReader(os.Stdin)
+
 	l.debuggeralive = true
 	l.debuglogshow = true
 }
@@ -78,15 +85,15 @@ func (l *logdb) SwitchModule(module string) {
 }
 
 func (l *logdb) InputFromUser() string {
+	prompt := l.prompt()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
 	if l.outputBuffer.checkclear() {
-		reader := bufio.NewReader(os.Stdin)
-
 		l.outputBuffer.moduleinputtext() // Get the input text depending on the module
-		l.Output("IN", "> ")
-		input, err := reader.ReadString('\n')
+		l.Output("IN", prompt)
+		input, err := l.reader.ReadString('\n')
 
 		inputProcess := strings.ToLower(input)
 		inputProcess = strings.ReplaceAll(input, " ", "")
@@ -104,6 +111,49 @@ func (l *logdb) InputFromUser() string {
 	}
 }
 
+// Like InputFromUser, but waits for the output to clear instead of giving back "". An empty string
+// is an empty line the user typed, ok is false once stdin is gone
+func (l *logdb) WaitInputFromUser() (string, bool) {
+	for !l.ReadyForUserInput() {
+		time.Sleep(time.Millisecond * 50)
+	}
+	prompt := l.prompt()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.outputBuffer.moduleinputtext()
+	l.Output("IN", prompt)
+	input, err := l.reader.ReadString('\n')
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimRight(input, "\r\n"), true
+}
+
+// Something to show in the prompt, like the unread count. It's asked before every input
+func (l *logdb) SetPromptInfo(info func() string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.promptinfo = info
+}
+
+// Learning: Called before taking the lock, the info func may well log something itself
+func (l *logdb) prompt() string {
+	l.mu.Lock()
+	info := l.promptinfo
+	l.mu.Unlock()
+
+	if info == nil {
+		return "> "
+	}
+	if text := info(); text != "" {
+		return "(" + text + ") > "
+	}
+	return "> "
+}
+
 func (l *logdb) ReadyForUserInput() bool {
 	return l.outputBuffer.checkclear()
 }
@@ -15,7 +15,13 @@ func (ob *OutBuffer) moduleinputtext() {
 	case "DEFAULT":
 		fmt.Println("\nQFServer CLI! Type in - Help - to get started.")
 	case "SERVERREQ":
-		fmt.Println("\n** (C[index] to accept connection or [index] to make a request) ** ")
+		fmt.Println("\n** (C[index] to accept, R[index] to reject, I[index] for details or [index]/[alias] [files...] to make a request) ** ")
+	case "DRAFT":
+		return // One prompt per line of a note would be a lot, draft says it once
+	case "CHAT":
+		return // Lines come and go all the time, chat says what to type once
+	case "SECRET":
+		return // Asking for a passphrase, whoever asks says what for
 	default:
 		return
 	}
@@ -24,6 +30,9 @@ func (ob *OutBuffer) moduleinputtext() {
 func (ob *OutBuffer) switchmodule(module string) {
 	switch module {
 	case "SERVERREQ",
+		"DRAFT",
+		"SECRET",
+		"CHAT",
 		"DEFAULT":
 		ob.CurrModule = module
 	default:
@@ -0,0 +1,113 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Everything that can go wrong reading a message. Check with errors.Is
+var (
+	ErrTooLarge    = errors.New("message is too large")
+	ErrVersion     = errors.New("unsupported protocol version")
+	ErrUnknownType = errors.New("unknown message type")
+	ErrMalformed   = errors.New("malformed message")
+	ErrInvalid     = errors.New("invalid message")
+	ErrUnexpected  = errors.New("unexpected message type")
+	ErrSignature   = errors.New("bad signature")
+	ErrStale       = errors.New("message is too old or from the future")
+	ErrReplay      = errors.New("message was already seen")
+)
+
+// A decode failure with the details of what was wrong
+type Error struct {
+	Kind   error // One of the errors above
+	Detail string
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return "protocol: " + e.Kind.Error()
+	}
+	return fmt.Sprintf("protocol: %s: %s", e.Kind, e.Detail)
+}
+
+// Learning: Unwrap is what lets errors.Is(err, ErrTooLarge) see through our wrapper
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func newerror(kind error, format string, args ...any) *Error {
+	return &Error{Kind: kind, Detail: fmt.Sprintf(format, args...)}
+}
+
+// Error codes a node answers with when it won't do what was asked. They go in a Problem next to
+// the HTTP status, the status says how bad it is and the code says what exactly
+const (
+	CodeBadAddress   = "bad_address"
+	CodeBadMessage   = "bad_message"
+	CodeBadSignature = "bad_signature"
+	CodeStale        = "stale"
+	CodeReplay       = "replay"
+	CodeUnknown      = "unknown"     // No such transfer, or not one the asker has a part in
+	CodeDuplicate    = "duplicate"   // That id is taken
+	CodeWrongState   = "wrong_state" // The transfer can't do that right now
+	CodeBadKey       = "bad_key"     // A key that couldn't be opened or used
+	CodeEncryption   = "encryption"  // Sealing or opening the data failed
+	CodeStorage      = "storage"     // The disk said no
+	CodeTooLarge     = "too_large"
+	CodeUnavailable  = "unavailable" // Turned off on that node
+	CodeExpired      = "expired"     // A share whose time or downloads ran out
+	CodeBusy         = "busy"        // Too much from the asker is waiting already, try again later
+)
+
+// What the user gets to read for each code
+var problemtext = map[string]string{
+	CodeBadAddress:   "couldn't tell where the request came from",
+	CodeBadMessage:   "didn't understand the message",
+	CodeBadSignature: "didn't trust the signature",
+	CodeStale:        "thinks the message is too old, check both clocks",
+	CodeReplay:       "has seen that message before",
+	CodeUnknown:      "doesn't know that transfer",
+	CodeDuplicate:    "already has a request with that id",
+	CodeWrongState:   "can't do that with the transfer right now",
+	CodeBadKey:       "couldn't use the key",
+	CodeEncryption:   "couldn't encrypt or decrypt the data",
+	CodeStorage:      "couldn't store it",
+	CodeTooLarge:     "says it's too big",
+	CodeUnavailable:  "doesn't offer that",
+	CodeExpired:      "says the share expired",
+	CodeBusy:         "has too much from you waiting already, try again later",
+}
+
+// The JSON body of every error answer
+type Problem struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Readable line for the CLI, like "doesn't know that transfer (no transfer 1f2e...)"
+func (p Problem) Describe() string {
+	text, ok := problemtext[p.Code]
+	if !ok {
+		return p.Message
+	}
+	if p.Message == "" {
+		return text
+	}
+	return text + " (" + p.Message + ")"
+}
+
+// The code that goes with a decode error
+func ProblemCode(err error) string {
+	switch {
+	case errors.Is(err, ErrSignature):
+		return CodeBadSignature
+	case errors.Is(err, ErrStale):
+		return CodeStale
+	case errors.Is(err, ErrReplay):
+		return CodeReplay
+	case errors.Is(err, ErrTooLarge):
+		return CodeTooLarge
+	}
+	return CodeBadMessage
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Streams (like a transfer) are a run of frames: a 4 byte big endian length, then the envelope
+// Learning: JSON has no end marker we can trust on a stream, a length in front lets us size check
+// before reading anything
+
+// Write one message as a frame
+func WriteFrame(w io.Writer, m Message) error {
+	content, err := Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(content)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// Read one frame. io.EOF means the stream ended cleanly between frames
+func ReadFrame(r io.Reader, limit int64) (Message, error) {
+	m, _, err := ReadFrameFrom(r, limit)
+	return m, err
+}
+
+// Read one frame and say who it's from
+func ReadFrameFrom(r io.Reader, limit int64) (Message, Origin, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, Origin{}, io.EOF
+		}
+		return nil, Origin{}, newerror(ErrMalformed, "frame header: %v", err)
+	}
+
+	length := int64(binary.BigEndian.Uint32(header))
+	if length > limit {
+		return nil, Origin{}, newerror(ErrTooLarge, "frame of %d bytes", length)
+	}
+
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, Origin{}, newerror(ErrMalformed, "frame cut short: %v", err)
+	}
+
+	return UnmarshalFrom(content)
+}
@@ -0,0 +1,3 @@
+module github.com/QFServer/protocol
+
+go 1.25.5
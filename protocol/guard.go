@@ -0,0 +1,147 @@
+package protocol
+
+import (
+	"container/heap"
+	"io"
+	"sync"
+	"time"
+)
+
+// Replay protection
+// A signed message is still good for an attacker who captured it, they can send it again.
+// The Guard refuses anything outside the allowed clock window and remembers every nonce it let
+// through for as long as the window lasts. The cache is bounded: when it's full the entry with the
+// oldest sent time goes and that time becomes the floor, anything from before the floor is refused
+// from then on. The floor never goes past our own clock, or a flood of messages dated in the future
+// would push it ahead and lock everyone out until it caught up.
+// Learning: Clamping has a price, a future dated message that got pushed out can come back once.
+// It's still inside the window and signed by whoever sent it first, we take that over a lockout
+
+type Guard struct {
+	mu     sync.Mutex
+	window time.Duration // How far a message's time may be from ours, either way
+	size   int
+	seen   map[string]time.Time
+	order  guardheap // Keys by their sent time, oldest first
+	floor  time.Time
+}
+
+func NewGuard(window time.Duration, size int) *Guard {
+	return &Guard{window: window, size: size, seen: make(map[string]time.Time)}
+}
+
+type guardentry struct {
+	key  string
+	sent time.Time
+}
+
+// Learning: container/heap only needs these five, Pop takes from the end after heap moved the smallest there
+type guardheap []guardentry
+
+func (h guardheap) Len() int           { return len(h) }
+func (h guardheap) Less(i, j int) bool { return h[i].sent.Before(h[j].sent) }
+func (h guardheap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *guardheap) Push(x any)        { *h = append(*h, x.(guardentry)) }
+func (h *guardheap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// Drop the entry sent first and say when that was. Must hold the lock
+func (g *Guard) evict() time.Time {
+	oldest := heap.Pop(&g.order).(guardentry)
+	delete(g.seen, oldest.key)
+	return oldest.sent
+}
+
+// Let a message through once. key has to be unique per message (node id and nonce)
+func (g *Guard) Check(key string, sent time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	if sent.Before(now.Add(-g.window)) || sent.After(now.Add(g.window)) {
+		return newerror(ErrStale, "sent %s, it's %s", sent.Format(time.RFC3339), now.Format(time.RFC3339))
+	}
+	if !sent.After(g.floor) {
+		return newerror(ErrStale, "older than what we still remember")
+	}
+
+	// Forget what's out of the window anyway
+	for len(g.order) > 0 && g.order[0].sent.Before(now.Add(-g.window)) {
+		g.evict()
+	}
+
+	if _, ok := g.seen[key]; ok {
+		return newerror(ErrReplay, "%s", key)
+	}
+
+	if len(g.order) >= g.size {
+		oldest := g.evict()
+		if oldest.After(now) {
+			oldest = now
+		}
+		if oldest.After(g.floor) {
+			g.floor = oldest
+		}
+	}
+
+	g.seen[key] = sent
+	heap.Push(&g.order, guardentry{key: key, sent: sent})
+	return nil
+}
+
+// Only the clock window, for messages that can't be replayed anyway (frames inside a transfer)
+func (g *Guard) Fresh(sent time.Time) error {
+	now := time.Now()
+	if sent.Before(now.Add(-g.window)) || sent.After(now.Add(g.window)) {
+		return newerror(ErrStale, "sent %s, it's %s", sent.Format(time.RFC3339), now.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (g *Guard) checkorigin(origin Origin) error {
+	return g.Check(origin.NodeID+"/"+origin.Nonce, origin.Time)
+}
+
+// Decode a message that has to be fresh and new
+func (g *Guard) Decode(r io.Reader, limit int64) (Message, Origin, error) {
+	m, origin, err := DecodeFrom(r, limit)
+	if err != nil {
+		return nil, origin, err
+	}
+	if err := g.checkorigin(origin); err != nil {
+		return nil, origin, err
+	}
+	return m, origin, nil
+}
+
+// Decode a fresh and new message of one type
+func (g *Guard) Expect(r io.Reader, limit int64, t Type) (Message, Origin, error) {
+	m, origin, err := g.Decode(r, limit)
+	if err != nil {
+		return nil, origin, err
+	}
+	if m.Type() != t {
+		return nil, origin, newerror(ErrUnexpected, "wanted %s, got %s", t, m.Type())
+	}
+	return m, origin, nil
+}
+
+// Read a frame of a stream. Only the clock is checked, nonces aren't remembered: a transfer sends
+// thousands of chunks and they would push every real message out of the cache.
+// That's safe because a frame is worth nothing outside its stream. Chunks are sealed with the session key
+// of their transfer and the transfer id, and the manifest takes every chunk index once. Chat lines carry
+// a sequence number that has to go up, and the frame opening a chat goes through Check as well
+func (g *Guard) ReadFrame(r io.Reader, limit int64) (Message, Origin, error) {
+	m, origin, err := ReadFrameFrom(r, limit)
+	if err != nil {
+		return nil, origin, err
+	}
+	if err := g.Fresh(origin.Time); err != nil {
+		return nil, origin, err
+	}
+	return m, origin, nil
+}
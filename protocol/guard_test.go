@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestGuardCheck(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		sent time.Time
+		want error
+	}{
+		{"now", now, nil},
+		{"a bit behind", now.Add(-20 * time.Second), nil},
+		{"a bit ahead", now.Add(20 * time.Second), nil},
+		{"stale", now.Add(-2 * time.Minute), ErrStale},
+		{"future", now.Add(2 * time.Minute), ErrStale},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := NewGuard(time.Minute, 16)
+			err := g.Check("node/"+tt.name, tt.sent)
+			if tt.want == nil && err != nil {
+				t.Fatalf("refused: %v", err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestGuardReplay(t *testing.T) {
+	g := NewGuard(time.Minute, 16)
+	now := time.Now()
+	if err := g.Check("node/nonce", now); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check("node/nonce", now); !errors.Is(err, ErrReplay) {
+		t.Fatalf("replay got %v", err)
+	}
+	if err := g.Check("node/other", now); err != nil {
+		t.Fatalf("another nonce got %v", err)
+	}
+}
+
+func TestGuardOverflow(t *testing.T) {
+	g := NewGuard(time.Minute, 4)
+	now := time.Now()
+
+	// Arrives last but was sent first, it's the one that has to go
+	for i := range 3 {
+		if err := g.Check(fmt.Sprintf("node/%d", i), now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Check("node/early", now.Add(-30*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Check("node/late", now.Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Forgotten, the floor is what refuses it now
+	if err := g.Check("node/early", now.Add(-30*time.Second)); !errors.Is(err, ErrStale) {
+		t.Fatalf("evicted replay got %v", err)
+	}
+	remembered := map[string]time.Time{
+		"node/0":    now,
+		"node/1":    now.Add(time.Second),
+		"node/2":    now.Add(2 * time.Second),
+		"node/late": now.Add(5 * time.Second),
+	}
+	for key, sent := range remembered {
+		if err := g.Check(key, sent); !errors.Is(err, ErrReplay) {
+			t.Fatalf("remembered %s got %v", key, err)
+		}
+	}
+}
+
+func TestGuardFutureFlood(t *testing.T) {
+	g := NewGuard(time.Minute, 4)
+	ahead := time.Now().Add(50 * time.Second)
+
+	// A full cache of future dated messages, and then some
+	for i := range 8 {
+		if err := g.Check(fmt.Sprintf("flood/%d", i), ahead); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g.floor.After(time.Now()) {
+		t.Fatalf("floor %s is in the future", g.floor)
+	}
+
+	// Someone with a correct clock still gets through
+	if err := g.Check("node/nonce", time.Now().Add(time.Millisecond)); err != nil {
+		t.Fatalf("locked out: %v", err)
+	}
+}
+
+func TestGuardFresh(t *testing.T) {
+	g := NewGuard(time.Minute, 4)
+	now := time.Now()
+	if err := g.Fresh(now); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Fresh(now); err != nil {
+		t.Fatalf("fresh doesn't remember, got %v", err)
+	}
+	if err := g.Fresh(now.Add(-2 * time.Minute)); !errors.Is(err, ErrStale) {
+		t.Fatalf("stale got %v", err)
+	}
+	if err := g.Fresh(now.Add(2 * time.Minute)); !errors.Is(err, ErrStale) {
+		t.Fatalf("future got %v", err)
+	}
+}
@@ -0,0 +1,508 @@
+package protocol
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The messages nodes send each other. Every one of them travels inside an Envelope
+
+type Type string
+
+const (
+	TypeHello   Type = "hello"   // Who a node is (answer to /info)
+	TypeOffer   Type = "offer"   // I want to send you something
+	TypeAccept  Type = "accept"  // Go ahead
+	TypeReject  Type = "reject"  // No thanks
+	TypeChunk   Type = "chunk"   // A piece of encrypted data
+	TypeAck     Type = "ack"     // Got that piece
+	TypeClose   Type = "close"   // The conversation is over
+	TypeControl Type = "control" // Pause, resume or cancel a transfer
+	TypeNote    Type = "note"    // A text note, sealed to the receiver
+
+	TypeChatOpen Type = "chat_open" // Start of a chat stream, both sides send one
+	TypeChatLine Type = "chat_line" // Something said in a chat, acked with an Ack
+	TypeReceipt  Type = "receipt"   // Signed by the receiver, a note or a transfer got there or was read
+	TypeRetract  Type = "retract"   // The sender takes back an offer nobody answered yet
+	TypeWormhole Type = "wormhole"  // One step of a key exchange from a short code
+)
+
+// What a control message asks for
+const (
+	ActionPause  = "pause"
+	ActionResume = "resume"
+	ActionCancel = "cancel"
+)
+
+// What a receipt says
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// Limits for the fields we accept
+const (
+	MaxChunkData = 1 << 20            // Biggest chunk payload
+	MaxFiles     = 1000               // Files in one offer
+	MaxStreams   = 16                 // Parallel connections for one transfer
+	MaxDownloads = 1000               // Pulls of one share
+	MaxNameplate = 99                 // The number in front of a wormhole code
+	pakeSize     = 256                // A SPAKE2 message, one 2048 bit group element
+	confirmSize  = 32                 // HMAC-SHA256
+	maxText      = 1024               // Names, reasons and other short strings
+	maxNote      = 4096               // The message that can come with an offer
+	MaxNoteText  = 64 << 10           // A note written with draft
+	maxSealed    = MaxNoteText + 1024 // Sealing adds a key and a tag
+	MaxChatText  = 16 << 10           // One line in a chat
+	maxChatLine  = MaxChatText + 1024 // Sealed line with the time and a file drop
+	maxName      = 255
+	minRSABits   = 2048
+	maxRSABits   = 4096
+)
+
+var (
+	idpattern   = regexp.MustCompile("^[0-9a-f]{16,64}$")
+	hashpattern = regexp.MustCompile("^[0-9a-f]{64}$")
+)
+
+// Every message knows its type and how to check itself after decoding
+type Message interface {
+	Type() Type
+	Validate() error
+}
+
+// Identity keys, base64 encoded
+type Keys struct {
+	Sign string `json:"sign,omitempty"`
+	Box  string `json:"box,omitempty"`
+}
+
+// An RSA public key. N is big endian
+type PublicKey struct {
+	N []byte `json:"n"`
+	E int    `json:"e"`
+}
+
+type Hello struct {
+	Service  string `json:"service"`
+	Software string `json:"software"`
+	NodeID   string `json:"node_id"`
+	Hostname string `json:"hostname"`
+	Keys     Keys   `json:"keys"`
+}
+
+// Who is sending
+type Sender struct {
+	NodeID   string `json:"node_id"`
+	Hostname string `json:"hostname"`
+}
+
+// One file in an offer. Hash is the hex sha256 of the content
+type FileMeta struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// Everything the receiver needs to decide before accepting
+type Offer struct {
+	ID        string     `json:"id"`
+	Endpoint  string     `json:"endpoint"`
+	Key       PublicKey  `json:"key"`
+	Sender    Sender     `json:"sender"`
+	Files     []FileMeta `json:"files"`
+	TotalSize int64      `json:"total_size"`
+	Message   string     `json:"message,omitempty"`
+	Streams   int        `json:"streams,omitempty"` // Most parallel streams the sender will open, 0 is 1
+
+	// A share isn't pushed, the receiver pulls it from /conn/{id} after accepting.
+	// Expires is when the sender forgets it (unix milliseconds), Downloads how often it can be pulled
+	Expires   int64 `json:"expires,omitempty"`
+	Downloads int   `json:"downloads,omitempty"`
+}
+
+// Key is the session key, encrypted to the RSA key from the offer
+// Streams is how many of the offered streams the receiver wants, 0 is 1
+type Accept struct {
+	ID      string `json:"id"`
+	Key     []byte `json:"key"`
+	Streams int    `json:"streams,omitempty"`
+}
+
+type Reject struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Encrypted data for one file, starting at Offset. Index is its place in the chunk manifest
+type Chunk struct {
+	ID     string `json:"id"`
+	Index  int    `json:"index"`
+	File   int    `json:"file"`
+	Offset int64  `json:"offset"`
+	Data   []byte `json:"data"`
+}
+
+type Ack struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+}
+
+type Close struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Sent to the other side when the user pauses, resumes or cancels a transfer
+type Control struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// A text note. Sealed is the text sealed to the receiver's box key, so only it can read it.
+// Sent is when it was written (unix milliseconds), it can be older than the envelope if it waited to go out
+type Note struct {
+	ID     string `json:"id"`
+	Sender Sender `json:"sender"`
+	Sent   int64  `json:"sent"`
+	Sealed []byte `json:"sealed"`
+}
+
+// Opens a chat. Key is an ephemeral X25519 public key, the two of them give the keys for the stream.
+// The signature on the envelope says whose it is
+type ChatOpen struct {
+	ID     string `json:"id"`
+	Sender Sender `json:"sender"`
+	Key    []byte `json:"key"`
+}
+
+// One line of a chat, sealed with the key of the side that sent it. Seq counts up from 1 per side
+type ChatLine struct {
+	ID     string `json:"id"`
+	Seq    int    `json:"seq"`
+	Sealed []byte `json:"sealed"`
+}
+
+// The receiver's word that a note or a transfer got there or was read. About is the note or transfer id,
+// At when it happened (unix milliseconds). The signature on the envelope is the proof, keep the envelope
+type Receipt struct {
+	About string `json:"about"`
+	Kind  string `json:"kind"`
+	At    int64  `json:"at"`
+}
+
+// The sender takes back an offer before it's accepted, the receiver forgets it ever came
+type Retract struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// One step of a wormhole, see server/wormhole.go. The receiver sends its PAKE message and gets the sender's
+// back with a confirmation, then it confirms too. Nameplate is the number the code starts with
+type Wormhole struct {
+	Nameplate int    `json:"nameplate"`
+	PAKE      []byte `json:"pake,omitempty"`
+	Confirm   []byte `json:"confirm,omitempty"`
+}
+
+func (ChatOpen) Type() Type { return TypeChatOpen }
+func (ChatLine) Type() Type { return TypeChatLine }
+func (Receipt) Type() Type  { return TypeReceipt }
+func (Retract) Type() Type  { return TypeRetract }
+func (Wormhole) Type() Type { return TypeWormhole }
+
+func (Hello) Type() Type   { return TypeHello }
+func (Offer) Type() Type   { return TypeOffer }
+func (Accept) Type() Type  { return TypeAccept }
+func (Reject) Type() Type  { return TypeReject }
+func (Chunk) Type() Type   { return TypeChunk }
+func (Ack) Type() Type     { return TypeAck }
+func (Close) Type() Type   { return TypeClose }
+func (Control) Type() Type { return TypeControl }
+func (Note) Type() Type    { return TypeNote }
+
+// Empty message for a type, used when decoding
+func newmessage(t Type) (Message, bool) {
+	switch t {
+	case TypeHello:
+		return &Hello{}, true
+	case TypeOffer:
+		return &Offer{}, true
+	case TypeAccept:
+		return &Accept{}, true
+	case TypeReject:
+		return &Reject{}, true
+	case TypeChunk:
+		return &Chunk{}, true
+	case TypeAck:
+		return &Ack{}, true
+	case TypeClose:
+		return &Close{}, true
+	case TypeControl:
+		return &Control{}, true
+	case TypeNote:
+		return &Note{}, true
+	case TypeChatOpen:
+		return &ChatOpen{}, true
+	case TypeChatLine:
+		return &ChatLine{}, true
+	case TypeReceipt:
+		return &Receipt{}, true
+	case TypeRetract:
+		return &Retract{}, true
+	case TypeWormhole:
+		return &Wormhole{}, true
+	}
+	return nil, false
+}
+
+func checkid(id string) error {
+	if !idpattern.MatchString(id) {
+		return newerror(ErrInvalid, "bad id %q", id)
+	}
+	return nil
+}
+
+func checkstreams(streams int) error {
+	if streams < 0 || streams > MaxStreams {
+		return newerror(ErrInvalid, "%d streams", streams)
+	}
+	return nil
+}
+
+func checktext(field string, value string) error {
+	if len(value) > maxText {
+		return newerror(ErrInvalid, "%s is too long", field)
+	}
+	return nil
+}
+
+func (m Hello) Validate() error {
+	if m.NodeID == "" {
+		return newerror(ErrInvalid, "hello without a node id")
+	}
+	for field, value := range map[string]string{"service": m.Service, "software": m.Software, "node_id": m.NodeID, "hostname": m.Hostname} {
+		if err := checktext(field, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m Offer) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	if err := checktext("endpoint", m.Endpoint); err != nil {
+		return err
+	}
+	if err := m.Sender.Validate(); err != nil {
+		return err
+	}
+	if len(m.Message) > maxNote {
+		return newerror(ErrInvalid, "message is too long")
+	}
+	if err := checkstreams(m.Streams); err != nil {
+		return err
+	}
+	if m.Expires < 0 || m.Downloads < 0 || m.Downloads > MaxDownloads || (m.Expires == 0) != (m.Downloads == 0) {
+		return newerror(ErrInvalid, "a share needs both an end and a number of downloads")
+	}
+
+	if len(m.Files) == 0 || len(m.Files) > MaxFiles {
+		return newerror(ErrInvalid, "offer with %d files", len(m.Files))
+	}
+	var total int64
+	for _, f := range m.Files {
+		if err := f.Validate(); err != nil {
+			return err
+		}
+		total += f.Size
+	}
+	if total != m.TotalSize {
+		return newerror(ErrInvalid, "total size %d doesn't add up to %d", m.TotalSize, total)
+	}
+
+	return m.Key.Validate()
+}
+
+func (s Sender) Validate() error {
+	if s.NodeID == "" {
+		return newerror(ErrInvalid, "no sender")
+	}
+	if err := checktext("node_id", s.NodeID); err != nil {
+		return err
+	}
+	return checktext("hostname", s.Hostname)
+}
+
+// Names are just names, anything that looks like a path is refused
+func (f FileMeta) Validate() error {
+	if f.Name == "" || f.Name == "." || f.Name == ".." || len(f.Name) > maxName || strings.ContainsAny(f.Name, "/\\\x00") {
+		return newerror(ErrInvalid, "bad file name %q", f.Name)
+	}
+	if f.Size < 0 {
+		return newerror(ErrInvalid, "negative size for %s", f.Name)
+	}
+	if !hashpattern.MatchString(f.Hash) {
+		return newerror(ErrInvalid, "bad hash for %s", f.Name)
+	}
+	return nil
+}
+
+func (k PublicKey) Validate() error {
+	bits := len(k.N) * 8
+	if bits < minRSABits || bits > maxRSABits {
+		return newerror(ErrInvalid, "rsa key of %d bits", bits)
+	}
+	if k.E < 3 || k.E%2 == 0 {
+		return newerror(ErrInvalid, "bad rsa exponent %d", k.E)
+	}
+	return nil
+}
+
+func (m Accept) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	if len(m.Key) == 0 || len(m.Key) > maxRSABits/8 {
+		return newerror(ErrInvalid, "accept without a usable key")
+	}
+	return checkstreams(m.Streams)
+}
+
+func (m Reject) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	return checktext("reason", m.Reason)
+}
+
+func (m Chunk) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	if m.Index < 0 || m.File < 0 || m.File >= MaxFiles || m.Offset < 0 {
+		return newerror(ErrInvalid, "chunk outside of the offer")
+	}
+	if len(m.Data) > MaxChunkData {
+		return newerror(ErrTooLarge, "chunk of %d bytes", len(m.Data))
+	}
+	return nil
+}
+
+func (m Ack) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	if m.Index < 0 {
+		return newerror(ErrInvalid, "negative chunk index")
+	}
+	return nil
+}
+
+func (m Close) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	return checktext("reason", m.Reason)
+}
+
+func (m Control) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	switch m.Action {
+	case ActionPause, ActionResume, ActionCancel:
+	default:
+		return newerror(ErrInvalid, "unknown action %q", m.Action)
+	}
+	return checktext("reason", m.Reason)
+}
+
+func (m Note) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	if err := m.Sender.Validate(); err != nil {
+		return err
+	}
+	if m.Sent <= 0 {
+		return newerror(ErrInvalid, "note without a time")
+	}
+	if len(m.Sealed) == 0 {
+		return newerror(ErrInvalid, "empty note")
+	}
+	if len(m.Sealed) > maxSealed {
+		return newerror(ErrTooLarge, "note of %d bytes", len(m.Sealed))
+	}
+	return nil
+}
+
+func (m ChatOpen) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	if err := m.Sender.Validate(); err != nil {
+		return err
+	}
+	if len(m.Key) != 32 {
+		return newerror(ErrInvalid, "chat key of %d bytes", len(m.Key))
+	}
+	return nil
+}
+
+func (m ChatLine) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	if m.Seq < 1 {
+		return newerror(ErrInvalid, "chat line %d", m.Seq)
+	}
+	if len(m.Sealed) == 0 {
+		return newerror(ErrInvalid, "empty chat line")
+	}
+	if len(m.Sealed) > maxChatLine {
+		return newerror(ErrTooLarge, "chat line of %d bytes", len(m.Sealed))
+	}
+	return nil
+}
+
+func (m Receipt) Validate() error {
+	if err := checkid(m.About); err != nil {
+		return err
+	}
+	switch m.Kind {
+	case ReceiptDelivered, ReceiptRead:
+	default:
+		return newerror(ErrInvalid, "unknown receipt %q", m.Kind)
+	}
+	if m.At <= 0 {
+		return newerror(ErrInvalid, "receipt without a time")
+	}
+	return nil
+}
+
+func (m Retract) Validate() error {
+	if err := checkid(m.ID); err != nil {
+		return err
+	}
+	return checktext("reason", m.Reason)
+}
+
+func (m Wormhole) Validate() error {
+	if m.Nameplate < 1 || m.Nameplate > MaxNameplate {
+		return newerror(ErrInvalid, "nameplate %d", m.Nameplate)
+	}
+	if len(m.PAKE) == 0 && len(m.Confirm) == 0 {
+		return newerror(ErrInvalid, "empty wormhole step")
+	}
+	if len(m.PAKE) != 0 && len(m.PAKE) != pakeSize {
+		return newerror(ErrInvalid, "key exchange message of %d bytes", len(m.PAKE))
+	}
+	if len(m.Confirm) != 0 && len(m.Confirm) != confirmSize {
+		return newerror(ErrInvalid, "confirmation of %d bytes", len(m.Confirm))
+	}
+	return nil
+}
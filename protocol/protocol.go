@@ -0,0 +1,290 @@
+package protocol
+
+// The QFServer wire protocol
+// Every message is a JSON envelope: {"v":2,"type":"offer","body":{...},"from":...,"key":...,"nonce":...,"time":...,"sig":...}
+// Decoding is strict. Unknown fields, trailing data, a missing body or anything over the size limit
+// is an error instead of a half filled struct.
+// Every envelope is signed by the node that sent it. The node id is derived from the signing key,
+// so an envelope proves who it's from without us having to know the node first. The nonce and
+// time are covered by the signature, a Guard (guard.go) uses them to refuse replays.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Version 2 added the signature, nonce and time to the envelope
+const Version = 2
+
+// Size limits for a whole envelope
+const (
+	MaxMessageSize = 256 << 10                         // Control messages (hello, offer, accept...)
+	MaxChunkSize   = MaxChunkData*4/3 + MaxMessageSize // A chunk, base64 makes the data a third bigger
+)
+
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    Type            `json:"type"`
+	Body    json.RawMessage `json:"body"`
+	From    string          `json:"from"`  // Node id of the sender
+	Key     []byte          `json:"key"`   // Its ed25519 public key, From has to match it
+	Nonce   string          `json:"nonce"` // Random, never used twice
+	Time    int64           `json:"time"`  // When it was sent, unix milliseconds
+	Sig     []byte          `json:"sig"`
+}
+
+// Who sent a message and when, once the signature checked out
+type Origin struct {
+	NodeID string
+	Key    ed25519.PublicKey
+	Nonce  string
+	Time   time.Time
+}
+
+var noncepattern = regexp.MustCompile("^[0-9a-f]{32}$")
+
+// The key everything we send is signed with. Set once the node knows who it is
+var (
+	signer   ed25519.PrivateKey
+	signermu sync.RWMutex
+)
+
+func SetSigner(key ed25519.PrivateKey) {
+	signermu.Lock()
+	defer signermu.Unlock()
+	signer = key
+}
+
+// Short id for a node, derived from its signing key
+func NodeID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// What the signature covers. Every field goes in with its length so nothing can be shifted around
+// Learning: Signing the digest instead of the whole envelope keeps big chunks cheap to sign
+func digest(e Envelope) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("qfserver envelope"))
+
+	field := func(value []byte) {
+		length := make([]byte, 8)
+		binary.BigEndian.PutUint64(length, uint64(len(value)))
+		hash.Write(length)
+		hash.Write(value)
+	}
+
+	stamp := make([]byte, 8)
+	binary.BigEndian.PutUint64(stamp, uint64(e.Time))
+
+	field([]byte{byte(e.Version)})
+	field([]byte(e.Type))
+	field(e.Body)
+	field([]byte(e.From))
+	field(e.Key)
+	field([]byte(e.Nonce))
+	field(stamp)
+
+	return hash.Sum(nil)
+}
+
+// Turn a message into its signed wire form
+func Marshal(m Message) ([]byte, error) {
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+
+	signermu.RLock()
+	key := signer
+	signermu.RUnlock()
+	if key == nil {
+		return nil, errors.New("protocol: no key to sign with")
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	public := key.Public().(ed25519.PublicKey)
+	envelope := Envelope{
+		Version: Version,
+		Type:    m.Type(),
+		Body:    body,
+		From:    NodeID(public),
+		Key:     public,
+		Nonce:   hex.EncodeToString(nonce),
+		Time:    time.Now().UnixMilli(),
+	}
+	envelope.Sig = ed25519.Sign(key, digest(envelope))
+
+	return json.Marshal(envelope)
+}
+
+// Write a message
+func Encode(w io.Writer, m Message) error {
+	content, err := Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(content)
+	return err
+}
+
+// Read exactly one message, no more than limit bytes
+func Decode(r io.Reader, limit int64) (Message, error) {
+	m, _, err := DecodeFrom(r, limit)
+	return m, err
+}
+
+// Decode and also say who it's from
+func DecodeFrom(r io.Reader, limit int64) (Message, Origin, error) {
+	// Learning: Read one byte past the limit, if we get it the message was too big
+	content, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, Origin{}, newerror(ErrMalformed, "%v", err)
+	}
+	if int64(len(content)) > limit {
+		return nil, Origin{}, newerror(ErrTooLarge, "over %d bytes", limit)
+	}
+
+	return UnmarshalFrom(content)
+}
+
+// Decode a message we already have in memory
+func Unmarshal(content []byte) (Message, error) {
+	m, _, err := UnmarshalFrom(content)
+	return m, err
+}
+
+// Decode a message we already have in memory and say who it's from
+func UnmarshalFrom(content []byte) (Message, Origin, error) {
+	envelope := Envelope{}
+	if err := strictjson(content, &envelope); err != nil {
+		return nil, Origin{}, err
+	}
+
+	if envelope.Version != Version {
+		return nil, Origin{}, newerror(ErrVersion, "got %d, we speak %d", envelope.Version, Version)
+	}
+
+	origin, err := verify(envelope)
+	if err != nil {
+		return nil, Origin{}, err
+	}
+
+	m, ok := newmessage(envelope.Type)
+	if !ok {
+		return nil, Origin{}, newerror(ErrUnknownType, "%q", envelope.Type)
+	}
+
+	if len(envelope.Body) == 0 {
+		return nil, Origin{}, newerror(ErrMalformed, "missing body")
+	}
+	if err := strictjson(envelope.Body, m); err != nil {
+		return nil, Origin{}, err
+	}
+
+	if err := m.Validate(); err != nil {
+		return nil, Origin{}, err
+	}
+
+	// Hand back values, not pointers, so callers can switch on protocol.Offer etc
+	return deref(m), origin, nil
+}
+
+// Check the signature and that the sender is who the key says
+func verify(e Envelope) (Origin, error) {
+	if len(e.Key) != ed25519.PublicKeySize {
+		return Origin{}, newerror(ErrSignature, "no usable key")
+	}
+	if NodeID(e.Key) != e.From {
+		return Origin{}, newerror(ErrSignature, "%s isn't the node id of its key", e.From)
+	}
+	if !noncepattern.MatchString(e.Nonce) {
+		return Origin{}, newerror(ErrInvalid, "bad nonce")
+	}
+	if !ed25519.Verify(e.Key, digest(e), e.Sig) {
+		return Origin{}, newerror(ErrSignature, "from %s", e.From)
+	}
+
+	return Origin{NodeID: e.From, Key: ed25519.PublicKey(e.Key), Nonce: e.Nonce, Time: time.UnixMilli(e.Time)}, nil
+}
+
+// Decode and insist on one type of message
+func Expect(r io.Reader, limit int64, t Type) (Message, error) {
+	m, err := Decode(r, limit)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type() != t {
+		return nil, newerror(ErrUnexpected, "wanted %s, got %s", t, m.Type())
+	}
+	return m, nil
+}
+
+// json.Unmarshal but unknown fields and trailing data are errors
+func strictjson(content []byte, v any) error {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		return newerror(ErrMalformed, "%v", err)
+	}
+
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return newerror(ErrMalformed, "trailing data")
+	}
+
+	return nil
+}
+
+func deref(m Message) Message {
+	switch v := m.(type) {
+	case *Hello:
+		return *v
+	case *Offer:
+		return *v
+	case *Accept:
+		return *v
+	case *Reject:
+		return *v
+	case *Chunk:
+		return *v
+	case *Ack:
+		return *v
+	case *Close:
+		return *v
+	case *Control:
+		return *v
+	case *Note:
+		return *v
+	case *ChatOpen:
+		return *v
+	case *ChatLine:
+		return *v
+	case *Receipt:
+		return *v
+	case *Retract:
+		return *v
+	case *Wormhole:
+		return *v
+	}
+	return m
+}
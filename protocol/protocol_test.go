@@ -0,0 +1,252 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testid = "0123456789abcdef0123456789abcdef"
+
+var testkey = func() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	SetSigner(key)
+	return key
+}()
+
+// One valid message of every type
+func testmessages() []Message {
+	sender := Sender{NodeID: NodeID(testkey.Public().(ed25519.PublicKey)), Hostname: "host"}
+	return []Message{
+		Hello{Service: "QFServer", Software: "test", NodeID: sender.NodeID, Hostname: "host", Keys: Keys{Sign: "c2lnbg==", Box: "Ym94"}},
+		Offer{
+			ID:        testid,
+			Endpoint:  "/conn/" + testid,
+			Key:       PublicKey{N: bytes.Repeat([]byte{0xff}, minRSABits/8), E: 65537},
+			Sender:    sender,
+			Files:     []FileMeta{{Name: "a.txt", Size: 3, Hash: strings.Repeat("ab", 32)}, {Name: "b.txt", Size: 4, Hash: strings.Repeat("cd", 32)}},
+			TotalSize: 7,
+			Message:   "hi",
+			Streams:   2,
+			Expires:   time.Now().Add(time.Hour).UnixMilli(),
+			Downloads: 3,
+		},
+		Accept{ID: testid, Key: []byte("session"), Streams: 2},
+		Reject{ID: testid, Reason: "no"},
+		Chunk{ID: testid, Index: 1, File: 1, Offset: 4, Data: []byte("data")},
+		Ack{ID: testid, Index: 1},
+		Close{ID: testid, Reason: "done"},
+		Control{ID: testid, Action: ActionPause},
+		Note{ID: testid, Sender: sender, Sent: time.Now().UnixMilli(), Sealed: []byte("sealed")},
+		ChatOpen{ID: testid, Sender: sender, Key: bytes.Repeat([]byte{1}, 32)},
+		ChatLine{ID: testid, Seq: 1, Sealed: []byte("sealed")},
+		Receipt{About: testid, Kind: ReceiptRead, At: time.Now().UnixMilli()},
+		Retract{ID: testid, Reason: "changed my mind"},
+		Wormhole{Nameplate: 7, PAKE: bytes.Repeat([]byte{2}, pakeSize), Confirm: bytes.Repeat([]byte{3}, confirmSize)},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, m := range testmessages() {
+		t.Run(string(m.Type()), func(t *testing.T) {
+			content, err := Marshal(m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, origin, err := UnmarshalFrom(content)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Fatalf("got %#v, want %#v", got, m)
+			}
+			if origin.NodeID != NodeID(testkey.Public().(ed25519.PublicKey)) {
+				t.Fatalf("from %s", origin.NodeID)
+			}
+
+			// And the same as a frame
+			buffer := &bytes.Buffer{}
+			if err := WriteFrame(buffer, m); err != nil {
+				t.Fatal(err)
+			}
+			got, err = ReadFrame(buffer, MaxChunkSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, m) {
+				t.Fatalf("frame got %#v, want %#v", got, m)
+			}
+		})
+	}
+}
+
+// A signed envelope to take apart. resign puts a valid signature back on after changing it
+func testenvelope(t *testing.T) Envelope {
+	content, err := Marshal(Ack{ID: testid, Index: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := Envelope{}
+	if err := json.Unmarshal(content, &e); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func resign(e Envelope) Envelope {
+	e.Sig = ed25519.Sign(testkey, digest(e))
+	return e
+}
+
+func wire(t *testing.T, e Envelope) []byte {
+	content, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestDecodeRejects(t *testing.T) {
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		content func(t *testing.T, e Envelope) []byte
+		want    error
+	}{
+		{"unknown envelope field", func(t *testing.T, e Envelope) []byte {
+			content := wire(t, e)
+			return append(content[:len(content)-1], []byte(`,"extra":1}`)...)
+		}, ErrMalformed},
+		{"unknown body field", func(t *testing.T, e Envelope) []byte {
+			e.Body = json.RawMessage(`{"id":"` + testid + `","index":1,"extra":1}`)
+			return wire(t, resign(e))
+		}, ErrMalformed},
+		{"trailing data", func(t *testing.T, e Envelope) []byte {
+			return append(wire(t, e), []byte(`{}`)...)
+		}, ErrMalformed},
+		{"not json", func(t *testing.T, e Envelope) []byte {
+			return []byte("hello")
+		}, ErrMalformed},
+		{"missing body", func(t *testing.T, e Envelope) []byte {
+			e.Body = nil
+			fields := map[string]any{}
+			if err := json.Unmarshal(wire(t, resign(e)), &fields); err != nil {
+				t.Fatal(err)
+			}
+			delete(fields, "body")
+			content, err := json.Marshal(fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return content
+		}, ErrMalformed},
+		{"old version", func(t *testing.T, e Envelope) []byte {
+			e.Version = 1
+			return wire(t, resign(e))
+		}, ErrVersion},
+		{"newer version", func(t *testing.T, e Envelope) []byte {
+			e.Version = Version + 1
+			return wire(t, resign(e))
+		}, ErrVersion},
+		{"flipped signature", func(t *testing.T, e Envelope) []byte {
+			e.Sig[0] ^= 1
+			return wire(t, e)
+		}, ErrSignature},
+		{"body changed after signing", func(t *testing.T, e Envelope) []byte {
+			e.Body = json.RawMessage(`{"id":"` + testid + `","index":2}`)
+			return wire(t, e)
+		}, ErrSignature},
+		{"signed by someone else", func(t *testing.T, e Envelope) []byte {
+			e.Sig = ed25519.Sign(other, digest(e))
+			return wire(t, e)
+		}, ErrSignature},
+		{"node id of another key", func(t *testing.T, e Envelope) []byte {
+			e.From = NodeID(other.Public().(ed25519.PublicKey))
+			return wire(t, resign(e))
+		}, ErrSignature},
+		{"no key", func(t *testing.T, e Envelope) []byte {
+			e.Key = nil
+			return wire(t, e)
+		}, ErrSignature},
+		{"unknown type", func(t *testing.T, e Envelope) []byte {
+			e.Type = "bogus"
+			return wire(t, resign(e))
+		}, ErrUnknownType},
+		{"bad nonce", func(t *testing.T, e Envelope) []byte {
+			e.Nonce = "xyz"
+			return wire(t, resign(e))
+		}, ErrInvalid},
+		{"invalid body", func(t *testing.T, e Envelope) []byte {
+			e.Body = json.RawMessage(`{"id":"../../etc","index":1}`)
+			return wire(t, resign(e))
+		}, ErrInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unmarshal(tt.content(t, testenvelope(t)))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeOversize(t *testing.T) {
+	content := wire(t, testenvelope(t))
+
+	tests := []struct {
+		name  string
+		limit int64
+		want  error
+	}{
+		{"fits", int64(len(content)), nil},
+		{"one byte over", int64(len(content)) - 1, ErrTooLarge},
+		{"way over", 16, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(bytes.NewReader(content), tt.limit)
+			if tt.want == nil && err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// A frame says how long it is, too long is refused before reading it
+	buffer := &bytes.Buffer{}
+	if err := WriteFrame(buffer, Ack{ID: testid, Index: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadFrame(buffer, 16); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("frame got %v", err)
+	}
+}
+
+func TestExpect(t *testing.T) {
+	content, err := Marshal(Ack{ID: testid, Index: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Expect(bytes.NewReader(content), MaxMessageSize, TypeAck); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Expect(bytes.NewReader(content), MaxMessageSize, TypeOffer); !errors.Is(err, ErrUnexpected) {
+		t.Fatalf("got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+)
+
+// Address handling
+// Learning: strings.Split(addr, ":")[0] only works for IPv4. For IPv6 "[fe80::1%eth0]:8080" turns into "[fe80"
+// netip.AddrPort understands both (and zones), so everything coming off the wire goes through here.
+
+// The port we listen on for http and udp
+const serverport = 8080
+
+// Link-local all-nodes multicast group, the IPv6 version of a broadcast
+var ipv6allnodes = netip.MustParseAddr("ff02::1")
+
+// Get the address and port of whoever made the request
+func remoteaddr(r *http.Request) (netip.AddrPort, error) {
+	addrport, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	// Dual-stack sockets give us IPv4 as ::ffff:a.b.c.d
+	return netip.AddrPortFrom(addrport.Addr().Unmap(), addrport.Port()), nil
+}
+
+// Same as above for addresses coming from a udp read or the address book
+func unmapped(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
+
+// The key used in the pools. Zones are kept ("fe80::1%eth0") since link-local addresses are useless without one
+func poolkey(addr netip.Addr) string {
+	return addr.Unmap().String()
+}
+
+// Build the url for an endpoint on a node
+// Learning: zones have to be written as %25 inside of a url. url.URL does that for us
+func nodeurl(addr netip.AddrPort, path string) string {
+	u := url.URL{
+		Scheme: "http",
+		Host:   unmapped(addr).String(),
+		Path:   path,
+	}
+	return u.String()
+}
+
+// How a node's server goes by in the pool, and anywhere a peer is named: the address alone on serverport,
+// with the port otherwise. resolvepeer turns it back into the same AddrPort
+func peername(target netip.AddrPort) string {
+	if target.Port() == serverport {
+		return poolkey(target.Addr())
+	}
+	return unmapped(target).String()
+}
+
+// Where a node that reached us serves its own endpoints. Its request came from a random port, so it's
+// the port we know it by: a scanned node on another port, an address book entry with one, or serverport.
+// Don't hold the pool lock
+func (si *ServerInstance) peeraddr(addr netip.Addr, node string) netip.AddrPort {
+	addr = addr.Unmap()
+
+	si.poolmu.RLock()
+	for key, peer := range si.pingpool {
+		target, err := netip.ParseAddrPort(key)
+		if err == nil && peer.NodeID == node && unmapped(target).Addr() == addr {
+			si.poolmu.RUnlock()
+			return unmapped(target)
+		}
+	}
+	si.poolmu.RUnlock()
+
+	// Learning: Only entries written as an IP count, resolving every name in the book here would hold up the request
+	for _, entry := range getaddressbook().list() {
+		host, port, err := splitpeeraddress(entry.Address)
+		if err != nil {
+			continue
+		}
+		if entryaddr, err := netip.ParseAddr(host); err == nil && entryaddr.Unmap() == addr {
+			return netip.AddrPortFrom(addr, uint16(port))
+		}
+	}
+
+	return netip.AddrPortFrom(addr, serverport)
+}
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/QFServer/log"
+)
+
+// The address book. Peers we can't discover (routed VLANs, other subnets) get added by hand
+// and kept in addressbook.json next to the config
+type BookEntry struct {
+	Alias   string     `json:"alias"`
+	Address string     `json:"address"` // host or host:port
+	Notes   string     `json:"notes,omitempty"`
+	Keys    PinnedKeys `json:"keys"`
+}
+
+// Identity keys we trust for a peer, base64 encoded
+type PinnedKeys struct {
+	Sign string `json:"sign,omitempty"`
+	Box  string `json:"box,omitempty"`
+}
+
+type addressbook struct {
+	Entries []BookEntry         `json:"entries"`
+	Groups  map[string][]string `json:"groups,omitempty"` // Named lists of aliases or addresses, @name sends to all of them
+	mu      sync.Mutex
+}
+
+const (
+	addressbookfile = "addressbook.json"
+	maxbooknotes    = 1024 // Notes are for a line or two about the peer
+)
+
+// One DNS label, letters digits and dashes, not starting or ending with a dash
+var hostlabel = regexp.MustCompile("^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$")
+
+var (
+	bookinstance *addressbook
+	bookonce     sync.Once
+)
+
+// The address book is a singleton, it's needed with or without the server running
+func getaddressbook() *addressbook {
+	bookonce.Do(func() {
+		bookinstance = &addressbook{Entries: make([]BookEntry, 0)}
+
+		dir, err := configdir()
+		if err != nil {
+			return
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, addressbookfile))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.GetInstance().Debug("BOOK", "Could not read the address book: "+err.Error())
+			}
+			return
+		}
+
+		if err := json.Unmarshal(content, bookinstance); err != nil {
+			log.GetInstance().Output("BOOK", "Address book is broken: "+err.Error())
+		}
+	})
+
+	return bookinstance
+}
+
+// Write the book to disk. Must hold the lock
+func (ab *addressbook) save() error {
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(ab, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, addressbookfile), content, 0600)
+}
+
+// Add an entry. Aliases are unique
+func (ab *addressbook) add(entry BookEntry) error {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	for _, e := range ab.Entries {
+		if entry.Alias != "" && e.Alias == entry.Alias {
+			return fmt.Errorf("alias %s is already used by %s", entry.Alias, e.Address)
+		}
+		if e.Address == entry.Address {
+			return fmt.Errorf("%s is already in the address book", entry.Address)
+		}
+	}
+
+	ab.Entries = append(ab.Entries, entry)
+	return ab.save()
+}
+
+// Find an entry by alias
+func (ab *addressbook) lookup(alias string) (BookEntry, bool) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	for _, e := range ab.Entries {
+		if e.Alias == alias {
+			return e, true
+		}
+	}
+
+	return BookEntry{}, false
+}
+
+// Set a group, or drop it when there are no members
+func (ab *addressbook) setgroup(name string, members []string) error {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	if len(members) == 0 {
+		if _, ok := ab.Groups[name]; !ok {
+			return fmt.Errorf("there is no group %s", name)
+		}
+		delete(ab.Groups, name)
+		return ab.save()
+	}
+
+	// Learning: Check the members now, a typo found at send time means one laptop quietly misses out
+	for _, member := range members {
+		known := false
+		for _, e := range ab.Entries {
+			known = known || e.Alias == member
+		}
+		if known {
+			continue
+		}
+		// Not an alias, so it has to look like an address, a bare word is more likely a typo than a hostname
+		if _, _, err := splitpeeraddress(member); err != nil || !strings.ContainsAny(member, ".:") {
+			return fmt.Errorf("%s isn't an alias or an address", member)
+		}
+	}
+
+	if ab.Groups == nil {
+		ab.Groups = make(map[string][]string)
+	}
+	ab.Groups[name] = members
+	return ab.save()
+}
+
+// Members of a group
+func (ab *addressbook) group(name string) ([]string, bool) {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	members, ok := ab.Groups[name]
+	return append([]string(nil), members...), ok
+}
+
+// Trust on first use. The first keys we see for an entry are pinned, after that they have to match
+func (ab *addressbook) pin(target netip.AddrPort, keys PinnedKeys) error {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	changed := false
+	for i, e := range ab.Entries {
+		resolved, err := resolvepeeraddress(e.Address)
+		if err != nil || resolved != unmapped(target) {
+			continue
+		}
+
+		if e.Keys.Sign == "" {
+			ab.Entries[i].Keys = keys
+			changed = true
+		} else if e.Keys.Box == "" && e.Keys.Sign == keys.Sign {
+			// Pinned by hand with only the signing key, the box key comes with the first hello
+			ab.Entries[i].Keys.Box = keys.Box
+			changed = true
+		} else if e.Keys != keys {
+			return fmt.Errorf("keys don't match the ones pinned for %s", e.Alias)
+		}
+	}
+
+	if changed {
+		return ab.save()
+	}
+	return nil
+}
+
+// Change the entry with this alias or address
+func (ab *addressbook) update(peer string, change func(*BookEntry)) error {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	for i, e := range ab.Entries {
+		if e.Alias == peer || e.Address == peer {
+			change(&ab.Entries[i])
+			return ab.save()
+		}
+	}
+	return fmt.Errorf("%s isn't in the address book, add it first with util server add", peer)
+}
+
+// Copy of all the entries
+func (ab *addressbook) list() []BookEntry {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	entries := make([]BookEntry, len(ab.Entries))
+	copy(entries, ab.Entries)
+	return entries
+}
+
+// Split host[:port] and fill in our port when there isn't one. The host has to be an IP or a DNS name,
+// an IPv6 address with a port goes in brackets
+// Learning: net.SplitHostPort wants brackets around IPv6, so a bare "fe80::1" is tried as an address first
+func splitpeeraddress(address string) (string, int, error) {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return addr.String(), serverport, nil
+	}
+
+	host, port := address, serverport
+	if splithost, splitport, err := net.SplitHostPort(address); err == nil {
+		portnum, err := strconv.Atoi(splitport)
+		if err != nil || portnum < 1 || portnum > 65535 {
+			return "", 0, fmt.Errorf("bad port in %s", address)
+		}
+		if addr, err := netip.ParseAddr(splithost); err == nil {
+			return addr.String(), portnum, nil
+		}
+		// Brackets are only for IPv6, [name]:port is a typo
+		if strings.HasPrefix(address, "[") {
+			return "", 0, fmt.Errorf("%s isn't an IPv6 address", splithost)
+		}
+		host, port = splithost, portnum
+	}
+
+	if !validhostname(host) {
+		return "", 0, fmt.Errorf("%s isn't an IP, IP:port, [IPv6]:port or host name", address)
+	}
+	return host, port, nil
+}
+
+// A DNS name: labels of up to 63 characters, 253 in all, and the last label isn't only digits
+// (that's a broken IPv4 address, not a name)
+func validhostname(host string) bool {
+	host = strings.TrimSuffix(host, ".")
+	if host == "" || len(host) > 253 {
+		return false
+	}
+
+	labels := strings.Split(host, ".")
+	for _, label := range labels {
+		if !hostlabel.MatchString(label) {
+			return false
+		}
+	}
+
+	_, err := strconv.Atoi(labels[len(labels)-1])
+	return err != nil
+}
+
+// Resolve host[:port] to something we can connect to
+func resolvepeeraddress(address string) (netip.AddrPort, error) {
+	host, port, err := splitpeeraddress(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", host)
+	if err != nil || len(addrs) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("could not resolve %s", host)
+	}
+
+	return netip.AddrPortFrom(addrs[0].Unmap(), uint16(port)), nil
+}
+
+// Resolve a peer the user typed in. Aliases first, then pool addresses
+func resolvepeer(name string) (netip.AddrPort, error) {
+	if entry, ok := getaddressbook().lookup(name); ok {
+		return resolvepeeraddress(entry.Address)
+	}
+
+	return resolvepeeraddress(name)
+}
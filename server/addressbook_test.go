@@ -0,0 +1,48 @@
+package server
+
+import "testing"
+
+func TestSplitPeerAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		host    string
+		port    int
+		ok      bool
+	}{
+		{"10.0.0.7", "10.0.0.7", serverport, true},
+		{"10.0.0.7:9000", "10.0.0.7", 9000, true},
+		{"fe80::1", "fe80::1", serverport, true},
+		{"[fe80::1]:9000", "fe80::1", 9000, true},
+		{"laptop", "laptop", serverport, true},
+		{"laptop.lan:9000", "laptop.lan", 9000, true},
+		{"files.example.com.", "files.example.com.", serverport, true},
+		{"[fe80::1]", "", 0, false},
+		{"a:b:c", "", 0, false},
+		{"[laptop]:9000", "", 0, false},
+		{"10.0.0.7:0", "", 0, false},
+		{"10.0.0.7:70000", "", 0, false},
+		{"10.0.0.7:http", "", 0, false},
+		{"10.0.0.300", "", 0, false},
+		{"-laptop", "", 0, false},
+		{"lap top", "", 0, false},
+		{"laptop/../x", "", 0, false},
+		{"", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			host, port, err := splitpeeraddress(tt.address)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("accepted as %s port %d", host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tt.host || port != tt.port {
+				t.Fatalf("got %s port %d, want %s port %d", host, port, tt.host, tt.port)
+			}
+		})
+	}
+}
@@ -0,0 +1,595 @@
+package server
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	Crypt "github.com/QFServer/crypt"
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Chat
+// A conversation with one peer that stays open for as long as both want it. Whoever starts it posts to
+// /chat and keeps the request body open, the other side answers with a response it flushes frame by frame.
+// 1. Both sides send a ChatOpen with a fresh X25519 key, signed like everything else
+// 2. The two keys give a shared secret, HKDF makes one AES-GCM key per direction out of it
+// 3. Lines go as ChatLines sealed with the sender's key, the other side answers every one with an Ack
+// A file dropped in with /file goes out as a normal offer, the chat only says which transfer it is
+
+const (
+	maxchats     = 16
+	chatopentime = 10 * time.Second // To get the other side's ChatOpen
+	chatacktime  = 10 * time.Second // A line without an ack by then is shown as not delivered yet
+)
+
+// What's sealed in a ChatLine
+type chatbody struct {
+	Text     string `json:"text,omitempty"`
+	Sent     int64  `json:"sent"`               // Unix milliseconds
+	Transfer string `json:"transfer,omitempty"` // A file dropped in the chat, offered as this transfer
+	Name     string `json:"name,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// One open chat
+type ChatSession struct {
+	id   string
+	name string // Alias or address we reach the peer by
+	addr netip.Addr
+	peer protocol.Sender
+	send cipher.AEAD // Our lines
+	recv cipher.AEAD // Theirs
+
+	mu       sync.Mutex
+	out      io.Writer
+	flush    func() error // Server side, every frame has to be flushed out of the response
+	stop     func()       // Ends our half of the stream
+	seq      int          // Last line we sent
+	theirs   int          // Last line we got
+	pending  map[int]chatbody
+	lastfile string // The last transfer the peer dropped in
+
+	done    chan struct{}
+	endonce sync.Once
+}
+
+type chatregistry struct {
+	mu       sync.Mutex
+	sessions map[*ChatSession]bool
+}
+
+var (
+	chatinstance *chatregistry
+	chatonce     sync.Once
+)
+
+func getchats() *chatregistry {
+	chatonce.Do(func() {
+		chatinstance = &chatregistry{sessions: make(map[*ChatSession]bool)}
+	})
+	return chatinstance
+}
+
+// An open chat with a peer, if there is one
+func (cr *chatregistry) find(name string) *ChatSession {
+	addr := netip.Addr{}
+	if target, err := resolvepeer(name); err == nil {
+		addr = target.Addr()
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for s := range cr.sessions {
+		if s.name == name || s.addr == addr {
+			return s
+		}
+	}
+	return nil
+}
+
+func (cr *chatregistry) add(s *ChatSession) error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if len(cr.sessions) >= maxchats {
+		return fmt.Errorf("already %d chats open", maxchats)
+	}
+	cr.sessions[s] = true
+	return nil
+}
+
+// End every chat, the server is going away
+func (cr *chatregistry) endall(reason string) {
+	cr.mu.Lock()
+	sessions := make([]*ChatSession, 0, len(cr.sessions))
+	for s := range cr.sessions {
+		sessions = append(sessions, s)
+	}
+	cr.mu.Unlock()
+
+	for _, s := range sessions {
+		s.Close(reason)
+	}
+}
+
+// The AES-GCM keys for both directions. Each side's key is tied to its node id,
+// so the two directions never share a key and the sequence numbers can be the nonces
+func chatkeys(private *ecdh.PrivateKey, theirkey []byte, id string, ours string, theirs string) (cipher.AEAD, cipher.AEAD, error) {
+	public, err := ecdh.X25519().NewPublicKey(theirkey)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aeads := make([]cipher.AEAD, 2)
+	for i, nodeid := range []string{ours, theirs} {
+		key, err := hkdf.Key(sha256.New, shared, []byte(id), "QFServer chat "+nodeid, 32)
+		if err != nil {
+			return nil, nil, err
+		}
+		if aeads[i], err = Crypt.NewAEAD(key); err != nil {
+			return nil, nil, err
+		}
+	}
+	return aeads[0], aeads[1], nil
+}
+
+func chatnonce(seq int) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(seq))
+	return nonce
+}
+
+func (si *ServerInstance) sender() protocol.Sender {
+	return protocol.Sender{NodeID: getidentity().nodeid(), Hostname: si.clienthostname}
+}
+
+// The chat with a peer. Joins the one that's open, or starts a new one
+func (si *ServerInstance) Chat(name string) (*ChatSession, error) {
+	if !CheckServerAlive() {
+		return nil, errors.New("the server isn't alive")
+	}
+	if s := getchats().find(name); s != nil {
+		return s, nil
+	}
+
+	target, info, err := si.directpeer(name, "chats")
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := newid()
+
+	// Learning: A request body with no length goes out chunked, so the pipe keeps it open for as long as we talk.
+	// No client timeout either, that would count the whole conversation
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	// Learning: Cancelling isn't enough, the transport waits for the body to finish before Do gives up
+	opening := time.AfterFunc(chatopentime, func() {
+		cancel()
+		writer.CloseWithError(context.DeadlineExceeded)
+	})
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nodeurl(target, "/chat"), reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	go func() {
+		open := protocol.ChatOpen{ID: id, Sender: si.sender(), Key: private.PublicKey().Bytes()}
+		if err := protocol.WriteFrame(writer, open); err != nil {
+			writer.CloseWithError(err)
+		}
+	}()
+
+	fail := func(err error) (*ChatSession, error) {
+		opening.Stop()
+		writer.Close()
+		cancel()
+		return nil, err
+	}
+
+	resp, err := (&http.Client{}).Do(req)
+	if err != nil {
+		return fail(fmt.Errorf("%w: %v", errunreachable, err))
+	}
+	if err := readproblem(resp); err != nil {
+		resp.Body.Close()
+		return fail(err)
+	}
+
+	// Their half has to come from the node we probed, signed with the key we pinned
+	m, origin, err := getguard().ReadFrame(resp.Body, protocol.MaxMessageSize)
+	if err == nil && (origin.NodeID != info.NodeID || base64.StdEncoding.EncodeToString(origin.Key) != info.Keys.Sign) {
+		err = fmt.Errorf("%w: chat answered by %s, not %s", protocol.ErrSignature, origin.NodeID, info.NodeID)
+	}
+	open, ok := m.(protocol.ChatOpen)
+	if err == nil && (!ok || open.ID != id) {
+		err = errors.New("the other side didn't open the chat")
+	}
+	if err != nil {
+		resp.Body.Close()
+		return fail(err)
+	}
+	opening.Stop()
+
+	send, recv, err := chatkeys(private, open.Key, id, getidentity().nodeid(), info.NodeID)
+	if err != nil {
+		resp.Body.Close()
+		return fail(err)
+	}
+
+	s := &ChatSession{
+		id:      id,
+		name:    name,
+		addr:    target.Addr(),
+		peer:    protocol.Sender{NodeID: info.NodeID, Hostname: info.Hostname},
+		send:    send,
+		recv:    recv,
+		out:     writer,
+		stop:    func() { writer.Close() },
+		pending: make(map[int]chatbody),
+		done:    make(chan struct{}),
+	}
+	if err := getchats().add(s); err != nil {
+		resp.Body.Close()
+		return fail(err)
+	}
+
+	go func() {
+		s.readloop(resp.Body)
+		resp.Body.Close()
+		cancel()
+	}()
+	return s, nil
+}
+
+// Someone opened a chat with us. The handler lives as long as the chat does
+func (si *ServerInstance) handlechat(w http.ResponseWriter, r *http.Request) {
+	// Learning: Go's server won't let a handler read the body once it started answering, unless it's told to.
+	// Without it a refusal would also hang, the server first tries to read the rest of a body that never ends
+	rc := http.NewResponseController(w)
+	if err := rc.EnableFullDuplex(); err != nil {
+		writeproblem(w, http.StatusInternalServerError, protocol.CodeUnavailable, err.Error())
+		return
+	}
+
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+
+	m, origin, err := getguard().ReadFrame(r.Body, protocol.MaxMessageSize)
+	if err == nil {
+		// Learning: ReadFrame only checks the clock, the opening frame also has to be one we never saw
+		err = getguard().Check(origin.NodeID+"/"+origin.Nonce, origin.Time)
+	}
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+	open, ok := m.(protocol.ChatOpen)
+	if !ok {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, "a chat starts with chat_open")
+		return
+	}
+	if open.Sender.NodeID != origin.NodeID {
+		rejectmessage(w, r, fmt.Errorf("%w: chat from %s signed by %s", protocol.ErrSignature, open.Sender.NodeID, origin.NodeID))
+		return
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		writeproblem(w, http.StatusInternalServerError, protocol.CodeEncryption, err.Error())
+		return
+	}
+	send, recv, err := chatkeys(private, open.Key, open.ID, getidentity().nodeid(), origin.NodeID)
+	if err != nil {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeEncryption, err.Error())
+		return
+	}
+
+	s := &ChatSession{
+		id:      open.ID,
+		name:    poolkey(remote.Addr()),
+		addr:    remote.Addr().Unmap(),
+		peer:    open.Sender,
+		send:    send,
+		recv:    recv,
+		out:     w,
+		flush:   rc.Flush,
+		stop:    func() { rc.SetReadDeadline(time.Now()) }, // The body read fails and the handler returns
+		pending: make(map[int]chatbody),
+		done:    make(chan struct{}),
+	}
+	if err := getchats().add(s); err != nil {
+		writeproblem(w, http.StatusServiceUnavailable, protocol.CodeUnavailable, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	s.mu.Lock()
+	err = s.writeframe(protocol.ChatOpen{ID: open.ID, Sender: si.sender(), Key: private.PublicKey().Bytes()})
+	s.mu.Unlock()
+	if err != nil {
+		s.end("could not answer: " + err.Error())
+		return
+	}
+
+	log.GetInstance().Output("CHAT", fmt.Sprintf("%s (%s) opened a chat, chat %s to answer", notefrom(open.Sender), s.name, s.name))
+	s.readloop(r.Body)
+}
+
+// Write one frame. Must hold the lock
+func (s *ChatSession) writeframe(m protocol.Message) error {
+	if err := protocol.WriteFrame(s.out, m); err != nil {
+		return err
+	}
+	if s.flush != nil {
+		return s.flush()
+	}
+	return nil
+}
+
+// Read the other side until it closes or something breaks
+func (s *ChatSession) readloop(body io.Reader) {
+	for {
+		m, origin, err := getguard().ReadFrame(body, protocol.MaxMessageSize)
+		if errors.Is(err, io.EOF) {
+			s.end("the other side hung up")
+			return
+		} else if err != nil {
+			s.end(err.Error())
+			return
+		}
+		if origin.NodeID != s.peer.NodeID {
+			s.end("a frame signed by someone else")
+			return
+		}
+
+		switch msg := m.(type) {
+		case protocol.ChatLine:
+			if err := s.heard(msg); err != nil {
+				s.end(err.Error())
+				return
+			}
+		case protocol.Ack:
+			s.acked(msg)
+		case protocol.Close:
+			reason := msg.Reason
+			if reason == "" {
+				reason = "the other side left"
+			}
+			s.end(reason)
+			return
+		default:
+			s.end(fmt.Sprintf("a %s in a chat", msg.Type()))
+			return
+		}
+	}
+}
+
+// A line from the other side. It gets an ack and goes on the screen
+func (s *ChatSession) heard(line protocol.ChatLine) error {
+	if line.ID != s.id {
+		return errors.New("a line from another chat")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Learning: Counting up means a line can't be played again or out of order inside the stream
+	if line.Seq <= s.theirs {
+		return fmt.Errorf("line %d after %d", line.Seq, s.theirs)
+	}
+	content, err := s.recv.Open(nil, chatnonce(line.Seq), line.Sealed, []byte(s.id))
+	if err != nil {
+		return errors.New("a line that doesn't open")
+	}
+	body := chatbody{}
+	if err := json.Unmarshal(content, &body); err != nil || !utf8.ValidString(body.Text) {
+		return errors.New("a line that isn't text")
+	}
+	s.theirs = line.Seq
+
+	if err := s.writeframe(protocol.Ack{ID: s.id, Index: line.Seq}); err != nil {
+		return err
+	}
+
+	when := time.UnixMilli(body.Sent).Format(time.TimeOnly)
+	logger := log.GetInstance()
+	if body.Transfer == "" {
+		logger.Output("CHAT", fmt.Sprintf("[%s] %s: %s", when, notefrom(s.peer), body.Text))
+		return nil
+	}
+
+	// Only a transfer that really came from them can be taken with /accept
+	if si := serverinstance; si != nil {
+		si.poolmu.RLock()
+		c, ok := si.reqpool[body.Transfer]
+		ok = ok && c.peerid == s.peer.NodeID
+		si.poolmu.RUnlock()
+		if ok {
+			s.lastfile = body.Transfer
+			logger.Output("CHAT", fmt.Sprintf("[%s] %s dropped %s (%s), /accept takes it", when, notefrom(s.peer), body.Name, humansize(body.Size)))
+			return nil
+		}
+	}
+	logger.Output("CHAT", fmt.Sprintf("[%s] %s dropped %s, but the offer never came", when, notefrom(s.peer), body.Name))
+	return nil
+}
+
+// The other side got one of our lines
+func (s *ChatSession) acked(ack protocol.Ack) {
+	s.mu.Lock()
+	body, ok := s.pending[ack.Index]
+	delete(s.pending, ack.Index)
+	s.mu.Unlock()
+
+	if ok {
+		log.GetInstance().Output("CHAT", fmt.Sprintf("[%s] you: %s | delivered", time.UnixMilli(body.Sent).Format(time.TimeOnly), body.show()))
+	}
+}
+
+// A line that's still waiting for its ack
+func (s *ChatSession) late(seq int) {
+	s.mu.Lock()
+	body, ok := s.pending[seq]
+	s.mu.Unlock()
+
+	if ok {
+		log.GetInstance().Output("CHAT", fmt.Sprintf("[%s] you: %s | not delivered yet", time.UnixMilli(body.Sent).Format(time.TimeOnly), body.show()))
+	}
+}
+
+func (body chatbody) show() string {
+	if body.Transfer != "" {
+		return fmt.Sprintf("dropped %s (%s)", body.Name, humansize(body.Size))
+	}
+	return body.Text
+}
+
+// Seal a line and send it
+func (s *ChatSession) sendbody(body chatbody) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return errors.New("the chat is over")
+	default:
+	}
+
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	s.seq++
+	seq := s.seq
+	sealed := s.send.Seal(nil, chatnonce(seq), content, []byte(s.id))
+
+	s.pending[seq] = body
+	if err := s.writeframe(protocol.ChatLine{ID: s.id, Seq: seq, Sealed: sealed}); err != nil {
+		delete(s.pending, seq)
+		return err
+	}
+	time.AfterFunc(chatacktime, func() { s.late(seq) })
+	return nil
+}
+
+// Say something
+func (s *ChatSession) Say(text string) error {
+	if text == "" {
+		return nil
+	}
+	if len(text) > protocol.MaxChatText {
+		return fmt.Errorf("a line can be %s at most", humansize(protocol.MaxChatText))
+	}
+	if !utf8.ValidString(text) {
+		return errors.New("that isn't text")
+	}
+	return s.sendbody(chatbody{Text: text, Sent: time.Now().UnixMilli()})
+}
+
+// Drop a file in the chat. It's offered like any other, the line says which transfer it is
+func (s *ChatSession) SendFile(path string) error {
+	si := serverinstance
+	if si == nil {
+		return errors.New("the server isn't alive")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	id, err := si.offer(s.name, []string{path}, "dropped in the chat", sharelimits{})
+	if err != nil {
+		return err
+	}
+	return s.sendbody(chatbody{Sent: time.Now().UnixMilli(), Transfer: id, Name: filepath.Base(path), Size: info.Size()})
+}
+
+// Take the last file the other side dropped in
+func (s *ChatSession) Accept() error {
+	s.mu.Lock()
+	id := s.lastfile
+	s.lastfile = ""
+	s.mu.Unlock()
+
+	si := serverinstance
+	if id == "" || si == nil {
+		return errors.New("nothing was dropped in the chat")
+	}
+	si.answerrequest(id, true, "")
+	return nil
+}
+
+// Leave the chat, the other side is told
+func (s *ChatSession) Close(reason string) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+	default:
+		s.writeframe(protocol.Close{ID: s.id, Reason: reason})
+	}
+	s.mu.Unlock()
+
+	s.end(reason)
+}
+
+// The chat is over, whichever way it ended
+func (s *ChatSession) end(reason string) {
+	s.endonce.Do(func() {
+		close(s.done)
+
+		cr := getchats()
+		cr.mu.Lock()
+		delete(cr.sessions, s)
+		cr.mu.Unlock()
+
+		s.mu.Lock()
+		s.stop()
+		s.mu.Unlock()
+
+		log.GetInstance().Output("CHAT", fmt.Sprintf("Chat with %s is over: %s", notefrom(s.peer), reason))
+	})
+}
+
+// Closed when the chat is over
+func (s *ChatSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Who the chat is with
+func (s *ChatSession) Peer() string {
+	return fmt.Sprintf("%s (%s)", notefrom(s.peer), s.name)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/QFServer/log"
+)
+
+// Server configuration, stored as JSON in the user config dir
+// (~/.config/qfserver/config.json on Linux, %AppData%\qfserver\config.json on Windows)
+type serverconfig struct {
+	// Interfaces to run discovery on. Names or patterns like "docker*"
+	// An empty include list means every usable interface
+	IncludeInterfaces []string `json:"include_interfaces"`
+	ExcludeInterfaces []string `json:"exclude_interfaces"`
+
+	// Start as a relay between the networks this node is on
+	Relay bool `json:"relay"`
+
+	// Where received files are written. Empty means "received" in the config dir
+	DownloadDir string `json:"download_dir"`
+
+	// Bandwidth limits in bytes per second, 0 means no limit. See limit.go
+	LimitGlobal int64 `json:"limit_global"`
+	LimitPeer   int64 `json:"limit_peer"`
+}
+
+const configfile = "config.json"
+
+// The directory holding everything we keep on disk
+func configdir() (string, error) {
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, "qfserver")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// A directory inside the config dir, made when it's missing
+func datadir(name string) (string, error) {
+	base, err := configdir()
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	return dir, nil
+}
+
+// Load the config. A missing or broken file gives the defaults so the server can always start
+func loadconfig() *serverconfig {
+	logger := log.GetInstance()
+	config := &serverconfig{}
+
+	dir, err := configdir()
+	if err != nil {
+		logger.Debug("CONFIG", "No config directory: "+err.Error())
+		return config
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, configfile))
+	if errors.Is(err, os.ErrNotExist) {
+		// First run, write the defaults out so there's something to edit
+		config.save()
+		return config
+	} else if err != nil {
+		logger.Debug("CONFIG", "Could not read config: "+err.Error())
+		return config
+	}
+
+	if err := json.Unmarshal(content, config); err != nil {
+		logger.Output("CONFIG", "Config file is broken, using defaults: "+err.Error())
+		return &serverconfig{}
+	}
+
+	return config
+}
+
+// Write the config back to disk
+func (sc *serverconfig) save() error {
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, configfile), content, 0600)
+}
+
+// Check an interface name against the include and exclude lists. Exclude wins
+func (sc *serverconfig) interfaceallowed(name string) bool {
+	for _, pattern := range sc.ExcludeInterfaces {
+		if match, _ := path.Match(pattern, name); match {
+			return false
+		}
+	}
+
+	if len(sc.IncludeInterfaces) == 0 {
+		return true
+	}
+
+	for _, pattern := range sc.IncludeInterfaces {
+		if match, _ := path.Match(pattern, name); match {
+			return true
+		}
+	}
+
+	return false
+}
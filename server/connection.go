@@ -1,18 +1,96 @@
 package server
 
-import "crypto/rsa"
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/QFServer/protocol"
+)
 
 // Connection structure
 type conn struct {
 	// Basic check
+	id          string // Random, picked by the requester
 	sourceCON   string
 	endpointCON string
+	target      netip.AddrPort // The other side's server. Replies to our request come from here, or its sender answers here (peeraddr)
+	peerid      string         // Node id of the other side, from the signature on its first message
+
+	// Where the connection is at, see state.go
+	state   connstate
+	created time.Time
+	updated time.Time
+
+	// Progress of the data, guarded by the pool lock
+	started time.Time // When it went to transferring
+	done    int64     // Bytes through so far
+
+	// Why it ended up where it is, for the history. Recorded once it's finished
+	reason   string
+	recorded bool
+
+	// Who goes first when the bandwidth is limited
+	priority priorityclass
+
+	// Parallel streams. Offered count until the receiver accepts, then the agreed one
+	streams   int
+	receiving *receiving // RECEIVER: The files being written, once the first stream is in
 
 	// Information
-	data []byte
+	sessionkey []byte // AES key for the data, made by the receiver when it accepts
+
+	// What's on offer, filled in before anything is accepted
+	sender    protocol.Sender
+	files     []protocol.FileMeta
+	totalsize int64
+	message   string
+	paths     []string // Outgoing only, where the files are on our disk
+
+	// Shares, see share.go. A zero expires is a plain push
+	expires   time.Time
+	downloads int  // How often it may be pulled
+	pulled    int  // Pulls started so far
+	pulling   int  // Pulls running right now
+	fetched   int  // Pulls that went through
+	forgotten bool // Paths and keys are gone, only the listing is left
 
 	// Keys
-	masterPublic rsa.PublicKey
+	masterPublic rsa.PublicKey // The requester's key, only used to get the session key across
+}
+
+// Random id for a connection
+func newid() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Short human readable size
+func humansize(size int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", size, units[0])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// One line summary of what's on offer
+func (c *conn) summary() string {
+	from := c.sender.Hostname
+	if from == "" {
+		from = c.sender.NodeID
+	}
+	return fmt.Sprintf("%s | %d files, %s", from, len(c.files), humansize(c.totalsize))
 }
 
 // Send information commands
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Pause, resume and cancel
+// Whoever the user is on changes the transfer here first, then tells the other side with a Control
+// posted to /control. Both sides hold their streams in throttle() while paused, so it doesn't matter
+// which one the user picked. Cancel throws away the partial files and the keys.
+
+// Find a transfer either way and who is on the other end of it
+func (si *ServerInstance) findtransfer(id string) (*conn, netip.AddrPort, bool) {
+	if c, ok := si.reqpool[id]; ok {
+		return c, c.target, true
+	}
+	if c, ok := si.connection[id]; ok {
+		return c, c.target, true
+	}
+	return nil, netip.AddrPort{}, false
+}
+
+// Apply a control action to a transfer. The pool lock has to be held
+func (si *ServerInstance) applycontrol(c *conn, action string, reason string) error {
+	switch action {
+	case protocol.ActionPause:
+		return c.transition(statepaused)
+
+	case protocol.ActionResume:
+		return c.transition(statetransferring)
+
+	case protocol.ActionCancel:
+		if err := c.transition(statecancelled); err != nil {
+			return err
+		}
+		c.reason = reason
+
+		// Nothing of it is needed anymore. The streams notice in throttle() and stop on their own
+		if c.receiving != nil {
+			c.receiving.abort()
+		}
+		delete(si.conKeyPriv, c)
+		c.sessionkey = nil
+		return nil
+	}
+
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// Pause, resume or cancel a transfer from the client and let the peer know
+func (si *ServerInstance) ControlTransfer(id string, action string) error {
+	if !CheckServerAlive() {
+		return errors.New("the server isn't alive")
+	}
+
+	reason := ""
+	if action == protocol.ActionCancel {
+		reason = "cancelled by " + si.clienthostname
+	}
+
+	si.poolmu.Lock()
+	c, peer, ok := si.findtransfer(id)
+	if !ok {
+		si.poolmu.Unlock()
+		return errors.New("no transfer with id " + id)
+	}
+	if err := si.applycontrol(c, action, reason); err != nil {
+		si.poolmu.Unlock()
+		return err
+	}
+	si.poolmu.Unlock()
+
+	if err := postmessage(peer, "/control", protocol.Control{ID: id, Action: action, Reason: reason}); err != nil {
+		return fmt.Errorf("done here, but the peer didn't hear it: %v", err)
+	}
+	return nil
+}
+
+// Post a protocol message to a node and check that it took it
+func postmessage(target netip.AddrPort, path string, m protocol.Message) error {
+	content, err := protocol.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(nodeurl(target, path), "application/json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return readproblem(resp)
+}
+
+// The other side paused, resumed or cancelled a transfer
+func (si *ServerInstance) handlecontrol(w http.ResponseWriter, r *http.Request) {
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+
+	m, origin, err := getguard().Expect(r.Body, protocol.MaxMessageSize, protocol.TypeControl)
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+	control := m.(protocol.Control)
+
+	si.poolmu.Lock()
+	c, peer, ok := si.findtransfer(control.ID)
+
+	// Only the other end of the transfer gets a say. A request that was never answered doesn't know
+	// the node on the other end yet, the first signed message from its address tells us
+	if ok && c.peerid == "" && peer.Addr() == remote.Addr() {
+		c.peerid = origin.NodeID
+	}
+	if !ok || peer.Addr() != remote.Addr() || origin.NodeID != c.peerid {
+		si.poolmu.Unlock()
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, "no transfer "+control.ID)
+		return
+	}
+	if err := si.applycontrol(c, control.Action, control.Reason); err != nil {
+		si.poolmu.Unlock()
+		writeproblem(w, http.StatusConflict, protocol.CodeWrongState, err.Error())
+		return
+	}
+	si.poolmu.Unlock()
+
+	message := fmt.Sprintf("Transfer %s %s by %s", control.ID, c.state, poolkey(remote.Addr()))
+	if control.Reason != "" {
+		message += ": " + control.Reason
+	}
+	log.GetInstance().Output("TRANSFER", message)
+}
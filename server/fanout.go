@@ -0,0 +1,247 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	FR "github.com/QFServer/fr"
+	"github.com/QFServer/log"
+)
+
+// Fan out
+// One file to the five laptops at standup. Targets are aliases, addresses or @group from the address book,
+// separated by commas or spaces. The files are hashed once, then every recipient gets its own offer with its
+// own keys, all at the same time. A watcher prints the progress of the lot until every transfer has ended
+
+const fanwatch = 2 * time.Second
+
+// How sending to one of the recipients went
+type FanResult struct {
+	To       string
+	Transfer string // Offers, the transfer id
+	Note     string // Notes, the note id
+	Queued   string // The outbox item when it wasn't reachable
+	Relayed  bool
+	Err      error
+}
+
+// Targets as typed, split on commas, @group expanded and everyone only once.
+// index turns a number from the request module's list into an address, nil outside of it
+func expandtargets(fields []string, index func(string) (string, bool)) ([]string, error) {
+	targets := make([]string, 0, len(fields))
+	seen := make(map[string]bool)
+	add := func(target string) {
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+
+	for _, field := range fields {
+		for _, part := range strings.Split(field, ",") {
+			part = strings.TrimSpace(part)
+			switch {
+			case part == "":
+			case strings.HasPrefix(part, "@"):
+				members, ok := getaddressbook().group(part[1:])
+				if !ok {
+					return nil, fmt.Errorf("there is no group %s", part[1:])
+				}
+				for _, member := range members {
+					add(member)
+				}
+			case index != nil:
+				if node, ok := index(part); ok {
+					add(node)
+					continue
+				}
+				if _, ok := getaddressbook().lookup(part); !ok {
+					return nil, fmt.Errorf("%s isn't in the list or the address book", part)
+				}
+				add(part)
+			default:
+				add(part)
+			}
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, errors.New("no one to send to")
+	}
+	return targets, nil
+}
+
+// Aliases, addresses and @groups, as the client got them
+func ExpandTargets(fields []string) ([]string, error) {
+	return expandtargets(fields, nil)
+}
+
+// The file contents for recipients behind a relay, read the first time one needs them and shared after that
+type fanpayload struct {
+	once     sync.Once
+	contents [][]byte
+}
+
+func (p *fanpayload) get(paths []string) [][]byte {
+	p.once.Do(func() {
+		for _, path := range paths {
+			p.contents = append(p.contents, FR.ReadFromFile(path))
+		}
+	})
+	return p.contents
+}
+
+// Offer the same files to everyone at once
+func (si *ServerInstance) sendmany(targets []string, paths []string, message string, share sharelimits) {
+	logger := log.GetInstance()
+
+	files, totalsize, err := describefiles(paths)
+	if err != nil {
+		logger.Output("ERROR", err.Error())
+		return
+	}
+	logger.Output("REQ", fmt.Sprintf("Offering %d files (%s) to %d peers", len(files), humansize(totalsize), len(targets)))
+
+	payload := &fanpayload{}
+	results := make([]FanResult, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result := FanResult{To: target}
+
+			// Peers on the other side of a relay get the files sealed and stored at the relay
+			if peer, ok := si.GetPingPool()[target]; ok && peer.Relay != "" {
+				result.Relayed = true
+				for n, data := range payload.get(paths) {
+					if err := si.sendrelayed(peer, filepath.Base(paths[n]), data); err != nil {
+						result.Err = fmt.Errorf("relay would not take %s: %v", filepath.Base(paths[n]), err)
+						break
+					}
+				}
+				results[i] = result
+				return
+			}
+
+			result.Transfer, result.Err = si.offerfiles(target, paths, files, totalsize, message, share)
+			if errors.Is(result.Err, errunreachable) {
+				item, qerr := getoutbox().queue(OutboxItem{Kind: KindOffer, To: target, Text: message, Paths: paths, Share: share}, result.Err)
+				if qerr == nil {
+					result.Queued, result.Err = item.ID, nil
+				}
+			}
+			results[i] = result
+		}()
+	}
+	wg.Wait()
+
+	transfers := make(map[string]string)
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			logger.Output("ERROR", fmt.Sprintf("%s: %v", result.To, result.Err))
+		case result.Queued != "":
+			logger.Output("OUTBOX", fmt.Sprintf("%s: not reachable, waits in the outbox as %s", result.To, result.Queued))
+		case result.Relayed:
+			logger.Output("RELAY", fmt.Sprintf("%s: handed to its relay", result.To))
+		default:
+			logger.Output("REQ", fmt.Sprintf("%s: offered as transfer %s", result.To, result.Transfer))
+			transfers[result.Transfer] = result.To
+		}
+	}
+
+	if len(transfers) > 0 {
+		go si.watchfanout(transfers)
+	}
+}
+
+// Print how the transfers of one fan out are doing, all of them in one line, until they've all ended.
+// Then one line per recipient with how it went
+func (si *ServerInstance) watchfanout(transfers map[string]string) {
+	logger := log.GetInstance()
+	last := ""
+
+	for CheckServerAlive() {
+		time.Sleep(fanwatch)
+
+		counts := make(map[string]int)
+		var done, total int64
+		ended := 0
+		si.poolmu.RLock()
+		for id := range transfers {
+			c, ok := si.connection[id]
+			if !ok {
+				counts["gone"]++
+				ended++
+				continue
+			}
+			counts[c.state.String()]++
+			done += c.done
+			total += c.totalsize
+			if c.state.finished() {
+				ended++
+			}
+		}
+		si.poolmu.RUnlock()
+
+		// Learning: Sorted, map order would change the line when nothing else did
+		states := make([]string, 0, len(counts))
+		for state, n := range counts {
+			states = append(states, fmt.Sprintf("%d %s", n, state))
+		}
+		sort.Strings(states)
+		line := fmt.Sprintf("%d peers: %s | %s of %s", len(transfers), strings.Join(states, ", "), humansize(done), humansize(total))
+		if line != last {
+			logger.Output("FANOUT", line)
+			last = line
+		}
+		if ended == len(transfers) {
+			break
+		}
+	}
+
+	lines := make([]string, 0, len(transfers))
+	si.poolmu.RLock()
+	for id, to := range transfers {
+		c, ok := si.connection[id]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("%s: transfer %s is gone", to, id))
+		case c.reason != "":
+			lines = append(lines, fmt.Sprintf("%s: %s, %s", to, c.state, c.reason))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %s", to, c.state))
+		}
+	}
+	si.poolmu.RUnlock()
+
+	sort.Strings(lines)
+	for _, line := range lines {
+		logger.Output("FANOUT", line)
+	}
+}
+
+// Send the same note to everyone at once. Each gets it sealed to its own key under its own id
+func (si *ServerInstance) SendNotes(targets []string, text string) []FanResult {
+	results := make([]FanResult, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, sent, err := si.SendNote(target, text)
+			results[i] = FanResult{To: target, Note: id, Err: err}
+			if err == nil && !sent {
+				results[i].Queued = id
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -5,8 +5,14 @@ go 1.25.5
 replace github.com/QFServer/log => ../log
 
 require (
+	github.com/QFServer/crypt v0.0.0-00010101000000-000000000000
 	github.com/QFServer/fr v0.0.0-00010101000000-000000000000
 	github.com/QFServer/log v0.0.0-00010101000000-000000000000
+	github.com/QFServer/protocol v0.0.0-00010101000000-000000000000
 )
 
 replace github.com/QFServer/fr => ../fr
+
+replace github.com/QFServer/crypt => ../crypt
+
+replace github.com/QFServer/protocol => ../protocol
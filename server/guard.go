@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Freshness for everything that comes in, see protocol/guard.go for how it works
+
+const (
+	clockskew       = 2 * time.Minute // How far apart two nodes' clocks may be
+	replaycachesize = 1 << 16
+	relaycachesize  = 1 << 12
+)
+
+var (
+	guardinstance      *protocol.Guard
+	relayguardinstance *protocol.Guard
+	guardonce          sync.Once
+)
+
+func initguards() {
+	guardonce.Do(func() {
+		guardinstance = protocol.NewGuard(clockskew, replaycachesize)
+
+		// Relayed boxes can sit at a relay for days, so their window is as long as a relay keeps them
+		relayguardinstance = protocol.NewGuard(relaymaxage+clockskew, relaycachesize)
+	})
+}
+
+func getguard() *protocol.Guard {
+	initguards()
+	return guardinstance
+}
+
+func getrelayguard() *protocol.Guard {
+	initguards()
+	return relayguardinstance
+}
+
+// Log a message we refused and tell the sender why
+func rejectmessage(w http.ResponseWriter, r *http.Request, err error) {
+	from := r.RemoteAddr
+	if remote, rerr := remoteaddr(r); rerr == nil {
+		from = poolkey(remote.Addr())
+	}
+
+	status := http.StatusBadRequest
+	if errors.Is(err, protocol.ErrSignature) || errors.Is(err, protocol.ErrStale) || errors.Is(err, protocol.ErrReplay) {
+		log.GetInstance().Output("SECURITY", fmt.Sprintf("Rejected %s from %s: %v", r.URL.Path, from, err))
+		status = http.StatusUnauthorized
+	}
+	if errors.Is(err, protocol.ErrTooLarge) {
+		status = http.StatusRequestEntityTooLarge
+	}
+
+	writeproblem(w, status, protocol.ProblemCode(err), err.Error())
+}
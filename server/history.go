@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/QFServer/log"
+)
+
+// Transfer history
+// Every transfer that finishes, whichever way it went, gets a line in history.jsonl in the config dir.
+// The reaper writes them, so a finished transfer shows up there within a few seconds.
+// Receipts come later than that, they're kept on their own (receipts.go) and joined in when it's read
+
+const historyfile = "history.jsonl"
+
+// One finished transfer
+type HistoryEntry struct {
+	ID        string    `json:"id"`
+	Direction string    `json:"direction"` // "in" or "out"
+	Peer      string    `json:"peer"`
+	Files     []string  `json:"files"`
+	Total     int64     `json:"total"`
+	Done      int64     `json:"done"`
+	Outcome   string    `json:"outcome"`
+	Reason    string    `json:"reason,omitempty"`
+	Created   time.Time `json:"created"`
+	Ended     time.Time `json:"ended"`
+
+	Receipts []Receipt `json:"-"` // Outgoing only, what the receiver signed for
+}
+
+// Learning: Appends from the reaper and the shutdown could land at the same time, one lock keeps the lines whole
+var historymu sync.Mutex
+
+func (c *conn) history(direction string, peer string) HistoryEntry {
+	files := make([]string, 0, len(c.files))
+	for _, f := range c.files {
+		files = append(files, f.Name)
+	}
+
+	return HistoryEntry{
+		ID:        c.id,
+		Direction: direction,
+		Peer:      peer,
+		Files:     files,
+		Total:     c.totalsize,
+		Done:      c.done,
+		Outcome:   c.state.String(),
+		Reason:    c.reason,
+		Created:   c.created,
+		Ended:     c.updated,
+	}
+}
+
+// Write every finished transfer that isn't in the history yet
+func (si *ServerInstance) recordhistory() {
+	si.poolmu.Lock()
+	entries := make([]HistoryEntry, 0)
+	for _, c := range si.reqpool {
+		if c.state.finished() && !c.recorded {
+			entries = append(entries, c.history("in", c.sourceCON))
+			c.recorded = true
+		}
+	}
+	for _, c := range si.connection {
+		if c.state.finished() && !c.recorded {
+			entries = append(entries, c.history("out", c.endpointCON))
+			c.recorded = true
+		}
+	}
+	si.poolmu.Unlock()
+
+	if len(entries) == 0 {
+		return
+	}
+	if err := appendhistory(entries); err != nil {
+		log.GetInstance().Debug("HISTORY", "Could not write the history: "+err.Error())
+	}
+}
+
+func appendhistory(entries []HistoryEntry) error {
+	historymu.Lock()
+	defer historymu.Unlock()
+
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, historyfile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The last n finished transfers, oldest first. Works with the server closed too
+func History(n int) ([]HistoryEntry, error) {
+	historymu.Lock()
+	defer historymu.Unlock()
+
+	dir, err := configdir()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filepath.Join(dir, historyfile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]HistoryEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := HistoryEntry{}
+		// A broken line (power cut mid write) is skipped, not fatal
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	if n > 0 && len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	for i := range entries {
+		if entries[i].Direction == "out" {
+			entries[i].Receipts = getreceipts().of(entries[i].ID)
+		}
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Who we are. Generated once and kept in identity.json in the config dir
+// sign is for signatures, box is for encrypting to us (X25519)
+// Learning: ed25519 keys can't do key exchange in the standard library, so a node carries two keys
+type identity struct {
+	sign ed25519.PrivateKey
+	box  *ecdh.PrivateKey
+}
+
+// What goes on disk, just the seeds
+type identityfile struct {
+	Sign []byte `json:"sign"`
+	Box  []byte `json:"box"`
+}
+
+const identityfilename = "identity.json"
+
+var (
+	identityinstance *identity
+	identityonce     sync.Once
+)
+
+// Load our identity or make a new one
+func getidentity() *identity {
+	identityonce.Do(func() {
+		logger := log.GetInstance()
+
+		// Everything we send gets signed with it, whichever way it was loaded
+		defer func() { protocol.SetSigner(identityinstance.sign) }()
+
+		dir, direrr := configdir()
+		if direrr == nil {
+			content, err := os.ReadFile(filepath.Join(dir, identityfilename))
+			if err == nil {
+				stored := identityfile{}
+				if err := json.Unmarshal(content, &stored); err == nil && len(stored.Sign) == ed25519.SeedSize {
+					box, err := ecdh.X25519().NewPrivateKey(stored.Box)
+					if err == nil {
+						identityinstance = &identity{sign: ed25519.NewKeyFromSeed(stored.Sign), box: box}
+						return
+					}
+				}
+				logger.Output("IDENTITY", "Identity file is broken, making a new identity")
+			}
+		}
+
+		_, sign, _ := ed25519.GenerateKey(rand.Reader)
+		box, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		identityinstance = &identity{sign: sign, box: box}
+
+		if direrr != nil {
+			logger.Debug("IDENTITY", "No config directory, identity only lasts this session")
+			return
+		}
+
+		content, _ := json.Marshal(identityfile{Sign: sign.Seed(), Box: box.Bytes()})
+		if err := os.WriteFile(filepath.Join(dir, identityfilename), content, 0600); err != nil {
+			logger.Debug("IDENTITY", "Could not save the identity: "+err.Error())
+		}
+	})
+
+	return identityinstance
+}
+
+// Short id for a node, derived from its signing key
+func nodeid(signkey ed25519.PublicKey) string {
+	return protocol.NodeID(signkey)
+}
+
+func (id *identity) nodeid() string {
+	return nodeid(id.sign.Public().(ed25519.PublicKey))
+}
+
+// Our public keys the way they get pinned
+func (id *identity) publickeys() PinnedKeys {
+	return PinnedKeys{
+		Sign: base64.StdEncoding.EncodeToString(id.sign.Public().(ed25519.PublicKey)),
+		Box:  base64.StdEncoding.EncodeToString(id.box.PublicKey().Bytes()),
+	}
+}
@@ -0,0 +1,587 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Inbox
+// Notes and file offers that came in, kept in inbox.jsonl in the config dir so they outlive the server.
+// The file is a log: a line for every item that arrives and a line whenever one is read or deleted.
+// Loading plays it back. Once the dead lines outnumber the live items it's rewritten without them.
+// With a passphrase set (vault.go) an item is sealed before it's written, only its kind, whether it was
+// read and a hash of its key stay readable. That's enough for the unread count while the inbox is locked
+
+const (
+	inboxfile       = "inbox.jsonl"
+	inboxlinelimit  = 1 << 20 // Biggest line we read back, a full note fits with room to spare
+	inboxcompactmin = 64      // Don't bother rewriting for a handful of dead lines
+	inboxpreview    = 60      // Characters of a note shown in the list
+	inboxperpeer    = 256     // Unread items one peer can have waiting, after that it has to wait for us to read
+)
+
+// What an inbox item is
+const (
+	KindNote  = "note"
+	KindOffer = "offer"
+)
+
+// Something that came in. Items are numbered from 1 in the order they arrived
+type InboxItem struct {
+	ID       string              `json:"id"`
+	Kind     string              `json:"kind"`
+	From     protocol.Sender     `json:"from"`
+	Address  string              `json:"address,omitempty"`
+	ReplyTo  string              `json:"reply_to,omitempty"` // Where the sender's server is (peername), read receipts go there
+	Sent     time.Time           `json:"sent"`               // When the sender wrote it
+	Received time.Time           `json:"received"`
+	Text     string              `json:"text,omitempty"` // The note, or the message that came with an offer
+	Files    []protocol.FileMeta `json:"files,omitempty"`
+	Total    int64               `json:"total,omitempty"`
+	Read     bool                `json:"read"`
+
+	State string `json:"-"` // Offers only, where the transfer is at while the server knows it
+
+	ref    string // key(), also for a locked item that doesn't know its sender
+	sealed []byte // The item as the vault keeps it, nil without a passphrase
+	locked bool   // Only kind, read and ref are known until the inbox is unlocked
+}
+
+// One line of the file. Adds carry the item, or with a passphrase the sealed item and what stays readable
+type inboxrecord struct {
+	Op     string     `json:"op"` // add, read or delete
+	Item   *InboxItem `json:"item,omitempty"`
+	Key    string     `json:"key,omitempty"`
+	Kind   string     `json:"kind,omitempty"`
+	Read   bool       `json:"read,omitempty"`
+	Sealed []byte     `json:"sealed,omitempty"`
+}
+
+type inbox struct {
+	mu    sync.Mutex
+	items []InboxItem
+	dead  int  // Lines in the file that don't add an item anymore
+	disk  bool // False when there's no config dir, the inbox only lasts the session then
+
+	// Who sent what, by ref, for everything that came in or was open this session. A locked item doesn't say,
+	// this is how it still counts for full
+	senders map[string]inboxsender
+}
+
+// Only kept in memory, the file doesn't get to say who sent what while it's locked
+type inboxsender struct {
+	node    string
+	address string
+}
+
+var (
+	inboxinstance *inbox
+	inboxonce     sync.Once
+)
+
+var errinboxduplicate = errors.New("already in the inbox")
+
+// Senders pick the ids, so they're only unique together with the sender.
+// Hashed, the file shouldn't say who sent what while it's locked
+func (item InboxItem) key() string {
+	if item.ref != "" {
+		return item.ref
+	}
+	return inboxref(item.From.NodeID + "/" + item.ID)
+}
+
+func inboxref(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
+
+// The inbox is a singleton, it can be read with or without the server running
+func getinbox() *inbox {
+	inboxonce.Do(func() {
+		inboxinstance = &inbox{items: make([]InboxItem, 0), senders: make(map[string]inboxsender)}
+		if err := inboxinstance.load(); err != nil {
+			log.GetInstance().Debug("INBOX", "Inbox only lasts this session: "+err.Error())
+			return
+		}
+		inboxinstance.disk = true
+	})
+
+	return inboxinstance
+}
+
+// Play the file back
+func (ib *inbox) load() error {
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(dir, inboxfile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64<<10), inboxlinelimit)
+	for scanner.Scan() {
+		record := inboxrecord{}
+		// A broken line (power cut mid write) is skipped, not fatal
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			ib.dead++
+			continue
+		}
+		ib.apply(record)
+	}
+	return scanner.Err()
+}
+
+// Apply one record to the items. Must hold the lock
+func (ib *inbox) apply(record inboxrecord) {
+	if record.Op == "add" && (record.Item != nil || record.Sealed != nil) {
+		item := InboxItem{Kind: record.Kind, Read: record.Read, ref: record.Key, sealed: record.Sealed, locked: true}
+		if record.Item != nil {
+			item = *record.Item
+			item.ref = item.key()
+		} else {
+			ib.open(&item)
+		}
+
+		if ib.find(item.ref) < 0 {
+			ib.items = append(ib.items, item)
+			return
+		}
+	}
+
+	// Learning: Files from before the keys were hashed still say sender/id
+	key := record.Key
+	if strings.Contains(key, "/") {
+		key = inboxref(key)
+	}
+
+	index := ib.find(key)
+	switch {
+	case index < 0:
+	case record.Op == "read":
+		ib.items[index].Read = true
+	case record.Op == "delete":
+		ib.items = append(ib.items[:index], ib.items[index+1:]...)
+		delete(ib.senders, key)
+		ib.dead++
+	}
+	ib.dead++
+}
+
+func (ib *inbox) find(key string) int {
+	for i, item := range ib.items {
+		if item.key() == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// True when a peer already has as many unread items waiting as it gets. Counted by node id and by address,
+// so neither a new identity nor a new address starts it from zero
+// Learning: A locked item doesn't say who it's from, senders remembers it for the ones we saw this session.
+// Items that stayed locked since a restart can't be told apart, so a peer starts over then
+func (ib *inbox) full(node string, address string) bool {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	bynode, byaddress := 0, 0
+	for _, item := range ib.items {
+		if item.Read {
+			continue
+		}
+		from := inboxsender{node: item.From.NodeID, address: item.Address}
+		if item.locked {
+			from = ib.senders[item.ref]
+		}
+		if from.node == node {
+			bynode++
+		}
+		if from.address == address {
+			byaddress++
+		}
+	}
+	return bynode >= inboxperpeer || byaddress >= inboxperpeer
+}
+
+// Apply a record and write it down. Must hold the lock
+func (ib *inbox) commit(record inboxrecord) error {
+	ib.apply(record)
+	return ib.write(record)
+}
+
+// Write a record down, or the whole file when it has too many dead lines. Must hold the lock
+func (ib *inbox) write(record inboxrecord) error {
+	if !ib.disk {
+		return nil
+	}
+
+	if ib.dead >= inboxcompactmin && ib.dead > len(ib.items) {
+		return ib.compact()
+	}
+
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, inboxfile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(record)
+}
+
+// Rewrite the file with only the live items. Must hold the lock
+// Learning: Write a new file and rename it over the old one, a crash halfway leaves the old one whole
+func (ib *inbox) compact() error {
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, inboxfile)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for i := range ib.items {
+		record, err := ib.record(&ib.items[i])
+		if err == nil {
+			err = encoder.Encode(record)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	ib.dead = 0
+	return nil
+}
+
+// Put something new in. The same item twice is refused. Any other error means it's
+// in the inbox but didn't make it to disk
+func (ib *inbox) add(item InboxItem) error {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	item.ref = item.key()
+	if ib.find(item.ref) >= 0 {
+		return errinboxduplicate
+	}
+
+	record, err := ib.record(&item)
+	if err != nil {
+		return err
+	}
+
+	ib.senders[item.ref] = inboxsender{node: item.From.NodeID, address: item.Address}
+
+	// Arriving while locked, it stays locked like the rest
+	if _, open := getvault().status(); item.sealed != nil && !open {
+		item = InboxItem{Kind: item.Kind, ref: item.ref, sealed: item.sealed, locked: true}
+	}
+	ib.items = append(ib.items, item)
+	return ib.write(record)
+}
+
+// The add record for an item, sealing it first if there's a passphrase and it isn't sealed yet. Must hold the lock
+func (ib *inbox) record(item *InboxItem) (inboxrecord, error) {
+	if item.sealed == nil && getvault().configured() {
+		content, err := json.Marshal(item)
+		if err != nil {
+			return inboxrecord{}, err
+		}
+		if item.sealed, err = getvault().seal(content); err != nil {
+			return inboxrecord{}, err
+		}
+	}
+
+	if item.sealed == nil {
+		return inboxrecord{Op: "add", Item: item}, nil
+	}
+	return inboxrecord{Op: "add", Key: item.ref, Kind: item.Kind, Read: item.Read, Sealed: item.sealed}, nil
+}
+
+// Open a locked item if the vault is unlocked. Must hold the lock
+func (ib *inbox) open(item *InboxItem) {
+	if !item.locked {
+		return
+	}
+	content, err := getvault().open(item.sealed)
+	if err != nil {
+		if !errors.Is(err, ErrLocked) {
+			log.GetInstance().Output("INBOX", "Could not open an item: "+err.Error())
+		}
+		return
+	}
+
+	opened := InboxItem{}
+	if err := json.Unmarshal(content, &opened); err != nil {
+		log.GetInstance().Output("INBOX", "Could not open an item: "+err.Error())
+		return
+	}
+	// Learning: The read flag sealed inside is from when it arrived, the one outside is current
+	opened.Read, opened.ref, opened.sealed = item.Read, item.ref, item.sealed
+	*item = opened
+}
+
+// A passphrase was just set, write everything again sealed
+func (ib *inbox) rewrite() error {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	if !ib.disk {
+		return nil
+	}
+	return ib.compact()
+}
+
+// The vault was unlocked, open what's locked
+func (ib *inbox) unseal() {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	for i := range ib.items {
+		ib.open(&ib.items[i])
+	}
+}
+
+// The vault was locked, forget what was opened.
+// Learning: Go strings can't be wiped, the old text is only let go of for the garbage collector
+func (ib *inbox) reseal() {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	for i, item := range ib.items {
+		if item.sealed != nil && !item.locked {
+			ib.senders[item.ref] = inboxsender{node: item.From.NodeID, address: item.Address}
+			ib.items[i] = InboxItem{Kind: item.Kind, Read: item.Read, ref: item.ref, sealed: item.sealed, locked: true}
+		}
+	}
+}
+
+// Reading the inbox needs it unlocked, and counts as using it for the auto-lock
+func inboxusable() error {
+	if _, locked := InboxVault(); locked {
+		return ErrLocked
+	}
+	getvault().touch()
+	return nil
+}
+
+// Item n, counting from 1. Must hold the lock
+func (ib *inbox) item(n int) (InboxItem, error) {
+	if n < 1 || n > len(ib.items) {
+		return InboxItem{}, fmt.Errorf("there is no item %d, the inbox has %d", n, len(ib.items))
+	}
+	if ib.items[n-1].locked {
+		return InboxItem{}, fmt.Errorf("item %d couldn't be opened", n)
+	}
+	return ib.items[n-1], nil
+}
+
+// Where an offer is at, if the server still has it
+func offerstate(item InboxItem) string {
+	if item.Kind != KindOffer || serverinstance == nil {
+		return ""
+	}
+
+	serverinstance.poolmu.RLock()
+	defer serverinstance.poolmu.RUnlock()
+
+	if c, ok := serverinstance.reqpool[item.ID]; ok && c.peerid == item.From.NodeID {
+		return c.state.String()
+	}
+	return ""
+}
+
+// Everything in the inbox, oldest first
+func InboxList() ([]InboxItem, error) {
+	if err := inboxusable(); err != nil {
+		return nil, err
+	}
+
+	ib := getinbox()
+	ib.mu.Lock()
+	items := make([]InboxItem, len(ib.items))
+	copy(items, ib.items)
+	ib.mu.Unlock()
+
+	for i := range items {
+		items[i].State = offerstate(items[i])
+	}
+	return items, nil
+}
+
+// Item n, which counts as read from now on. The first time, the sender gets a read receipt
+func InboxRead(n int) (InboxItem, error) {
+	if err := inboxusable(); err != nil {
+		return InboxItem{}, err
+	}
+
+	ib := getinbox()
+	ib.mu.Lock()
+	item, err := ib.item(n)
+	if err == nil && !item.Read {
+		err = ib.commit(inboxrecord{Op: "read", Key: item.key()})
+		item.Read = true
+		// Learning: Items from before reply_to only know the address, their sender gets serverport
+		to := item.ReplyTo
+		if to == "" {
+			to = item.Address
+		}
+		if to != "" {
+			go sendreceipt(to, item.From.NodeID, item.ID, protocol.ReceiptRead)
+		}
+	}
+	ib.mu.Unlock()
+
+	item.State = offerstate(item)
+	return item, err
+}
+
+// Write a note to a file. Offers have nothing to save until they're accepted, the files land in the downloads
+func InboxSave(n int, path string) error {
+	if err := inboxusable(); err != nil {
+		return err
+	}
+
+	ib := getinbox()
+	ib.mu.Lock()
+	item, err := ib.item(n)
+	ib.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if item.Kind != KindNote {
+		return errors.New("that's a file offer, accept it with util server request and the files go to the downloads")
+	}
+
+	// Learning: O_EXCL so a typo in the path can't overwrite something
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(item.Text); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Throw item n away
+func InboxDelete(n int) error {
+	if err := inboxusable(); err != nil {
+		return err
+	}
+
+	ib := getinbox()
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	item, err := ib.item(n)
+	if err != nil {
+		return err
+	}
+	return ib.commit(inboxrecord{Op: "delete", Key: item.key()})
+}
+
+// The sender took an offer back. It goes, and the file is written again without it,
+// a delete line alone would leave the sealed offer on disk
+func (ib *inbox) retract(node string, id string) error {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	key := inboxref(node + "/" + id)
+	if ib.find(key) < 0 {
+		return nil
+	}
+	ib.apply(inboxrecord{Op: "delete", Key: key})
+	if !ib.disk {
+		return nil
+	}
+	return ib.compact()
+}
+
+// How many notes and offers nobody has read yet
+func InboxUnread() (int, int) {
+	ib := getinbox()
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
+	notes, offers := 0, 0
+	for _, item := range ib.items {
+		switch {
+		case item.Read:
+		case item.Kind == KindNote:
+			notes++
+		default:
+			offers++
+		}
+	}
+	return notes, offers
+}
+
+// One line for the list
+func (item InboxItem) Summary() string {
+	from := item.From.Hostname
+	if from == "" {
+		from = item.From.NodeID
+	}
+
+	flag := " "
+	if !item.Read {
+		flag = "*"
+	}
+
+	line := fmt.Sprintf("%s %s | %s | %s", flag, item.Kind, from, item.Sent.Format(time.DateTime))
+	if item.Kind == KindOffer {
+		line += fmt.Sprintf(" | %d files, %s", len(item.Files), humansize(item.Total))
+		if item.State != "" {
+			line += " | " + item.State
+		}
+		return line
+	}
+
+	// The first line of a note is as good as a subject
+	// Learning: Cut by runes, cutting bytes can split a character in half
+	preview, _, cut := strings.Cut(item.Text, "\n")
+	if runes := []rune(preview); len(runes) > inboxpreview {
+		preview, cut = string(runes[:inboxpreview]), true
+	}
+	if cut {
+		preview += " ..."
+	}
+	return line + " | " + preview
+}
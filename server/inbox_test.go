@@ -0,0 +1,55 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/QFServer/protocol"
+)
+
+func TestInboxFull(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	ib := &inbox{items: make([]InboxItem, 0), senders: make(map[string]inboxsender)}
+	for i := range inboxperpeer {
+		item := InboxItem{ID: fmt.Sprintf("%032x", i), Kind: KindNote, From: protocol.Sender{NodeID: "aaaa"}, Address: "10.0.0.7"}
+		if err := ib.add(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		node    string
+		address string
+		full    bool
+	}{
+		{"same node and address", "aaaa", "10.0.0.7", true},
+		{"new address", "aaaa", "10.0.0.8", true},
+		{"new node id", "bbbb", "10.0.0.7", true},
+		{"someone else", "bbbb", "10.0.0.8", false},
+	}
+	check := func(t *testing.T) {
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if full := ib.full(tt.node, tt.address); full != tt.full {
+					t.Fatalf("full is %v", full)
+				}
+			})
+		}
+	}
+	t.Run("open", check)
+
+	// Locked, like reseal leaves them. Only the ref is left to go by
+	for i, item := range ib.items {
+		ib.items[i] = InboxItem{Kind: item.Kind, ref: item.ref, sealed: []byte("sealed"), locked: true}
+	}
+	t.Run("locked", check)
+
+	// Reading one makes room
+	ib.items[0].Read = true
+	if ib.full("aaaa", "10.0.0.7") {
+		t.Fatal("still full after reading one")
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// A network interface we run discovery on
+// Learning: Dialing 255.255.255.255 lets the kernel pick one interface. On a laptop with a VPN, Wi-Fi and
+// a docker bridge that's usually the wrong one, so we go through every interface ourselves
+type discoveryinterface struct {
+	ifi        net.Interface
+	prefixes   []netip.Prefix // Every address on the interface with its subnet
+	broadcasts []netip.Addr   // Directed IPv4 broadcast address per subnet (192.168.1.255 for 192.168.1.0/24)
+	multicast  bool           // Can we reach the IPv6 all-nodes group here
+}
+
+// All the interfaces which are up and allowed by the config
+func discoveryinterfaces(config *serverconfig) []discoveryinterface {
+	found := make([]discoveryinterface, 0)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return found
+	}
+
+	for _, ifi := range interfaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if config != nil && !config.interfaceallowed(ifi.Name) {
+			continue
+		}
+
+		di := discoveryinterface{
+			ifi:       ifi,
+			multicast: ifi.Flags&net.FlagMulticast != 0,
+		}
+
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+
+			addr, ok := netip.AddrFromSlice(ipnet.IP)
+			if !ok {
+				continue
+			}
+			addr = addr.Unmap()
+			ones, _ := ipnet.Mask.Size()
+			prefix := netip.PrefixFrom(addr, ones).Masked()
+			di.prefixes = append(di.prefixes, prefix)
+
+			if addr.Is4() && ifi.Flags&net.FlagBroadcast != 0 {
+				di.broadcasts = append(di.broadcasts, directedbroadcast(prefix))
+			}
+		}
+
+		found = append(found, di)
+	}
+
+	return found
+}
+
+// Last address of an IPv4 subnet, the network with all host bits set
+func directedbroadcast(prefix netip.Prefix) netip.Addr {
+	ip := prefix.Masked().Addr().As4()
+	hostbits := 32 - prefix.Bits()
+
+	for i := 3; i >= 0 && hostbits > 0; i-- {
+		take := min(hostbits, 8)
+		ip[i] |= byte(0xff >> (8 - take))
+		hostbits -= take
+	}
+
+	return netip.AddrFrom4(ip)
+}
+
+// Find the interface an address came in on. Link-local IPv6 carries it in the zone, everything else
+// is matched against the subnets on our interfaces
+func interfacefor(interfaces []discoveryinterface, addr netip.Addr) string {
+	if addr.Zone() != "" {
+		return addr.Zone()
+	}
+
+	for _, di := range interfaces {
+		for _, prefix := range di.prefixes {
+			if prefix.Contains(addr) {
+				return di.ifi.Name
+			}
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bandwidth limiting
+// Every transfer goes through two token buckets, one for its peer and one shared by everything.
+// A bucket fills at the rate (bytes per second) and a read or write takes tokens out before it happens.
+// Priority: while a higher class is waiting on a bucket the lower classes leave the tokens alone,
+// so a small note gets through a bucket that a running ISO is draining. A rate of 0 means no limit
+
+type priorityclass int
+
+const (
+	priorityhigh priorityclass = iota
+	prioritynormal
+	prioritylow
+	priorityclasses
+)
+
+const (
+	limitpiece    = 32 << 10 // Biggest single take, keeps the waits short and fair
+	limitmaxsleep = 50 * time.Millisecond
+	pausepoll     = 200 * time.Millisecond // How often a paused transfer looks to see if it can go on
+
+	// Transfers get a class from their size unless the user says otherwise
+	smalltransfer = 1 << 20
+	largetransfer = 1 << 30
+)
+
+func (p priorityclass) String() string {
+	switch p {
+	case priorityhigh:
+		return "high"
+	case prioritynormal:
+		return "normal"
+	case prioritylow:
+		return "low"
+	}
+	return "unknown"
+}
+
+func parsepriority(name string) (priorityclass, error) {
+	for p := priorityhigh; p < priorityclasses; p++ {
+		if strings.EqualFold(name, p.String()) {
+			return p, nil
+		}
+	}
+	return prioritynormal, fmt.Errorf("unknown priority %q, use high, normal or low", name)
+}
+
+// Notes jump the queue, ISOs wait their turn
+func defaultpriority(size int64) priorityclass {
+	switch {
+	case size <= smalltransfer:
+		return priorityhigh
+	case size >= largetransfer:
+		return prioritylow
+	}
+	return prioritynormal
+}
+
+type tokenbucket struct {
+	mu      sync.Mutex
+	rate    float64 // Bytes per second, 0 is unlimited
+	tokens  float64
+	last    time.Time
+	waiting [priorityclasses]int
+}
+
+func newtokenbucket(rate int64) *tokenbucket {
+	tb := &tokenbucket{last: time.Now()}
+	tb.setrate(rate)
+	return tb
+}
+
+// A quarter second of data, but always enough for one piece
+func (tb *tokenbucket) burst() float64 {
+	return max(tb.rate/4, limitpiece)
+}
+
+func (tb *tokenbucket) setrate(rate int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.rate = float64(max(rate, 0))
+	tb.tokens = min(tb.tokens, tb.burst())
+}
+
+func (tb *tokenbucket) refill(now time.Time) {
+	tb.tokens = min(tb.tokens+now.Sub(tb.last).Seconds()*tb.rate, tb.burst())
+	tb.last = now
+}
+
+// Is a more important class waiting on this bucket
+func (tb *tokenbucket) outranked(class priorityclass) bool {
+	for p := priorityhigh; p < class; p++ {
+		if tb.waiting[p] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Block until n bytes (no more than limitpiece) may go through
+func (tb *tokenbucket) take(n int, class priorityclass) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	tb.waiting[class]++
+	defer func() { tb.waiting[class]-- }()
+
+	for tb.rate > 0 {
+		tb.refill(time.Now())
+
+		if !tb.outranked(class) && tb.tokens >= float64(n) {
+			tb.tokens -= float64(n)
+			return
+		}
+
+		wait := limitmaxsleep
+		if !tb.outranked(class) {
+			wait = min(time.Duration((float64(n)-tb.tokens)/tb.rate*float64(time.Second)), limitmaxsleep)
+		}
+
+		// Learning: Let go of the lock while sleeping, otherwise nobody else could even register as waiting
+		tb.mu.Unlock()
+		time.Sleep(wait)
+		tb.mu.Lock()
+	}
+}
+
+// The buckets of one server
+type limiter struct {
+	mu       sync.Mutex
+	global   *tokenbucket
+	peerrate int64
+	peers    map[string]*tokenbucket
+}
+
+func newlimiter(global int64, peer int64) *limiter {
+	return &limiter{global: newtokenbucket(global), peerrate: peer, peers: make(map[string]*tokenbucket)}
+}
+
+func (l *limiter) peer(key string) *tokenbucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.peers[key]
+	if !ok {
+		bucket = newtokenbucket(l.peerrate)
+		l.peers[key] = bucket
+	}
+	return bucket
+}
+
+func (l *limiter) setpeerrate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.peerrate = rate
+	for _, bucket := range l.peers {
+		bucket.setrate(rate)
+	}
+}
+
+// Wait for both the peer and the global bucket
+func (l *limiter) take(peer string, n int, class priorityclass) {
+	l.peer(peer).take(n, class)
+	l.global.take(n, class)
+}
+
+// Who is on the other end of a connection, the key for its peer bucket
+func (c *conn) peer() string {
+	if c.target.IsValid() {
+		return poolkey(c.target.Addr())
+	}
+	return c.sourceCON
+}
+
+// Wait until n bytes of a connection may go through. A paused transfer waits here
+// until it's resumed, a cancelled or failed one gets an error so its streams wind down
+func (si *ServerInstance) throttle(c *conn, n int) error {
+	for {
+		si.poolmu.RLock()
+		state, class := c.state, c.priority
+		si.poolmu.RUnlock()
+
+		if state.finished() {
+			return fmt.Errorf("transfer %s", state)
+		}
+		if state != statepaused {
+			si.limits.take(c.peer(), n, class)
+			return nil
+		}
+		time.Sleep(pausepoll)
+	}
+}
+
+// A reader or writer that keeps a transfer inside the limits
+type throttled struct {
+	si *ServerInstance
+	c  *conn
+	r  io.Reader
+	w  io.Writer
+}
+
+func (t *throttled) Read(p []byte) (int, error) {
+	if len(p) > limitpiece {
+		p = p[:limitpiece]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if stop := t.si.throttle(t.c, n); stop != nil {
+			return n, stop
+		}
+	}
+	return n, err
+}
+
+func (t *throttled) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		piece := p[written:min(written+limitpiece, len(p))]
+		if err := t.si.throttle(t.c, len(piece)); err != nil {
+			return written, err
+		}
+
+		n, err := t.w.Write(piece)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Read a rate like 500K, 2M, 1.5MB/s or off. Units are powers of 1024
+func ParseRate(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "OFF" || value == "NONE" {
+		return 0, nil
+	}
+
+	value = strings.TrimSuffix(value, "/S")
+	value = strings.TrimSuffix(value, "B")
+
+	multiplier := 1.0
+	for i, unit := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(value, unit) {
+			multiplier = float64(int64(1) << (10 * (i + 1)))
+			value = strings.TrimSuffix(value, unit)
+			break
+		}
+	}
+
+	// Learning: ParseFloat takes NaN, Inf and 1e30 too, and turning those into an int64 gives garbage (negative on amd64)
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) || math.IsInf(number, 0) || number < 0 || number >= math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("bad rate %q", value)
+	}
+
+	return int64(number * multiplier), nil
+}
+
+// The global and per peer limits in bytes per second, 0 is unlimited
+func (si *ServerInstance) Limits() (int64, int64) {
+	si.poolmu.RLock()
+	defer si.poolmu.RUnlock()
+	return si.config.LimitGlobal, si.config.LimitPeer
+}
+
+// Change a limit while the server runs. scope is global or peer. It's saved for next time too
+func (si *ServerInstance) SetLimit(scope string, rate int64) error {
+	if rate < 0 {
+		return errors.New("a rate can't be negative")
+	}
+
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	switch scope {
+	case "global":
+		si.config.LimitGlobal = rate
+		si.limits.global.setrate(rate)
+	case "peer":
+		si.config.LimitPeer = rate
+		si.limits.setpeerrate(rate)
+	default:
+		return fmt.Errorf("unknown limit %q, use global or peer", scope)
+	}
+
+	return si.config.save()
+}
+
+// Move a transfer to another priority class
+func (si *ServerInstance) SetPriority(id string, class string) error {
+	priority, err := parsepriority(class)
+	if err != nil {
+		return err
+	}
+
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	c, ok := si.reqpool[id]
+	if !ok {
+		c, ok = si.connection[id]
+	}
+	if !ok {
+		return errors.New("no transfer with id " + id)
+	}
+
+	c.priority = priority
+	return nil
+}
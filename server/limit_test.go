@@ -0,0 +1,43 @@
+package server
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value string
+		rate  int64
+		ok    bool
+	}{
+		{"off", 0, true},
+		{"500", 500, true},
+		{"500K", 500 << 10, true},
+		{"2M", 2 << 20, true},
+		{"1.5MB/s", 3 << 19, true},
+		{"1g", 1 << 30, true},
+		{"-1K", 0, false},
+		{"NaN", 0, false},
+		{"Inf", 0, false},
+		{"+InfM", 0, false},
+		{"1e30G", 0, false},
+		{"9223372036854775807", 0, false},
+		{"fast", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			rate, err := ParseRate(tt.value)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("took it as %d", rate)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rate != tt.rate {
+				t.Fatalf("got %d, want %d", rate, tt.rate)
+			}
+		})
+	}
+}
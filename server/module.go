@@ -1,18 +1,23 @@
 package server
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	FR "github.com/QFServer/fr"
 	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
 )
 
 func (si *ServerInstance) REQmodule(alive chan bool) {
@@ -39,18 +44,40 @@ func (si *ServerInstance) REQmodule(alive chan bool) {
 	logger.Output("SERVERREQ", "Current Pool")
 	pingablePool := make(map[int]string)
 	requestablePool := make(map[int]string)
+
+	// Learning: Map order is random in go, so sort the addresses to keep the indexes steady between views
+	pingKeys := make([]string, 0, len(pingPool))
 	for i := range pingPool {
+		pingKeys = append(pingKeys, i)
+	}
+	sort.Strings(pingKeys)
+
+	for _, i := range pingKeys {
 
-		logger.Output("NODE", fmt.Sprintf("%d | %s", counter+1, i))
+		if pingPool[i].Alias != "" {
+			logger.Output("NODE", fmt.Sprintf("%d | %s (%s)", counter+1, i, pingPool[i].Alias))
+		} else {
+			logger.Output("NODE", fmt.Sprintf("%d | %s", counter+1, i))
+		}
 		pingablePool[counter] = i
 
 		counter += 1
 	}
 
+	// Requests are keyed by their transfer id, the same peer can have a few going at once
 	counter = 0
+	reqKeys := make([]string, 0, len(reqPool))
 	for i := range reqPool {
+		reqKeys = append(reqKeys, i)
+	}
+	sort.Slice(reqKeys, func(a, b int) bool {
+		return reqPool[reqKeys[a]].created.Before(reqPool[reqKeys[b]].created)
+	})
+
+	for _, i := range reqKeys {
 
-		logger.Output("REQ", fmt.Sprintf("C%d | %s", counter+1, i))
+		c := reqPool[i]
+		logger.Output("REQ", fmt.Sprintf("C%d | %s | %s | %s | %s", counter+1, c.sourceCON, i, c.summary(), c.state))
 		requestablePool[counter] = i
 
 		counter += 1
@@ -65,53 +92,339 @@ func (si *ServerInstance) REQmodule(alive chan bool) {
 			goodInput = true
 		}
 
-		if input == "1" { // TODO: THis is hardcoded for now
-			nodeToPing, exist := pingablePool[0]
+		// A request goes out to an alias from the address book or the index shown above
+		// Files to offer come after it: 1 notes.txt photo.png
+		// Several go comma separated, a group with @: 1,3,alice notes.txt or @standup notes.txt
+		fields := strings.Fields(input)
+		nodeToPing := ""
+		if len(fields) == 0 {
+			fields = []string{""}
+		}
+		if _, isAlias := getaddressbook().lookup(fields[0]); isAlias {
+			nodeToPing = fields[0]
+		} else if index, err := strconv.Atoi(fields[0]); err == nil {
+			node, exist := pingablePool[index-1]
 
 			if exist == false {
 				logger.Debug("ERROR", "That entry doesnt exist!")
 			} else {
-				// Prepare the file that we want to send over
-				getFile := FR.ReadFromFile(filepath.Join(os.TempDir(), "example"))
+				nodeToPing = node
+			}
+		} else if strings.ContainsRune(fields[0], ',') || strings.HasPrefix(fields[0], "@") {
+			targets, err := expandtargets(fields[:1], func(part string) (string, bool) {
+				index, err := strconv.Atoi(part)
+				node, exist := pingablePool[index-1]
+				return node, err == nil && exist
+			})
+			if err != nil {
+				logger.Output("ERROR", err.Error())
+			} else {
+				nodeToPing = strings.Join(targets, ",")
+			}
+		}
 
-				// Generate a private key
-				masterPriv, _ := rsa.GenerateKey(rand.Reader, 2048)
+		// ttl=30m or downloads=3 among the files makes it a share the receiver pulls, see share.go
+		share, paths, err := parseshare(fields[1:])
+		if err != nil && nodeToPing != "" {
+			logger.Output("ERROR", err.Error())
+			nodeToPing = ""
+		}
 
-				// We store this information inside a connection for this node that we're requesting to
-				connObject := &conn{
-					endpointCON:  nodeToPing,
-					data:         getFile,
-					masterPublic: masterPriv.PublicKey,
-				}
+		if nodeToPing != "" {
+			if len(paths) == 0 {
+				paths = []string{filepath.Join(os.TempDir(), "example")}
+			}
 
-				si.connection[nodeToPing] = connObject
+			logger.Output("SERVERREQ", "Message to go with it (enter for none)")
+			message := logger.InputFromUser()
 
-				// TODO: This should be in a key manager internally
-				// Storing the private key (Since we're the requesting node we're the "master" or "server")
-				si.conKeyPriv[si.connection[nodeToPing]] = masterPriv
+			if targets := strings.Split(nodeToPing, ","); len(targets) > 1 {
+				si.sendmany(targets, paths, message, share)
+			} else {
+				si.sendrequest(nodeToPing, paths, message, share)
+			}
+		}
 
-				// Building the reader for the connection | We're sending only vital information to establish a secure connection
-				r := strings.NewReader(
-					fmt.Sprintf("%s||%s||%s",
-						connObject.endpointCON,
-						connObject.masterPublic.N.String(),
-						strconv.Itoa(connObject.masterPublic.E)))
+		// C1 accepts the request from 1, R1 rejects it, I1 shows what it is
+		if nodeToPing == "" && len(input) > 1 && strings.ContainsRune("CcRrIi", rune(input[0])) {
+			index, err := strconv.Atoi(input[1:])
+			requester, exist := requestablePool[index-1]
 
-				// Send over the connection object
-				http.Post("http://"+nodeToPing+":8080"+"/req", "text/plain", r)
+			if err != nil || exist == false {
+				logger.Debug("ERROR", "That entry doesn't exist!")
+			} else {
+				switch strings.ToUpper(input[:1]) {
+				case "C":
+					si.answerrequest(requester, true, "")
+				case "R":
+					si.answerrequest(requester, false, "rejected by the user")
+				case "I":
+					si.showrequest(requester)
+				}
 			}
 		}
 
-		// if input == "C1" {
-		// 	nodeToPing, exist := requestablePool[0]
+		time.Sleep(time.Second * 1)
+	}
+}
 
-		// 	if exist == false {
-		// 		logger.Debug("ERROR", "That entry doesn't exist!")
-		// 	} else {
-		// 		// This means that we
-		// 	}
-		// }
+// Make a request to a node. The node is an alias or an address from the pool
+func (si *ServerInstance) sendrequest(nodeToPing string, paths []string, message string, share sharelimits) {
+	logger := log.GetInstance()
 
-		time.Sleep(time.Second * 1)
+	// Peers on the other side of a relay get the file sealed and stored at the relay
+	if peer, ok := si.GetPingPool()[nodeToPing]; ok && peer.Relay != "" {
+		for _, path := range paths {
+			getFile := FR.ReadFromFile(path)
+			if err := si.sendrelayed(peer, filepath.Base(path), getFile); err != nil {
+				logger.Output("ERROR", "Relay would not take the file: "+err.Error())
+			} else {
+				logger.Output("RELAY", "Handed "+path+" to "+peer.Relay+" for "+peer.NodeID)
+			}
+		}
+		return
+	}
+
+	id, err := si.offer(nodeToPing, paths, message, share)
+	switch {
+	case errors.Is(err, errunreachable):
+		// Not there right now, the outbox tries again when discovery sees it
+		item, qerr := getoutbox().queue(OutboxItem{Kind: KindOffer, To: nodeToPing, Text: message, Paths: paths, Share: share}, err)
+		if qerr != nil {
+			logger.Output("ERROR", fmt.Sprintf("%v, and it couldn't go in the outbox: %v", err, qerr))
+			return
+		}
+		logger.Output("OUTBOX", fmt.Sprintf("%s isn't reachable, the offer waits in the outbox as %s", nodeToPing, item.ID))
+	case err != nil:
+		logger.Output("ERROR", fmt.Sprintf("%s didn't take the request: %v", nodeToPing, err))
+	case share.shared():
+		logger.Output("REQ", fmt.Sprintf("Shared %s with %s as transfer %s, %d downloads for %s", humansize(sumsize(paths)), nodeToPing, id, share.Downloads, share.TTL))
+	default:
+		logger.Output("REQ", fmt.Sprintf("Offered %s to %s as transfer %s", humansize(sumsize(paths)), nodeToPing, id))
+	}
+}
+
+// Offer files to a node and give back the transfer id. An errunreachable error means it never got there
+// A share with limits is pulled by the receiver instead, the zero sharelimits pushes
+func (si *ServerInstance) offer(nodeToPing string, paths []string, message string, share sharelimits) (string, error) {
+	files, totalsize, err := describefiles(paths)
+	if err != nil {
+		return "", err
+	}
+	return si.offerfiles(nodeToPing, paths, files, totalsize, message, share)
+}
+
+// Describe the files so the other side can decide before accepting
+func describefiles(paths []string) ([]protocol.FileMeta, int64, error) {
+	files := make([]protocol.FileMeta, 0, len(paths))
+	var totalsize int64
+	for _, path := range paths {
+		size, hash, err := FR.HashFile(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("can't offer %s: %v", path, err)
+		}
+		files = append(files, protocol.FileMeta{Name: filepath.Base(path), Size: size, Hash: hash})
+		totalsize += size
+	}
+	return files, totalsize, nil
+}
+
+// Offer files that are already described. Sending to a group describes them once for everyone
+func (si *ServerInstance) offerfiles(nodeToPing string, paths []string, files []protocol.FileMeta, totalsize int64, message string, share sharelimits) (string, error) {
+	nodeAddr, err := resolvepeer(nodeToPing)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errunreachable, err)
+	}
+
+	// Generate a private key
+	masterPriv, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	// We store this information inside a connection for this node that we're requesting to
+	connObject := &conn{
+		id:           newid(),
+		endpointCON:  nodeToPing,
+		masterPublic: masterPriv.PublicKey,
+		sender:       protocol.Sender{NodeID: getidentity().nodeid(), Hostname: si.clienthostname},
+		files:        files,
+		totalsize:    totalsize,
+		message:      message,
+		paths:        paths,
+		priority:     defaultpriority(totalsize),
+	}
+
+	now := time.Now()
+	connObject.target = nodeAddr
+	connObject.state = statepending
+	connObject.created = now
+	connObject.updated = now
+
+	// A share says until when and how often, see share.go
+	var expires int64
+	if share.shared() {
+		connObject.expires = now.Add(share.TTL)
+		connObject.downloads = share.Downloads
+		expires = connObject.expires.UnixMilli()
+	}
+
+	// Building the offer for the connection | We're sending only vital information to establish a secure connection
+	offer, err := protocol.Marshal(protocol.Offer{
+		ID:        connObject.id,
+		Endpoint:  connObject.endpointCON,
+		Key:       protocol.PublicKey{N: connObject.masterPublic.N.Bytes(), E: connObject.masterPublic.E},
+		Sender:    connObject.sender,
+		Files:     connObject.files,
+		TotalSize: connObject.totalsize,
+		Message:   connObject.message,
+		Streams:   maxstreams,
+		Expires:   expires,
+		Downloads: connObject.downloads,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not build the offer: %v", err)
+	}
+
+	si.poolmu.Lock()
+	si.connection[connObject.id] = connObject
+
+	// TODO: This should be in a key manager internally
+	// Storing the private key (Since we're the requesting node we're the "master" or "server")
+	si.conKeyPriv[connObject] = masterPriv
+	si.poolmu.Unlock()
+
+	// Send over the connection object. If they didn't take it there's nothing to wait for
+	if err := postoffer(nodeAddr, offer); err != nil {
+		si.poolmu.Lock()
+		var remote *RemoteError
+		if errors.As(err, &remote) {
+			connObject.transition(statefailed)
+			connObject.reason = err.Error()
+		} else {
+			// Never got there, so it was never a transfer. The outbox makes a new one next time
+			delete(si.connection, connObject.id)
+			err = fmt.Errorf("%w: %v", errunreachable, err)
+		}
+		delete(si.conKeyPriv, connObject)
+		si.poolmu.Unlock()
+		return "", err
+	}
+
+	return connObject.id, nil
+}
+
+// Size of the files on disk, only for telling the user
+func sumsize(paths []string) int64 {
+	var total int64
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// Post an offer to /req. A node puts it in its pool and answers 202, the accept or reject comes later
+func postoffer(target netip.AddrPort, offer []byte) error {
+	client := &http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(nodeurl(target, "/req"), "application/json", bytes.NewReader(offer))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return readproblem(resp, http.StatusAccepted)
+}
+
+// Accept or reject a request that came to us and tell the requester straight away
+func (si *ServerInstance) answerrequest(id string, accept bool, reason string) {
+	logger := log.GetInstance()
+
+	si.poolmu.Lock()
+	c, ok := si.reqpool[id]
+	if !ok {
+		si.poolmu.Unlock()
+		logger.Output("ERROR", "That request is gone")
+		return
+	}
+
+	to := staterejected
+	if accept {
+		to = stateaccepted
+	}
+	if err := c.transition(to); err != nil {
+		si.poolmu.Unlock()
+		logger.Output("ERROR", err.Error())
+		return
+	}
+	c.reason = reason
+	si.poolmu.Unlock()
+
+	var reply protocol.Message = protocol.Reject{ID: c.id, Reason: reason}
+	if accept {
+		key, encrypted, err := newsessionkey(c)
+		if err != nil {
+			logger.Output("ERROR", "Could not make a session key: "+err.Error())
+			return
+		}
+
+		// Ask for as many of the offered streams as the link took last time. A share comes in one pull
+		si.poolmu.Lock()
+		c.sessionkey = key
+		c.streams = si.tuner.suggest(c.sourceCON, c.totalsize, c.streams)
+		if c.shared() {
+			c.streams = 1
+		}
+		streams := c.streams
+		si.poolmu.Unlock()
+
+		reply = protocol.Accept{ID: c.id, Key: encrypted, Streams: streams}
+	}
+
+	if err := sendreply(c.target, reply); err != nil {
+		logger.Output("ERROR", fmt.Sprintf("Could not tell %s: %v", c.sourceCON, err))
+		return
+	}
+
+	logger.Output("REQ", fmt.Sprintf("Request %s from %s %s", id, c.sourceCON, to))
+
+	if accept && c.shared() {
+		go si.pulltransfer(c)
+	}
+}
+
+// Post an accept or reject back to whoever made the request
+func sendreply(requester netip.AddrPort, reply protocol.Message) error {
+	return postmessage(requester, "/reply", reply)
+}
+
+// Everything we know about a request that came to us
+func (si *ServerInstance) showrequest(id string) {
+	logger := log.GetInstance()
+
+	si.poolmu.RLock()
+	found, ok := si.reqpool[id]
+	var c conn
+	if ok {
+		c = *found
+	}
+	si.poolmu.RUnlock()
+	if !ok {
+		logger.Output("ERROR", "That request is gone")
+		return
+	}
+
+	logger.Output("INFO", fmt.Sprintf("From: %s (%s, node %s)", c.sourceCON, c.sender.Hostname, c.sender.NodeID))
+	logger.Output("INFO", "Asked for: "+c.endpointCON)
+	logger.Output("INFO", "Id: "+c.id)
+	logger.Output("INFO", fmt.Sprintf("Files: %d, %s total", len(c.files), humansize(c.totalsize)))
+	for _, f := range c.files {
+		logger.Output("INFO", fmt.Sprintf("  %s | %s | sha256 %s", f.Name, humansize(f.Size), f.Hash))
+	}
+	if c.message != "" {
+		logger.Output("INFO", "Message: "+c.message)
+	}
+	if c.shared() {
+		logger.Output("INFO", "Share: pulled instead of pushed, "+c.sharesummary())
 	}
+	logger.Output("INFO", fmt.Sprintf("State: %s for %s", c.state, time.Since(c.updated).Round(time.Second)))
+	logger.Output("INFO", fmt.Sprintf("Key: RSA %d bits", c.masterPublic.N.BitLen()))
 }
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"time"
+	"unicode/utf8"
+
+	Crypt "github.com/QFServer/crypt"
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Notes
+// What the project started out as, passing a bit of text to another device. A note is sealed to the
+// receiver's box key (the one from /info, checked against the address book pin) and posted to /note.
+// The receiver opens it and keeps it in the inbox (inbox.go), nothing is written to the downloads.
+// It answers with a signed delivered receipt, a read one follows once the note is opened (receipts.go)
+
+// Seal a note to a peer and post it. name is an alias or an address from the pool.
+// A peer that can't be reached gets it later from the outbox, sent is false then
+func (si *ServerInstance) SendNote(name string, text string) (string, bool, error) {
+	if !CheckServerAlive() {
+		return "", false, errors.New("the server isn't alive")
+	}
+	if text == "" {
+		return "", false, errors.New("the note is empty")
+	}
+	if len(text) > protocol.MaxNoteText {
+		return "", false, fmt.Errorf("the note is %s, notes can be %s at most", humansize(int64(len(text))), humansize(protocol.MaxNoteText))
+	}
+
+	id := newid()
+	err := si.delivernote(name, id, text, time.Now())
+	if errors.Is(err, errunreachable) {
+		if _, qerr := getoutbox().queue(OutboxItem{ID: id, Kind: KindNote, To: name, Text: text}, err); qerr != nil {
+			return "", false, fmt.Errorf("%v, and it couldn't go in the outbox: %v", err, qerr)
+		}
+		return id, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+
+	if err := getoutbox().delivered(OutboxItem{ID: id, Kind: KindNote, To: name, Text: text}); err != nil {
+		log.GetInstance().Debug("OUTBOX", "Sent note not listed: "+err.Error())
+	}
+	return id, true, nil
+}
+
+// Seal and post one note. The id and time stay the same however often the outbox tries,
+// so a receiver that already has it answers duplicate instead of keeping it twice
+func (si *ServerInstance) delivernote(name string, id string, text string, written time.Time) error {
+	target, recipient, node, err := si.notetarget(name)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := Crypt.Seal(recipient, []byte(text))
+	if err != nil {
+		return err
+	}
+
+	note := protocol.Note{
+		ID:     id,
+		Sender: protocol.Sender{NodeID: getidentity().nodeid(), Hostname: si.clienthostname},
+		Sent:   written.UnixMilli(),
+		Sealed: sealed,
+	}
+
+	// Remembered before it goes, the read receipt can come back before we'd get around to it afterwards
+	if err := getreceipts().remember(sentitem{About: id, Kind: KindNote, To: name, Node: node, Sent: written}); err != nil {
+		log.GetInstance().Debug("RECEIPT", "Receipts for the note only last this session: "+err.Error())
+	}
+
+	receipt, err := postnote(target, note)
+	var remote *RemoteError
+	if err != nil && !errors.As(err, &remote) {
+		return fmt.Errorf("%w: %v", errunreachable, err)
+	}
+	if err == nil {
+		keepnotereceipt(receipt, id, node)
+	}
+	return err
+}
+
+// Keep the delivered receipt from the answer to /note. Older nodes answer without one
+func keepnotereceipt(content []byte, id string, node string) {
+	if len(content) == 0 {
+		return
+	}
+
+	m, origin, err := getguard().Expect(bytes.NewReader(content), protocol.MaxMessageSize, protocol.TypeReceipt)
+	if err == nil && (m.(protocol.Receipt).About != id || origin.NodeID != node) {
+		err = fmt.Errorf("receipt for %s from %s", m.(protocol.Receipt).About, origin.NodeID)
+	}
+	if err == nil {
+		_, _, err = keepreceipt(content, m.(protocol.Receipt), origin)
+	}
+	if err != nil {
+		log.GetInstance().Debug("RECEIPT", fmt.Sprintf("Delivered receipt for %s not kept: %v", id, err))
+	}
+}
+
+// Where a note goes, the key to seal it to and the node it is. Asking /info right before sending also tells us it's up
+func (si *ServerInstance) notetarget(name string) (netip.AddrPort, *ecdh.PublicKey, string, error) {
+	target, info, err := si.directpeer(name, "notes")
+	if err != nil {
+		return netip.AddrPort{}, nil, "", err
+	}
+
+	boxkey, err := base64.StdEncoding.DecodeString(info.Keys.Box)
+	if err != nil {
+		return netip.AddrPort{}, nil, "", errors.New("no box key for " + name)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(boxkey)
+	if err != nil {
+		return netip.AddrPort{}, nil, "", err
+	}
+
+	return target, recipient, info.NodeID, nil
+}
+
+// A peer we talk to directly, with who it says it is. what is what we're about to send, for the error
+func (si *ServerInstance) directpeer(name string, what string) (netip.AddrPort, protocol.Hello, error) {
+	if peer, ok := si.GetPingPool()[name]; ok && peer.Relay != "" {
+		return netip.AddrPort{}, protocol.Hello{}, fmt.Errorf("%s is only reachable through a relay, %s go direct", name, what)
+	}
+
+	target, err := resolvepeer(name)
+	if err != nil {
+		return netip.AddrPort{}, protocol.Hello{}, fmt.Errorf("%w: %v", errunreachable, err)
+	}
+
+	client := &http.Client{Timeout: scantimeout * 2}
+	info, err := probeinfo(context.Background(), client, target)
+	if err != nil {
+		return netip.AddrPort{}, protocol.Hello{}, fmt.Errorf("%w: %s didn't answer: %v", errunreachable, name, err)
+	}
+
+	// Learning: Trust on first use, if the address book pinned other keys this isn't who we think it is
+	if err := getaddressbook().pin(target, PinnedKeys(info.Keys)); err != nil {
+		return netip.AddrPort{}, protocol.Hello{}, err
+	}
+	return target, info, nil
+}
+
+// The receiver answers 202 once the note is in its inbox, with the delivered receipt as the body
+func postnote(target netip.AddrPort, note protocol.Note) ([]byte, error) {
+	content, err := protocol.Marshal(note)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(nodeurl(target, "/note"), "application/json", bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := readproblem(resp, http.StatusAccepted); err != nil {
+		return nil, err
+	}
+	// Learning: The note got there whatever happens to the body, a receipt we can't read is only a missing receipt
+	receipt, _ := io.ReadAll(io.LimitReader(resp.Body, protocol.MaxMessageSize+1))
+	return receipt, nil
+}
+
+// Someone sent us a note
+func (si *ServerInstance) handlenote(w http.ResponseWriter, r *http.Request) {
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+
+	m, origin, err := getguard().Expect(r.Body, protocol.MaxMessageSize, protocol.TypeNote)
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+	msg := m.(protocol.Note)
+
+	if origin.NodeID != msg.Sender.NodeID {
+		rejectmessage(w, r, fmt.Errorf("%w: note from %s signed by %s", protocol.ErrSignature, msg.Sender.NodeID, origin.NodeID))
+		return
+	}
+
+	text, err := Crypt.Open(getidentity().box, msg.Sealed)
+	if err != nil {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeEncryption, err.Error())
+		return
+	}
+	if len(text) > protocol.MaxNoteText || !utf8.Valid(text) {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, "a note has to be text")
+		return
+	}
+
+	if getinbox().full(origin.NodeID, poolkey(remote.Addr())) {
+		writeproblem(w, http.StatusTooManyRequests, protocol.CodeBusy, fmt.Sprintf("%d unread items from you already", inboxperpeer))
+		return
+	}
+
+	err = getinbox().add(InboxItem{
+		ID:       msg.ID,
+		Kind:     KindNote,
+		From:     msg.Sender,
+		Address:  poolkey(remote.Addr()),
+		ReplyTo:  peername(si.peeraddr(remote.Addr(), origin.NodeID)),
+		Sent:     time.UnixMilli(msg.Sent),
+		Received: time.Now(),
+		Text:     string(text),
+	})
+	if errors.Is(err, errinboxduplicate) {
+		writeproblem(w, http.StatusConflict, protocol.CodeDuplicate, "note "+msg.ID)
+		return
+	} else if err != nil {
+		log.GetInstance().Debug("INBOX", "Note only kept for this session: "+err.Error())
+	}
+
+	// The seal opened, so it got here whole. That's what the delivered receipt says
+	receipt, err := protocol.Marshal(protocol.Receipt{About: msg.ID, Kind: protocol.ReceiptDelivered, At: time.Now().UnixMilli()})
+	if err != nil {
+		log.GetInstance().Debug("RECEIPT", "Could not sign the receipt: "+err.Error())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(receipt)
+	log.GetInstance().Output("NOTE", fmt.Sprintf("New note from %s (%s), inbox to read it", notefrom(msg.Sender), poolkey(remote.Addr())))
+}
+
+// Hostname when there is one, the node id otherwise
+func notefrom(sender protocol.Sender) string {
+	if sender.Hostname != "" {
+		return sender.Hostname
+	}
+	return sender.NodeID
+}
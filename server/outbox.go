@@ -0,0 +1,470 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Outbox
+// Notes and offers for a peer that couldn't be reached wait in outbox.json in the config dir.
+// While the server runs they're tried again with a growing wait in between (15s, 30s, 1m ... 30m),
+// and straight away when discovery hears from the peer. A peer that answers "no" isn't tried again,
+// only one that wasn't there. Finished items stay in the list for a day so the user can see how it went.
+// With a passphrase set (vault.go) the text and paths are sealed on disk. After a restart they wait
+// for inbox unlock before they can go out.
+// Notes that went out straight away are listed too, as sent, so their receipts (receipts.go) show somewhere.
+// Receipts we owe a peer that wasn't there wait here as well
+
+const (
+	outboxfile    = "outbox.json"
+	outboxtick    = 2 * time.Second
+	outboxfirst   = 15 * time.Second
+	outboxmaxwait = 30 * time.Minute
+	outboxmaxage  = 7 * 24 * time.Hour // Waiting longer than this, give up
+	outboxkeep    = 24 * time.Hour     // How long finished items stay in the list
+	outboxquiet   = time.Minute        // Not heard from for this long, the next beacon counts as it coming back
+)
+
+// Where an outbox item is at
+const (
+	OutboxWaiting   = "waiting"
+	OutboxSending   = "sending"
+	OutboxSent      = "sent"
+	OutboxFailed    = "failed" // The peer answered and said no
+	OutboxExpired   = "expired"
+	OutboxCancelled = "cancelled"
+	OutboxRetracted = "retracted" // An offer taken back with outbox retract
+)
+
+// Something that still has to go out
+type OutboxItem struct {
+	ID        string      `json:"id"`              // Notes keep it when they go out, offers get a transfer id of their own
+	Kind      string      `json:"kind"`            // KindNote, KindOffer or KindReceipt
+	To        string      `json:"to"`              // Alias or address the user picked
+	Node      string      `json:"node,omitempty"`  // Receipts, the node that has to get it
+	About     string      `json:"about,omitempty"` // Receipts, the note or transfer it's for
+	Address   string      `json:"address,omitempty"`
+	Text      string      `json:"text,omitempty"` // The note, or the message with an offer
+	Paths     []string    `json:"paths,omitempty"`
+	State     string      `json:"state"`
+	Attempts  int         `json:"attempts"`
+	LastError string      `json:"last_error,omitempty"`
+	Transfer  string      `json:"transfer,omitempty"` // Offers, the transfer id once it went out
+	Share     sharelimits `json:"share,omitzero"`     // Offers, pulled instead of pushed. The ttl starts when it goes out
+	Created   time.Time   `json:"created"`
+	Updated   time.Time   `json:"updated"`
+	NextTry   time.Time   `json:"next_try"`
+	Sealed    []byte      `json:"sealed,omitempty"` // Text and paths, sealed to the vault
+
+	locked bool // Sealed and not opened yet
+}
+
+// What gets sealed of an item
+type outboxcontent struct {
+	Text  string   `json:"text,omitempty"`
+	Paths []string `json:"paths,omitempty"`
+}
+
+type outbox struct {
+	Items []OutboxItem         `json:"items"`
+	heard map[string]time.Time // When discovery last heard each address
+	mu    sync.Mutex
+}
+
+var (
+	outboxinstance *outbox
+	outboxonce     sync.Once
+)
+
+// The peer wasn't there (couldn't resolve, connect or get an answer). Anything else is the peer saying no
+var errunreachable = errors.New("unreachable")
+
+// The outbox is a singleton, it can be looked at with or without the server running
+func getoutbox() *outbox {
+	outboxonce.Do(func() {
+		outboxinstance = &outbox{Items: make([]OutboxItem, 0), heard: make(map[string]time.Time)}
+
+		dir, err := configdir()
+		if err != nil {
+			return
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, outboxfile))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.GetInstance().Debug("OUTBOX", "Could not read the outbox: "+err.Error())
+			}
+			return
+		}
+
+		if err := json.Unmarshal(content, outboxinstance); err != nil {
+			log.GetInstance().Output("OUTBOX", "Outbox is broken: "+err.Error())
+		}
+
+		// Whatever was going out when we stopped goes again
+		for i := range outboxinstance.Items {
+			item := &outboxinstance.Items[i]
+			if item.State == OutboxSending {
+				item.State = OutboxWaiting
+			}
+			item.locked = item.Sealed != nil
+		}
+	})
+
+	return outboxinstance
+}
+
+// Write the outbox to disk. Must hold the lock
+func (ob *outbox) save() error {
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	// Learning: Seal once and keep it, sealing again on every save would only make new bytes for the same thing
+	items := make([]OutboxItem, len(ob.Items))
+	for i := range ob.Items {
+		item := &ob.Items[i]
+		if item.Sealed == nil && getvault().configured() {
+			content, err := json.Marshal(outboxcontent{Text: item.Text, Paths: item.Paths})
+			if err != nil {
+				return err
+			}
+			if item.Sealed, err = getvault().seal(content); err != nil {
+				return err
+			}
+		}
+
+		items[i] = *item
+		if item.Sealed != nil {
+			items[i].Text, items[i].Paths = "", nil
+		}
+	}
+
+	content, err := json.MarshalIndent(outbox{Items: items}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(dir, outboxfile), content, 0600)
+}
+
+func (item OutboxItem) finished() bool {
+	return item.State != OutboxWaiting && item.State != OutboxSending
+}
+
+// 15s after the first miss, doubling up to 30m
+func backoff(attempts int) time.Duration {
+	wait := outboxfirst
+	for i := 1; i < attempts && wait < outboxmaxwait; i++ {
+		wait *= 2
+	}
+	return min(wait, outboxmaxwait)
+}
+
+// Put something that just missed its peer in the outbox
+func (ob *outbox) queue(item OutboxItem, why error) (OutboxItem, error) {
+	now := time.Now()
+	if item.ID == "" {
+		item.ID = newid()
+	}
+	if target, err := resolvepeer(item.To); err == nil {
+		item.Address = poolkey(target.Addr())
+	}
+	item.State = OutboxWaiting
+	item.Attempts = 1
+	item.LastError = failurereason(why)
+	item.Created = now
+	item.Updated = now
+	item.NextTry = now.Add(backoff(1))
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.Items = append(ob.Items, item)
+	return item, ob.save()
+}
+
+// A note that got there on the first try. It's only listed for its receipts
+func (ob *outbox) delivered(item OutboxItem) error {
+	now := time.Now()
+	item.State = OutboxSent
+	item.Attempts = 1
+	item.Created = now
+	item.Updated = now
+	if target, err := resolvepeer(item.To); err == nil {
+		item.Address = poolkey(target.Addr())
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.Items = append(ob.Items, item)
+	return ob.save()
+}
+
+// The error without the "unreachable:" in front, that's what the state already says
+func failurereason(err error) string {
+	if err == nil {
+		return ""
+	}
+	return strings.TrimPrefix(err.Error(), errunreachable.Error()+": ")
+}
+
+// Take the items that are due and mark them as going out
+func (ob *outbox) due(now time.Time) []OutboxItem {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	due := make([]OutboxItem, 0)
+	kept := ob.Items[:0]
+	changed := false
+	for _, item := range ob.Items {
+		switch {
+		case item.finished() && now.Sub(item.Updated) > outboxkeep:
+			changed = true
+			continue
+		case item.State == OutboxWaiting && now.Sub(item.Created) > outboxmaxage:
+			item.State, item.Updated = OutboxExpired, now
+			changed = true
+		case item.State == OutboxWaiting && item.locked:
+			// Nothing to send until the inbox is unlocked
+		case item.State == OutboxWaiting && !now.Before(item.NextTry):
+			item.State, item.Updated = OutboxSending, now
+			due = append(due, item)
+			changed = true
+		}
+		kept = append(kept, item)
+	}
+	ob.Items = kept
+
+	if changed {
+		if err := ob.save(); err != nil {
+			log.GetInstance().Debug("OUTBOX", "Could not write the outbox: "+err.Error())
+		}
+	}
+	return due
+}
+
+// Record how an attempt went
+func (ob *outbox) settle(id string, transfer string, err error) OutboxItem {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	now := time.Now()
+	for i := range ob.Items {
+		item := &ob.Items[i]
+		if item.ID != id {
+			continue
+		}
+
+		// Cancelled while it was going out, the peer may have it now but we keep the user's word
+		if item.State == OutboxCancelled || item.State == OutboxRetracted {
+			return *item
+		}
+
+		item.Updated = now
+		item.Attempts++
+		item.LastError = failurereason(err)
+		switch {
+		case err == nil:
+			item.State, item.Transfer = OutboxSent, transfer
+		case errors.Is(err, errunreachable):
+			item.State, item.NextTry = OutboxWaiting, now.Add(backoff(item.Attempts))
+		default:
+			item.State = OutboxFailed
+		}
+
+		if err := ob.save(); err != nil {
+			log.GetInstance().Debug("OUTBOX", "Could not write the outbox: "+err.Error())
+		}
+		return *item
+	}
+	return OutboxItem{}
+}
+
+// A passphrase was just set, write it again sealed
+func (ob *outbox) rewrite() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return ob.save()
+}
+
+// The vault was unlocked, open what was sealed before we started
+func (ob *outbox) unseal() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	for i := range ob.Items {
+		item := &ob.Items[i]
+		if !item.locked {
+			continue
+		}
+
+		sealed, err := getvault().open(item.Sealed)
+		content := outboxcontent{}
+		if err == nil {
+			err = json.Unmarshal(sealed, &content)
+		}
+		if err != nil {
+			log.GetInstance().Output("OUTBOX", fmt.Sprintf("Could not open %s: %v", item.ID, err))
+			continue
+		}
+		item.Text, item.Paths, item.locked = content.Text, content.Paths, false
+	}
+}
+
+// Discovery heard from a node. If it's back after being quiet, whatever waits for it goes on the next tick.
+// Learning: Only on coming back, a node that beacons all the time would otherwise undo the backoff
+func (ob *outbox) seen(addr netip.Addr) {
+	key := poolkey(addr)
+	now := time.Now()
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	last, heard := ob.heard[key]
+	ob.heard[key] = now
+	if heard && now.Sub(last) < outboxquiet {
+		return
+	}
+
+	for i := range ob.Items {
+		item := &ob.Items[i]
+		if item.State != OutboxWaiting {
+			continue
+		}
+		// Learning: Items whose peer didn't resolve when they were queued could be anyone, try them too
+		if item.Address == "" || item.Address == key {
+			item.NextTry = now
+		}
+	}
+}
+
+// Runs for as long as the server does, sending what's due one at a time
+func outboxsender() {
+	logger := log.GetInstance()
+	ob := getoutbox()
+
+	for serverinstance != nil {
+		time.Sleep(outboxtick)
+
+		si := serverinstance
+		if si == nil {
+			return
+		}
+
+		for _, item := range ob.due(time.Now()) {
+			transfer := ""
+			var err error
+			switch item.Kind {
+			case KindNote:
+				err = si.delivernote(item.To, item.ID, item.Text, item.Created)
+
+				// The peer already had it, an earlier try got there and only the answer got lost
+				var remote *RemoteError
+				if errors.As(err, &remote) && remote.Problem.Code == protocol.CodeDuplicate {
+					err = nil
+				}
+			case KindOffer:
+				transfer, err = si.offer(item.To, item.Paths, item.Text, item.Share)
+			case KindReceipt:
+				err = si.deliverreceipt(item.To, item.Node, item.About, item.Text, item.Created)
+			default:
+				err = fmt.Errorf("unknown kind %q", item.Kind)
+			}
+
+			item = ob.settle(item.ID, transfer, err)
+			switch item.State {
+			case OutboxSent:
+				logger.Output("OUTBOX", fmt.Sprintf("%s %s went out to %s", item.Kind, item.ID, item.To))
+			case OutboxFailed:
+				logger.Output("OUTBOX", fmt.Sprintf("%s %s to %s failed: %s", item.Kind, item.ID, item.To, item.LastError))
+			}
+		}
+	}
+}
+
+// Everything in the outbox, oldest first
+func OutboxList() []OutboxItem {
+	ob := getoutbox()
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	items := make([]OutboxItem, len(ob.Items))
+	copy(items, ob.Items)
+	return items
+}
+
+// Where an item is in the list. which is its number in the list or its id. Must hold the lock
+func (ob *outbox) find(which string) int {
+	for i, item := range ob.Items {
+		if item.ID == which || fmt.Sprint(i+1) == which {
+			return i
+		}
+	}
+	return -1
+}
+
+// Stop trying an item. which is its number in the list or its id
+func OutboxCancel(which string) (OutboxItem, error) {
+	ob := getoutbox()
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	index := ob.find(which)
+	if index < 0 {
+		return OutboxItem{}, errors.New("nothing in the outbox is " + which)
+	}
+
+	item := &ob.Items[index]
+	if item.finished() {
+		return *item, fmt.Errorf("%s is already %s", item.ID, item.State)
+	}
+	item.State, item.Updated = OutboxCancelled, time.Now()
+	return *item, ob.save()
+}
+
+// One line for the list
+func (item OutboxItem) Summary(now time.Time) string {
+	kind := item.Kind
+	if kind == KindReceipt {
+		// Learning: Trimmed, the text is sealed away while the inbox is locked
+		kind = strings.TrimSpace(item.Text + " " + kind)
+	}
+	line := fmt.Sprintf("%s | %s to %s | %s | %d tries", item.ID, kind, item.To, item.State, item.Attempts)
+	switch item.State {
+	case OutboxWaiting:
+		if item.locked {
+			line += " | waits for inbox unlock"
+			break
+		}
+		line += " | next in " + max(item.NextTry.Sub(now), 0).Round(time.Second).String()
+	case OutboxSent:
+		about := item.ID
+		if item.Transfer != "" {
+			line += " | transfer " + item.Transfer
+			about = item.Transfer
+		}
+		if item.Kind != KindReceipt {
+			if receipts := ReceiptSummary(getreceipts().of(about)); receipts != "" {
+				line += " | " + receipts
+			}
+		}
+	}
+	if item.LastError != "" && item.State != OutboxSent {
+		line += " | " + item.LastError
+	}
+	return line
+}
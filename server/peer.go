@@ -0,0 +1,33 @@
+package server
+
+import "github.com/QFServer/protocol"
+
+// Someone in the ping pool
+type Peer struct {
+	Hostname  string
+	Interface string // The interface they were discovered on
+	Alias     string // Set when the peer is in the address book
+	Manual    bool   // Added by hand instead of discovered
+	Notes     string
+	NodeID    string // Known once the peer answered /info
+	Keys      PinnedKeys
+	Relay     string // Address of the relay we reach this peer through, empty when it's direct
+	hello     []byte // Their signed /info answer as it came, a relay passes it on so the other side can check the keys
+}
+
+const (
+	servicename = "QFServer"
+	version     = "0.2.0"
+)
+
+// What we answer /info with, just enough to know who's on the other end
+func (si *ServerInstance) hello() protocol.Hello {
+	id := getidentity()
+	return protocol.Hello{
+		Service:  servicename,
+		Software: version,
+		NodeID:   id.nodeid(),
+		Hostname: si.clienthostname,
+		Keys:     protocol.Keys(id.publickeys()),
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/QFServer/protocol"
+)
+
+// Error answers
+// A handler that won't do what was asked answers with a real status code and a protocol.Problem
+// as JSON, so the asking side can tell "unknown transfer" from "bad key" without guessing from text.
+// Asking side: readproblem turns any answer it didn't want into a RemoteError the CLI can print
+
+// Answer with a status and a problem body
+func writeproblem(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(protocol.Problem{Code: code, Message: message})
+}
+
+// The remote address couldn't be read, nothing else can be checked without it
+func badaddress(w http.ResponseWriter, err error) {
+	writeproblem(w, http.StatusBadRequest, protocol.CodeBadAddress, err.Error())
+}
+
+// What another node said when it wouldn't do what we asked
+type RemoteError struct {
+	Status  int
+	Problem protocol.Problem
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("the other side %s [%d]", e.Problem.Describe(), e.Status)
+}
+
+// Check an answer. Anything but the wanted statuses (200 when none are given) comes back as a RemoteError.
+// Older nodes and plain HTTP errors answer with text, that ends up as the message
+func readproblem(resp *http.Response, want ...int) error {
+	if len(want) == 0 {
+		want = []int{http.StatusOK}
+	}
+	if slices.Contains(want, resp.StatusCode) {
+		return nil
+	}
+
+	remote := &RemoteError{Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, protocol.MaxMessageSize))
+	if err := json.Unmarshal(body, &remote.Problem); err != nil || remote.Problem.Code == "" {
+		remote.Problem = protocol.Problem{Message: strings.TrimSpace(string(body))}
+	}
+	if remote.Problem.Message == "" {
+		remote.Problem.Message = http.StatusText(resp.StatusCode)
+	}
+	return remote
+}
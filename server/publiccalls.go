@@ -1,9 +1,15 @@
 package server
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"net/netip"
+	"strings"
 
 	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
 )
 
 // Request pool
@@ -11,15 +17,162 @@ func (si *ServerInstance) GetRequestPool() map[string]conn {
 	if !CheckServerAlive() {
 		return map[string]conn{"ERROR": {}}
 	}
-	return si.reqpool
+
+	si.poolmu.RLock()
+	defer si.poolmu.RUnlock()
+
+	// Learning: Returning the map itself hands out a reference, readers would race the handlers. So copy it
+	pool := make(map[string]conn, len(si.reqpool))
+	for k, v := range si.reqpool {
+		pool[k] = *v
+	}
+	return pool
 }
 
 // Return all of the ping pools (This is everyone we can contact)
-func (si *ServerInstance) GetPingPool() map[string]string {
+func (si *ServerInstance) GetPingPool() map[string]Peer {
+	if !CheckServerAlive() {
+		return map[string]Peer{"ERROR": {Hostname: "ERROR: Cannot change broadcast since the server isn't alive!"}}
+	}
+
+	si.poolmu.RLock()
+	defer si.poolmu.RUnlock()
+
+	pool := make(map[string]Peer, len(si.pingpool))
+	for k, v := range si.pingpool {
+		pool[k] = v
+	}
+
+	// Address book entries sit next to the discovered ones
+	for _, entry := range getaddressbook().list() {
+		host, _, _ := splitpeeraddress(entry.Address)
+		if discovered, ok := pool[host]; ok {
+			discovered.Alias = entry.Alias
+			discovered.Notes = entry.Notes
+			pool[host] = discovered
+			continue
+		}
+
+		pool[entry.Address] = Peer{Alias: entry.Alias, Manual: true, Notes: entry.Notes}
+	}
+
+	return pool
+}
+
+// Scan a subnet from the client, the server has to be running
+func Scan(cidr string, progress func(done int, total int, found int)) error {
 	if !CheckServerAlive() {
-		return map[string]string{"ERROR": "ERROR: Cannot change broadcast since the server isn't alive!"}
+		return errors.New("the server isn't alive")
+	}
+	return serverinstance.Scan(cidr, progress)
+}
+
+// Add a peer to the address book by hand
+func AddPeer(address string, alias string) error {
+	if _, _, err := splitpeeraddress(address); err != nil {
+		return err
+	}
+
+	return getaddressbook().add(BookEntry{Alias: alias, Address: address})
+}
+
+// Everything in the address book
+func GetAddressBook() []BookEntry {
+	return getaddressbook().list()
+}
+
+// Write down something about a peer in the address book, empty clears it. Shows up in the pool
+func SetPeerNotes(peer string, notes string) error {
+	notes = strings.TrimSpace(notes)
+	if len(notes) > maxbooknotes {
+		return fmt.Errorf("notes are %d bytes, at most %d", len(notes), maxbooknotes)
+	}
+	return getaddressbook().update(peer, func(e *BookEntry) { e.Notes = notes })
+}
+
+// Pin a peer's keys by hand, read out by its owner instead of trusted on first use.
+// box can be empty, it's filled in from the first hello signed with the sign key
+func PinPeer(peer string, sign string, box string) error {
+	keys := PinnedKeys{Sign: sign, Box: box}
+	signkey, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil || len(signkey) != ed25519.PublicKeySize {
+		return errors.New("the sign key has to be the base64 of an ed25519 public key")
+	}
+	if box != "" {
+		boxkey, err := base64.StdEncoding.DecodeString(box)
+		if err != nil || len(boxkey) != 32 {
+			return errors.New("the box key has to be the base64 of an X25519 public key")
+		}
 	}
-	return si.pingpool
+	return getaddressbook().update(peer, func(e *BookEntry) { e.Keys = keys })
+}
+
+// Our own keys and node id, for reading out to someone who wants to pin them
+func GetOwnKeys() (PinnedKeys, string) {
+	id := getidentity()
+	return id.publickeys(), id.nodeid()
+}
+
+// Make or change a group in the address book. No members drops it
+func SetGroup(name string, members []string) error {
+	name = strings.TrimPrefix(name, "@")
+	if name == "" {
+		return errors.New("a group needs a name")
+	}
+	return getaddressbook().setgroup(name, members)
+}
+
+// Every group in the address book
+func GetGroups() map[string][]string {
+	ab := getaddressbook()
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	groups := make(map[string][]string, len(ab.Groups))
+	for name, members := range ab.Groups {
+		groups[name] = append([]string(nil), members...)
+	}
+	return groups
+}
+
+// Check if an address is already in the ping pool
+func (si *ServerInstance) inpingpool(addr netip.Addr) bool {
+	si.poolmu.RLock()
+	defer si.poolmu.RUnlock()
+
+	_, exists := si.pingpool[poolkey(addr)]
+	return exists
+}
+
+// Store [address] = peer, recording which interface found it
+func (si *ServerInstance) addtopingpool(addr netip.Addr, hostname string) {
+	iface := interfacefor(discoveryinterfaces(nil), addr)
+
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	si.pingpool[poolkey(addr)] = Peer{Hostname: hostname, Interface: iface}
+}
+
+// Store a node that answered /info. Keys get pinned for address book entries that don't have any yet
+func (si *ServerInstance) addscanned(target netip.AddrPort, info protocol.Hello, hello []byte) {
+	logger := log.GetInstance()
+
+	key := peername(target)
+
+	if err := getaddressbook().pin(target, PinnedKeys(info.Keys)); err != nil {
+		logger.Output("WARNING", fmt.Sprintf("%s: %v", target, err))
+		return
+	}
+
+	getoutbox().seen(target.Addr())
+
+	iface := interfacefor(discoveryinterfaces(nil), target.Addr())
+
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	si.pingpool[key] = Peer{Hostname: info.Hostname, Interface: iface, NodeID: info.NodeID, Keys: PinnedKeys(info.Keys), hello: hello}
 }
 
 // Open the server to be pinged
@@ -56,7 +209,7 @@ func BroadcastStateChange() {
 
 	logger.Output("SERVER", "Instance exists! Server broadcast will be changed now")
 	serverinstance.broadcasting = !serverinstance.broadcasting
-	logger.Output("SERVER", fmt.Sprintf("Broadcasting: %s", serverinstance.broadcasting))
+	logger.Output("SERVER", fmt.Sprintf("Broadcasting: %t", serverinstance.broadcasting))
 }
 
 // Simple check alive for the server instance
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Receipts
+// Whoever gets a note or a transfer from us signs a receipt and sends it back: delivered once a transfer
+// passed its hash check (a note once its seal opened), read once inbox read opened it.
+// Notes get theirs in the answer to /note, everything else is posted to /receipt, and one that can't go out
+// waits in the outbox like anything else. On our side receipts.jsonl keeps what we sent to which node, so
+// only that node can answer for it, and every receipt with the envelope it came in. The signature in there
+// can be checked again any time against the key the address book pinned for the peer
+
+const (
+	receiptsfile = "receipts.jsonl"
+	receiptkeep  = 90 * 24 * time.Hour // Sent things older than this are forgotten, receipts and all
+
+	KindReceipt = "receipt" // An outbox item carrying a receipt back to the sender
+)
+
+// A receipt we got. Proof is the signed envelope exactly as it came in
+type Receipt struct {
+	About string    `json:"about"` // The note or transfer id
+	Kind  string    `json:"kind"`  // protocol.ReceiptDelivered or protocol.ReceiptRead
+	Node  string    `json:"node"`  // Who signed it
+	At    time.Time `json:"at"`
+	Proof []byte    `json:"proof"`
+}
+
+// Something we sent and the node it went to
+type sentitem struct {
+	About string    `json:"about"`
+	Kind  string    `json:"kind"` // KindNote or KindOffer
+	To    string    `json:"to"`
+	Node  string    `json:"node"`
+	Sent  time.Time `json:"sent"`
+}
+
+// One line of the file, either half
+type receiptrecord struct {
+	Sent    *sentitem `json:"sent,omitempty"`
+	Receipt *Receipt  `json:"receipt,omitempty"`
+}
+
+type receiptstore struct {
+	mu   sync.Mutex
+	sent map[string]sentitem
+	got  map[string][]Receipt
+	disk bool
+}
+
+var (
+	receiptsinstance *receiptstore
+	receiptsonce     sync.Once
+)
+
+var errunknownreceipt = errors.New("nothing like that was sent to that node")
+
+// The receipts are a singleton, the outbox and history show them with or without the server
+func getreceipts() *receiptstore {
+	receiptsonce.Do(func() {
+		receiptsinstance = &receiptstore{sent: make(map[string]sentitem), got: make(map[string][]Receipt)}
+		if err := receiptsinstance.load(); err != nil {
+			log.GetInstance().Debug("RECEIPT", "Receipts only last this session: "+err.Error())
+			return
+		}
+		receiptsinstance.disk = true
+	})
+
+	return receiptsinstance
+}
+
+// Play the file back, and write it again without what's too old to keep
+func (rs *receiptstore) load() error {
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filepath.Join(dir, receiptsfile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	stale := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := receiptrecord{}
+		// A broken line (power cut mid write) is skipped, not fatal
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			stale = true
+			continue
+		}
+		switch {
+		case record.Sent != nil:
+			rs.sent[record.Sent.About] = *record.Sent
+		case record.Receipt != nil:
+			rs.got[record.Receipt.About] = append(rs.got[record.Receipt.About], *record.Receipt)
+		}
+	}
+	file.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for about, item := range rs.sent {
+		if time.Since(item.Sent) > receiptkeep {
+			delete(rs.sent, about)
+			delete(rs.got, about)
+			stale = true
+		}
+	}
+	if stale {
+		return rs.compact()
+	}
+	return nil
+}
+
+// Rewrite the file with only what's kept. Must hold the lock, or be loading
+func (rs *receiptstore) compact() error {
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(dir, receiptsfile)
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	for about, item := range rs.sent {
+		records := []receiptrecord{{Sent: &item}}
+		for _, receipt := range rs.got[about] {
+			records = append(records, receiptrecord{Receipt: &receipt})
+		}
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				file.Close()
+				return err
+			}
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Add a line to the file. Must hold the lock
+func (rs *receiptstore) write(record receiptrecord) error {
+	if !rs.disk {
+		return nil
+	}
+
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, receiptsfile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return json.NewEncoder(file).Encode(record)
+}
+
+// Remember that something went to a node, before it goes. Sending it again changes nothing
+func (rs *receiptstore) remember(item sentitem) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if known, ok := rs.sent[item.About]; ok && known.Node == item.Node {
+		return nil
+	}
+	rs.sent[item.About] = item
+	return rs.write(receiptrecord{Sent: &item})
+}
+
+// What we sent as about
+func (rs *receiptstore) find(about string) (sentitem, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	item, ok := rs.sent[about]
+	return item, ok
+}
+
+// Keep a receipt from the node the thing went to. False when we already had that one
+func (rs *receiptstore) add(receipt Receipt) (sentitem, bool, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	item, ok := rs.sent[receipt.About]
+	if !ok || item.Node != receipt.Node {
+		return sentitem{}, false, errunknownreceipt
+	}
+	for _, known := range rs.got[receipt.About] {
+		if known.Kind == receipt.Kind {
+			return item, false, nil
+		}
+	}
+
+	rs.got[receipt.About] = append(rs.got[receipt.About], receipt)
+	return item, true, rs.write(receiptrecord{Receipt: &receipt})
+}
+
+// The receipts for a note or transfer, in the order they came
+func (rs *receiptstore) of(about string) []Receipt {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return append([]Receipt(nil), rs.got[about]...)
+}
+
+// "delivered 14:02, read 14:10", empty without receipts
+func ReceiptSummary(receipts []Receipt) string {
+	parts := make([]string, 0, len(receipts))
+	for _, receipt := range receipts {
+		parts = append(parts, receipt.Kind+" "+receipt.At.Format("15:04"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// The receipts for an outbox item (its number or id) or for any note or transfer id
+func Receipts(which string) ([]Receipt, error) {
+	about := which
+	for i, item := range OutboxList() {
+		if item.ID == which || fmt.Sprint(i+1) == which {
+			about = item.ID
+			if item.Kind == KindOffer {
+				about = item.Transfer
+			}
+			break
+		}
+	}
+
+	if _, ok := getreceipts().find(about); !ok || about == "" {
+		return nil, errors.New("nothing sent is known as " + which)
+	}
+	return getreceipts().of(about), nil
+}
+
+// Check the signature again and find the peer it belongs to. Gives back the alias (or address)
+// whose pinned key signed it
+func (r Receipt) Verify() (string, error) {
+	m, origin, err := protocol.UnmarshalFrom(r.Proof)
+	if err != nil {
+		return "", err
+	}
+	signed, ok := m.(protocol.Receipt)
+	if !ok || signed.About != r.About || signed.Kind != r.Kind || origin.NodeID != r.Node {
+		return "", errors.New("the signed receipt says something else than what was kept")
+	}
+
+	for _, e := range getaddressbook().list() {
+		pinned, err := base64.StdEncoding.DecodeString(e.Keys.Sign)
+		if err != nil || !bytes.Equal(pinned, origin.Key) {
+			continue
+		}
+		if e.Alias != "" {
+			return e.Alias, nil
+		}
+		return e.Address, nil
+	}
+	return "", fmt.Errorf("the signature is good, but no key pinned in the address book belongs to node %s", r.Node)
+}
+
+// Keep a receipt that came in, content is the envelope it was in
+func keepreceipt(content []byte, msg protocol.Receipt, origin protocol.Origin) (sentitem, bool, error) {
+	return getreceipts().add(Receipt{
+		About: msg.About,
+		Kind:  msg.Kind,
+		Node:  origin.NodeID,
+		At:    time.UnixMilli(msg.At),
+		Proof: content,
+	})
+}
+
+// Someone we sent something to says it got there or was read
+func (si *ServerInstance) handlereceipt(w http.ResponseWriter, r *http.Request) {
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+
+	// Learning: Keep the bytes, the envelope as it came in is what proves the receipt later
+	content, err := io.ReadAll(io.LimitReader(r.Body, protocol.MaxMessageSize+1))
+	if err != nil {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, err.Error())
+		return
+	}
+	m, origin, err := getguard().Expect(bytes.NewReader(content), protocol.MaxMessageSize, protocol.TypeReceipt)
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+	msg := m.(protocol.Receipt)
+
+	// An offer that wasn't answered yet only knows where it went, so whoever is there gets to answer for it.
+	// Same as a reply, see handlereply
+	si.poolmu.RLock()
+	c, pending := si.connection[msg.About]
+	if pending && c.target.Addr() == remote.Addr() {
+		getreceipts().remember(sentitem{About: c.id, Kind: KindOffer, To: c.endpointCON, Node: origin.NodeID, Sent: c.created})
+	}
+	si.poolmu.RUnlock()
+
+	item, fresh, err := keepreceipt(content, msg, origin)
+	if errors.Is(err, errunknownreceipt) {
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, "nothing sent as "+msg.About)
+		return
+	} else if err != nil {
+		log.GetInstance().Debug("RECEIPT", "Receipt only kept for this session: "+err.Error())
+	}
+
+	if fresh {
+		log.GetInstance().Output("RECEIPT", fmt.Sprintf("%s %s to %s was %s", item.Kind, item.About, item.To, msg.Kind))
+	}
+}
+
+// Tell whoever sent us something that it got here or was read. When they aren't there (or we aren't running)
+// it waits in the outbox
+func sendreceipt(to string, node string, about string, kind string) {
+	err := fmt.Errorf("%w: the server isn't running", errunreachable)
+	if si := serverinstance; si != nil && CheckServerAlive() {
+		err = si.deliverreceipt(to, node, about, kind, time.Now())
+	}
+
+	if errors.Is(err, errunreachable) {
+		if _, qerr := getoutbox().queue(OutboxItem{Kind: KindReceipt, To: to, Node: node, About: about, Text: kind}, err); qerr != nil {
+			log.GetInstance().Debug("RECEIPT", "Receipt dropped: "+qerr.Error())
+		}
+	} else if err != nil {
+		log.GetInstance().Debug("RECEIPT", fmt.Sprintf("%s didn't take the receipt for %s: %v", to, about, err))
+	}
+}
+
+// Sign and post one receipt. It only goes to the node that sent the thing, whoever else has the address now
+// doesn't get to know
+func (si *ServerInstance) deliverreceipt(to string, node string, about string, kind string, at time.Time) error {
+	target, info, err := si.directpeer(to, "receipts")
+	if err != nil {
+		return err
+	}
+	if info.NodeID != node {
+		return fmt.Errorf("%w: %s is node %s now, the receipt is for %s", errunreachable, to, info.NodeID, node)
+	}
+
+	err = postmessage(target, "/receipt", protocol.Receipt{About: about, Kind: kind, At: at.UnixMilli()})
+	var remote *RemoteError
+	if err != nil && !errors.As(err, &remote) {
+		return fmt.Errorf("%w: %v", errunreachable, err)
+	}
+	return err
+}
@@ -0,0 +1,623 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	Crypt "github.com/QFServer/crypt"
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Relay mode
+// A node that sits on two networks (lab and office) can pass peers and transfers between them.
+// 1. The relay beacons [QFSERVER]RELAY, nodes that hear it ask /relay/peers who is on the other side
+// 2. Transfers to those peers are sealed to the peer's box key and posted to /relay/{nodeid}
+// 3. The relay keeps them on disk and posts them to /relay/deliver once the peer is reachable
+// The relay never has a key for what it carries, it only ever sees sealed boxes.
+// Inside the box the sender signs with its identity key, and the receiver only takes boxes from nodes whose
+// signing key it has pinned.
+// The relay's peer list only carries each peer's own signed hello. Keys come from a hello whose signer gives
+// the node id, or from the address book, never from what the relay says, so it can't hand out its own box key.
+// /relay/{nodeid} only exists once relay mode was turned on, /relay/deliver once we heard a relay
+
+const (
+	relaybeacon      = "[QFSERVER]RELAY"
+	relayinterval    = 5 * time.Second
+	relayrefresh     = 30 * time.Second   // How often we ask the same relay for its peers
+	relaymaxmessage  = 256 << 20          // Biggest sealed box a relay will hold
+	relaymaxage      = 7 * 24 * time.Hour // Undelivered boxes get dropped after this
+	relaypeersmaxlen = 1 << 20
+	relaymaxboxes    = 64      // Boxes a relay holds for one node
+	relaymaxqueue    = 1 << 30 // Bytes a relay holds for one node
+)
+
+// Learning: Two stores for the same node could both pass the limits before either wrote, so they take turns
+var relayqueuemu sync.Mutex
+
+var nodeidpattern = regexp.MustCompile("^[0-9a-f]{16}$")
+
+// A peer the relay can reach, as told to the other side. Hello is the peer's signed /info answer, byte for byte
+type relayedpeer struct {
+	NodeID string `json:"node_id"`
+	Hello  []byte `json:"hello"`
+}
+
+// What's inside the sealed box. Nonce and time let the receiver refuse a box it already got.
+// Signature is the sender's ed25519 signature over the payload with the signature left out
+type relaypayload struct {
+	From      string `json:"from"`
+	Hostname  string `json:"hostname"`
+	Name      string `json:"name"`
+	Data      []byte `json:"data"`
+	Nonce     string `json:"nonce"`
+	Time      int64  `json:"time"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// The bytes the signature covers
+func (p relaypayload) signed() ([]byte, error) {
+	p.Signature = nil
+	return json.Marshal(p)
+}
+
+// Relay mode is on for the first time, start holding boxes
+func (si *ServerInstance) routerelaystore() {
+	si.relaystore.Do(func() {
+		si.handlerInterface.HandleFunc("POST /relay/{nodeid}", si.handlerelaystore)
+	})
+}
+
+// We heard a relay for the first time, it may bring us boxes from now on
+func (si *ServerInstance) routerelaydeliver() {
+	si.relaydeliver.Do(func() {
+		si.handlerInterface.HandleFunc("POST /relay/deliver", si.handlerelaydeliver)
+	})
+}
+
+// Is this a relay we asked for its peers. Only those get to hand us boxes
+func (si *ServerInstance) knownrelay(addr netip.Addr) bool {
+	si.poolmu.RLock()
+	defer si.poolmu.RUnlock()
+	_, ok := si.relayfetched[poolkey(addr)]
+	return ok
+}
+
+// Open a hello a relay passed on for a node. The relay only carried it, the signature is the peer's own.
+// Learning: No freshness check here, the relay may have asked a while ago. An old hello is still the peer's word
+func relayedhello(raw []byte, node string) (protocol.Hello, error) {
+	m, origin, err := protocol.UnmarshalFrom(raw)
+	if err != nil {
+		return protocol.Hello{}, err
+	}
+	info, err := checkhello(m, origin)
+	if err != nil {
+		return info, err
+	}
+	if info.NodeID != node {
+		return info, fmt.Errorf("%w: hello from %s passed on as %s", protocol.ErrSignature, info.NodeID, node)
+	}
+	return info, nil
+}
+
+// The keys we trust for a pool peer. Direct peers answered /info to us, relayed ones only through their hello
+func peerkeys(peer Peer) (PinnedKeys, bool) {
+	if peer.Relay == "" {
+		return peer.Keys, true
+	}
+	info, err := relayedhello(peer.hello, peer.NodeID)
+	return PinnedKeys(info.Keys), err == nil
+}
+
+// Keys pinned in the address book for a node
+func bookkeys(node string) (PinnedKeys, bool) {
+	for _, e := range getaddressbook().list() {
+		key, err := base64.StdEncoding.DecodeString(e.Keys.Sign)
+		if err == nil && len(key) == ed25519.PublicKeySize && nodeid(key) == node {
+			return e.Keys, true
+		}
+	}
+	return PinnedKeys{}, false
+}
+
+// The signing key we pinned for a node, from the address book or a peer that proved it with a signed hello.
+// Learning: The node id is made from the signing key, so a key only counts if it gives the same id
+func (si *ServerInstance) pinnedsignkey(node string) (ed25519.PublicKey, bool) {
+	candidates := make([]string, 0)
+	if keys, ok := bookkeys(node); ok {
+		candidates = append(candidates, keys.Sign)
+	}
+	for _, peer := range si.GetPingPool() {
+		if peer.NodeID != node {
+			continue
+		}
+		if keys, ok := peerkeys(peer); ok {
+			candidates = append(candidates, keys.Sign)
+		}
+	}
+
+	for _, candidate := range candidates {
+		key, err := base64.StdEncoding.DecodeString(candidate)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			continue
+		}
+		if nodeid(key) == node {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+// Turn relay mode on or off
+func (si *ServerInstance) RelayStateChange() bool {
+	logger := log.GetInstance()
+	if !CheckServerAlive() {
+		logger.Output("ERROR", "Cannot change relay status since the server isn't alive!")
+		return false
+	}
+
+	si.poolmu.Lock()
+	si.relaying = !si.relaying
+	relaying := si.relaying
+	si.poolmu.Unlock()
+
+	if relaying {
+		si.routerelaystore()
+	}
+	return relaying
+}
+
+func (si *ServerInstance) isrelaying() bool {
+	si.poolmu.RLock()
+	defer si.poolmu.RUnlock()
+	return si.relaying
+}
+
+// Ask a new peer who it is so we know its node id and keys
+func (si *ServerInstance) learnpeer(addr netip.Addr) {
+	client := &http.Client{Timeout: scantimeout * 2}
+
+	info, hello, err := probehello(context.Background(), client, netip.AddrPortFrom(addr, serverport))
+	if err != nil || info.NodeID == getidentity().nodeid() {
+		return
+	}
+
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	peer, ok := si.pingpool[poolkey(addr)]
+	if !ok {
+		return
+	}
+	if peer.Hostname == "" {
+		peer.Hostname = info.Hostname
+	}
+	peer.NodeID = info.NodeID
+	peer.Keys = PinnedKeys(info.Keys)
+	peer.hello = hello
+	si.pingpool[poolkey(addr)] = peer
+}
+
+// Beacon that we're a relay, runs for as long as the server does
+func relayadvertise() {
+	con := createudpcon("udp4", netip.AddrPort{}, true)
+	con6 := createudpcon("udp6", netip.AddrPort{}, true)
+
+	for serverinstance != nil {
+		if serverinstance.isrelaying() {
+			beaconall(con, con6, []byte(relaybeacon))
+		}
+		time.Sleep(relayinterval)
+	}
+
+	if con != nil {
+		con.Close()
+	}
+	if con6 != nil {
+		con6.Close()
+	}
+}
+
+// We heard a relay, find out who it can reach
+func (si *ServerInstance) fetchrelayed(relay netip.Addr) {
+	logger := log.GetInstance()
+	key := poolkey(relay)
+
+	si.poolmu.Lock()
+	if time.Since(si.relayfetched[key]) < relayrefresh {
+		si.poolmu.Unlock()
+		return
+	}
+	si.relayfetched[key] = time.Now()
+	si.poolmu.Unlock()
+
+	client := &http.Client{Timeout: scantimeout * 2}
+	resp, err := client.Get(nodeurl(netip.AddrPortFrom(relay, serverport), "/relay/peers"))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return
+	}
+
+	peers := make([]relayedpeer, 0)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, relaypeersmaxlen)).Decode(&peers); err != nil {
+		logger.Debug("RELAY", "Bad peer list from "+key+": "+err.Error())
+		return
+	}
+
+	si.routerelaydeliver()
+
+	self := getidentity().nodeid()
+	interfaces := discoveryinterfaces(nil)
+
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	for _, p := range peers {
+		if !nodeidpattern.MatchString(p.NodeID) || p.NodeID == self {
+			continue
+		}
+
+		// Only what the peer signed itself, a relay that swapped in its own box key could read everything
+		info, err := relayedhello(p.Hello, p.NodeID)
+		if err != nil {
+			logger.Debug("RELAY", "Bad hello for "+p.NodeID+" from "+key+": "+err.Error())
+			continue
+		}
+		if pinned, ok := bookkeys(p.NodeID); ok && pinned.Sign != info.Keys.Sign {
+			logger.Output("WARNING", "Relay "+key+" passed on keys for "+p.NodeID+" that don't match the address book")
+			continue
+		}
+
+		// Somebody we can reach ourselves doesn't need the relay
+		direct := false
+		for _, existing := range si.pingpool {
+			if existing.NodeID == p.NodeID && existing.Relay == "" {
+				direct = true
+			}
+		}
+		if direct {
+			continue
+		}
+
+		si.pingpool[p.NodeID] = Peer{
+			Hostname:  info.Hostname,
+			Interface: interfacefor(interfaces, relay),
+			NodeID:    p.NodeID,
+			Keys:      PinnedKeys(info.Keys),
+			Relay:     key,
+			hello:     p.Hello,
+		}
+	}
+}
+
+// Where relayed boxes wait for their peer
+func relayqueuedir(nodeid string) (string, error) {
+	base, err := datadir("relay")
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(base, nodeid)
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// Deliver what we're holding to every peer that's reachable now
+func relayforwarder() {
+	logger := log.GetInstance()
+	client := &http.Client{Timeout: time.Minute * 5}
+
+	for serverinstance != nil {
+		time.Sleep(relayinterval)
+
+		if serverinstance == nil || !serverinstance.isrelaying() {
+			continue
+		}
+
+		base, err := datadir("relay")
+		if err != nil {
+			continue
+		}
+		queues, err := os.ReadDir(base)
+		if err != nil {
+			continue
+		}
+
+		pool := serverinstance.GetPingPool()
+		for _, queue := range queues {
+			target, reachable := directpeer(pool, queue.Name())
+
+			boxes, _ := os.ReadDir(filepath.Join(base, queue.Name()))
+			for _, box := range boxes {
+				path := filepath.Join(base, queue.Name(), box.Name())
+
+				if info, err := box.Info(); err == nil && time.Since(info.ModTime()) > relaymaxage {
+					logger.Debug("RELAY", "Dropping an old box for "+queue.Name())
+					os.Remove(path)
+					continue
+				}
+
+				if !reachable {
+					continue
+				}
+
+				sealed, err := os.ReadFile(path)
+				if err != nil {
+					continue
+				}
+
+				resp, err := client.Post(nodeurl(target, "/relay/deliver"), "application/octet-stream", bytes.NewReader(sealed))
+				if err != nil {
+					continue
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode == http.StatusOK {
+					logger.Debug("RELAY", "Delivered a box to "+queue.Name())
+					os.Remove(path)
+				}
+			}
+		}
+	}
+}
+
+// A pool entry for the node id that we can reach without another relay
+func directpeer(pool map[string]Peer, nodeid string) (netip.AddrPort, bool) {
+	for key, peer := range pool {
+		if peer.NodeID != nodeid || peer.Relay != "" {
+			continue
+		}
+
+		target, err := resolvepeeraddress(key)
+		if err == nil {
+			return target, true
+		}
+	}
+
+	return netip.AddrPort{}, false
+}
+
+// The box key to seal to for a peer behind a relay. Pinned in the address book, or signed by the peer itself
+func relayboxkey(peer Peer) (string, error) {
+	if keys, ok := bookkeys(peer.NodeID); ok && keys.Box != "" {
+		return keys.Box, nil
+	}
+	info, err := relayedhello(peer.hello, peer.NodeID)
+	if err != nil {
+		return "", fmt.Errorf("no signed box key for %s: %w", peer.NodeID, err)
+	}
+	return info.Keys.Box, nil
+}
+
+// Seal a file to a peer behind a relay and hand it over
+func (si *ServerInstance) sendrelayed(peer Peer, name string, data []byte) error {
+	box64, err := relayboxkey(peer)
+	if err != nil {
+		return err
+	}
+	boxkey, err := base64.StdEncoding.DecodeString(box64)
+	if err != nil {
+		return errors.New("no box key for " + peer.NodeID)
+	}
+	recipient, err := ecdh.X25519().NewPublicKey(boxkey)
+	if err != nil {
+		return err
+	}
+
+	box := relaypayload{
+		From:     getidentity().nodeid(),
+		Hostname: si.clienthostname,
+		Name:     name,
+		Data:     data,
+		Nonce:    newid() + newid(),
+		Time:     time.Now().UnixMilli(),
+	}
+	signed, err := box.signed()
+	if err != nil {
+		return err
+	}
+	box.Signature = ed25519.Sign(getidentity().sign, signed)
+
+	payload, err := json.Marshal(box)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := Crypt.Seal(recipient, payload)
+	if err != nil {
+		return err
+	}
+
+	relay, err := resolvepeeraddress(peer.Relay)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.Post(nodeurl(relay, "/relay/"+peer.NodeID), "application/octet-stream", bytes.NewReader(sealed))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return readproblem(resp, http.StatusAccepted)
+}
+
+// RELAY: Who can we reach for the side asking
+func (si *ServerInstance) handlerelaypeers(w http.ResponseWriter, r *http.Request) {
+	if !si.isrelaying() {
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnavailable, "this node isn't a relay")
+		return
+	}
+
+	address, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+	asking := interfacefor(discoveryinterfaces(nil), address.Addr())
+
+	peers := make([]relayedpeer, 0)
+	for _, peer := range si.GetPingPool() {
+		// Only the other side, never peers we reach through another relay, and only with a hello to pass on
+		if peer.NodeID == "" || peer.Relay != "" || peer.Interface == asking || peer.hello == nil {
+			continue
+		}
+		peers = append(peers, relayedpeer{NodeID: peer.NodeID, Hello: peer.hello})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(peers)
+}
+
+// RELAY: Hold a sealed box for a node
+func (si *ServerInstance) handlerelaystore(w http.ResponseWriter, r *http.Request) {
+	logger := log.GetInstance()
+
+	if !si.isrelaying() {
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnavailable, "this node isn't a relay")
+		return
+	}
+
+	nodeid := r.PathValue("nodeid")
+	if !nodeidpattern.MatchString(nodeid) {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, "bad node id")
+		return
+	}
+
+	sealed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, relaymaxmessage))
+	if err != nil {
+		writeproblem(w, http.StatusRequestEntityTooLarge, protocol.CodeTooLarge, "box too big")
+		return
+	}
+
+	dir, err := relayqueuedir(nodeid)
+	if err != nil {
+		writeproblem(w, http.StatusInternalServerError, protocol.CodeStorage, "no space for the box")
+		return
+	}
+
+	relayqueuemu.Lock()
+	defer relayqueuemu.Unlock()
+
+	// Nobody gets to fill our disk, whatever they claim to be sending
+	boxes, held := relayqueuesize(dir)
+	if boxes >= relaymaxboxes || held+int64(len(sealed)) > relaymaxqueue {
+		writeproblem(w, http.StatusTooManyRequests, protocol.CodeBusy, fmt.Sprintf("already holding %d boxes (%s) for %s", boxes, humansize(held), nodeid))
+		return
+	}
+
+	name := make([]byte, 8)
+	rand.Read(name)
+	if err := os.WriteFile(filepath.Join(dir, hex.EncodeToString(name)), sealed, 0600); err != nil {
+		writeproblem(w, http.StatusInternalServerError, protocol.CodeStorage, "no space for the box")
+		return
+	}
+
+	logger.Debug("RELAY", fmt.Sprintf("Holding %d bytes for %s", len(sealed), nodeid))
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// How many boxes and bytes a node's queue holds
+func relayqueuesize(dir string) (int, int64) {
+	entries, _ := os.ReadDir(dir)
+	var held int64
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			held += info.Size()
+		}
+	}
+	return len(entries), held
+}
+
+// Final hop, a relay is handing us a box that was sealed to us
+func (si *ServerInstance) handlerelaydeliver(w http.ResponseWriter, r *http.Request) {
+	logger := log.GetInstance()
+
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+	if !si.knownrelay(remote.Addr()) {
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnavailable, "we don't use a relay at "+remote.Addr().String())
+		return
+	}
+
+	sealed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, relaymaxmessage))
+	if err != nil {
+		writeproblem(w, http.StatusRequestEntityTooLarge, protocol.CodeTooLarge, "box too big")
+		return
+	}
+
+	plaintext, err := Crypt.Open(getidentity().box, sealed)
+	if err != nil {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeEncryption, err.Error())
+		return
+	}
+
+	payload := relaypayload{}
+	if err := json.Unmarshal(plaintext, &payload); err != nil {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, "bad payload")
+		return
+	}
+
+	// Learning: From ends up in a file name, and anyone can seal a box to us since the box key is public.
+	// So it has to look like a node id, and that node has to have signed the box with the key we pinned
+	if !nodeidpattern.MatchString(payload.From) {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, "bad sender")
+		return
+	}
+	signkey, ok := si.pinnedsignkey(payload.From)
+	if !ok {
+		writeproblem(w, http.StatusForbidden, protocol.CodeBadSignature, "no pinned key for "+payload.From)
+		return
+	}
+	signed, err := payload.signed()
+	if err != nil || !ed25519.Verify(signkey, signed, payload.Signature) {
+		writeproblem(w, http.StatusUnauthorized, protocol.CodeBadSignature, "box not signed by "+payload.From)
+		return
+	}
+	if err := getrelayguard().Check(payload.From+"/"+payload.Nonce, time.UnixMilli(payload.Time)); err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+
+	dir, err := datadir("received")
+	if err != nil {
+		writeproblem(w, http.StatusInternalServerError, protocol.CodeStorage, "nowhere to put it")
+		return
+	}
+
+	// Learning: Never trust a name from the network, filepath.Base stops ../../ tricks
+	name := filepath.Base(filepath.Clean("/" + payload.Name))
+	if name == "/" || name == "." {
+		name = "relayed"
+	}
+	path := freename(dir, payload.From+"-"+name)
+
+	if err := os.WriteFile(path, payload.Data, 0600); err != nil {
+		writeproblem(w, http.StatusInternalServerError, protocol.CodeStorage, "nowhere to put it")
+		return
+	}
+
+	logger.Output("RELAY", fmt.Sprintf("Received %s from %s (%s) through a relay", path, payload.Hostname, payload.From))
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// A hello signed by whatever key is signing right now
+func signedhello(t *testing.T, info protocol.Hello) []byte {
+	t.Helper()
+	content, err := protocol.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func TestRelayedKeys(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	log.GetInstance().BeginDebugLogger()
+
+	si := &ServerInstance{clienthostname: "behind"}
+	node := getidentity().nodeid()
+	keys := getidentity().publickeys()
+	genuine := signedhello(t, si.hello())
+
+	// The relay's own keys, what it would like us to seal to
+	relaysign, relaypriv, _ := ed25519.GenerateKey(rand.Reader)
+	relaybox, _ := ecdh.X25519().GenerateKey(rand.Reader)
+	relayboxkey64 := base64.StdEncoding.EncodeToString(relaybox.PublicKey().Bytes())
+
+	protocol.SetSigner(relaypriv)
+	// Our hello with the box key swapped, the relay can only sign it with its own key
+	swapped := si.hello()
+	swapped.Keys.Box = relayboxkey64
+	resigned := signedhello(t, swapped)
+	// The relay's honest hello, passed on under our node id
+	own := si.hello()
+	own.NodeID = protocol.NodeID(relaysign)
+	own.Keys = protocol.Keys{Sign: base64.StdEncoding.EncodeToString(relaysign), Box: relayboxkey64}
+	renamed := signedhello(t, own)
+	protocol.SetSigner(getidentity().sign)
+
+	info, err := relayedhello(genuine, node)
+	if err != nil {
+		t.Fatalf("genuine hello refused: %v", err)
+	}
+	if PinnedKeys(info.Keys) != keys {
+		t.Fatal("genuine hello gave other keys")
+	}
+	box, err := relayboxkey(Peer{NodeID: node, Relay: "10.0.0.1", hello: genuine})
+	if err != nil || box != keys.Box {
+		t.Fatalf("sealing to %q, %v", box, err)
+	}
+
+	tests := []struct {
+		name string
+		peer Peer
+	}{
+		{"box key swapped", Peer{NodeID: node, Relay: "10.0.0.1", hello: resigned}},
+		{"someone else's hello", Peer{NodeID: node, Relay: "10.0.0.1", hello: renamed}},
+		{"garbage", Peer{NodeID: node, Relay: "10.0.0.1", hello: []byte("{}")}},
+		{"only the relay's word", Peer{NodeID: node, Relay: "10.0.0.1", Keys: PinnedKeys{Sign: keys.Sign, Box: relayboxkey64}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if box, err := relayboxkey(tt.peer); err == nil {
+				t.Fatalf("would seal to %q", box)
+			}
+			if _, ok := peerkeys(tt.peer); ok {
+				t.Fatal("keys trusted")
+			}
+		})
+	}
+
+	if _, err := relayedhello(resigned, node); !errors.Is(err, protocol.ErrSignature) {
+		t.Fatalf("swapped box key got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Retract
+// Sent the wrong file? As long as the receiver hasn't answered, the sender can take an offer back.
+// A signed Retract goes to /retract, the receiver drops the request from its pool and the inbox and
+// rewrites the inbox file so the sealed copy is gone from the disk too. Both sides throw the keys away.
+// Once it's accepted it's a transfer, that's what transfer cancel is for
+
+// Take back an offer. which is an outbox item (number or id) or the transfer id of an offer that went
+// straight out. An offer still waiting in the outbox never left, it's only marked retracted.
+// Gives back the transfer id (empty when nothing had gone out yet) and whether the receiver heard it
+func OutboxRetract(which string) (string, bool, error) {
+	ob := getoutbox()
+	ob.mu.Lock()
+	transfer := which
+	if index := ob.find(which); index >= 0 {
+		item := &ob.Items[index]
+		switch {
+		case item.Kind != KindOffer:
+			ob.mu.Unlock()
+			return "", false, fmt.Errorf("%s is a %s, only offers can be retracted", item.ID, item.Kind)
+		case item.State == OutboxWaiting:
+			item.State, item.Updated = OutboxRetracted, time.Now()
+			item.wipe()
+			err := ob.save()
+			ob.mu.Unlock()
+			return "", false, err
+		case item.State == OutboxSending:
+			ob.mu.Unlock()
+			return "", false, fmt.Errorf("%s is going out right now, try again in a moment", item.ID)
+		case item.State != OutboxSent:
+			ob.mu.Unlock()
+			return "", false, fmt.Errorf("%s is already %s", item.ID, item.State)
+		}
+		transfer = item.Transfer
+	}
+	ob.mu.Unlock()
+
+	si := serverinstance
+	if si == nil || !CheckServerAlive() {
+		return "", false, errors.New("the server isn't alive")
+	}
+
+	err := si.retract(transfer)
+	if err != nil && !errors.Is(err, errunreachable) {
+		return transfer, false, err
+	}
+	ob.retracted(transfer)
+	return transfer, err == nil, nil
+}
+
+// Forget what an item was about to send. Must hold the lock
+// Learning: Go strings can't be wiped, but the sealed copy on disk goes with the next save
+func (item *OutboxItem) wipe() {
+	item.Text, item.Paths, item.Sealed = "", nil, nil
+}
+
+// Mark the outbox item of a retracted transfer, if it came from the outbox
+func (ob *outbox) retracted(transfer string) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	for i := range ob.Items {
+		item := &ob.Items[i]
+		if item.Kind == KindOffer && item.Transfer == transfer {
+			item.State, item.Updated = OutboxRetracted, time.Now()
+			item.wipe()
+		}
+	}
+	if err := ob.save(); err != nil {
+		log.GetInstance().Debug("OUTBOX", "Could not write the outbox: "+err.Error())
+	}
+}
+
+// Tell the receiver first. If it says no it has most likely accepted, and then nothing changes here either.
+// If it isn't there the offer is retracted on our side anyway, theirs expires on its own
+func (si *ServerInstance) retract(id string) error {
+	si.poolmu.Lock()
+	c, ok := si.connection[id]
+	if !ok {
+		si.poolmu.Unlock()
+		return errors.New("no offer " + id)
+	}
+	if c.state != statepending {
+		si.poolmu.Unlock()
+		return fmt.Errorf("%s is %s, only an offer nobody answered yet can be retracted", id, c.state)
+	}
+	target := c.target
+	si.poolmu.Unlock()
+
+	err := postmessage(target, "/retract", protocol.Retract{ID: id, Reason: "retracted by " + si.clienthostname})
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		return err
+	}
+
+	si.poolmu.Lock()
+	terr := c.transition(stateretracted)
+	if terr == nil {
+		c.reason = "retracted"
+		delete(si.conKeyPriv, c)
+		c.sessionkey = nil
+	}
+	si.poolmu.Unlock()
+
+	if terr != nil {
+		return terr
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", errunreachable, err)
+	}
+	return nil
+}
+
+// The sender took back an offer it made us
+func (si *ServerInstance) handleretract(w http.ResponseWriter, r *http.Request) {
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+	address := poolkey(remote.Addr())
+
+	m, origin, err := getguard().Expect(r.Body, protocol.MaxMessageSize, protocol.TypeRetract)
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+	msg := m.(protocol.Retract)
+
+	// Only the node that made the offer, from where it made it. Anyone else gets the same answer as a wrong id
+	si.poolmu.Lock()
+	c, ok := si.reqpool[msg.ID]
+	if !ok || c.sourceCON != address || c.peerid != origin.NodeID {
+		si.poolmu.Unlock()
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, "no request "+msg.ID)
+		return
+	}
+	if err := c.transition(stateretracted); err != nil {
+		si.poolmu.Unlock()
+		writeproblem(w, http.StatusConflict, protocol.CodeWrongState, "request "+msg.ID+" is "+c.state.String()+" already")
+		return
+	}
+	if c.receiving != nil {
+		c.receiving.abort()
+	}
+	c.sessionkey = nil
+	delete(si.reqpool, msg.ID)
+	si.poolmu.Unlock()
+
+	if err := getinbox().retract(origin.NodeID, msg.ID); err != nil {
+		log.GetInstance().Debug("INBOX", "Could not drop the retracted offer: "+err.Error())
+	}
+
+	message := fmt.Sprintf("Request %s from %s was taken back", msg.ID, address)
+	if msg.Reason != "" {
+		message += ": " + msg.Reason
+	}
+	log.GetInstance().Output("REQ", message)
+}
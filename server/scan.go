@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Active scanning. Broadcasts don't cross routers and some networks drop them, so we can also walk a
+// subnet and ask every host for /info
+
+const (
+	scanrate     = 200                    // Probes started per second
+	scanworkers  = 64                     // Probes in flight at once
+	scantimeout  = 750 * time.Millisecond // How long a host gets to answer
+	maxscanhosts = 1 << 16                // Biggest subnet we'll walk (a /16)
+)
+
+// The scan that's running right now, there's only ever one
+type scanjob struct {
+	cancel context.CancelFunc
+	total  int
+	done   atomic.Int64
+	found  atomic.Int64
+}
+
+var (
+	currentscan *scanjob
+	scanmu      sync.Mutex
+)
+
+// Every host address in a prefix. The network and broadcast address are skipped for IPv4
+func scanhosts(prefix netip.Prefix) ([]netip.Addr, error) {
+	prefix = prefix.Masked()
+
+	hostbits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostbits > 16 {
+		return nil, fmt.Errorf("%s is too big to scan, use a /16 or smaller", prefix)
+	}
+
+	hosts := make([]netip.Addr, 0, 1<<hostbits)
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		hosts = append(hosts, addr)
+		if !addr.Next().IsValid() {
+			break
+		}
+	}
+
+	if prefix.Addr().Is4() && hostbits >= 2 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+
+	return hosts, nil
+}
+
+// Ask one host who it is
+func probeinfo(ctx context.Context, client *http.Client, target netip.AddrPort) (protocol.Hello, error) {
+	info, _, err := probehello(ctx, client, target)
+	return info, err
+}
+
+// Same as probeinfo, but also hands back the signed hello as it came, so a relay can pass it on untouched
+func probehello(ctx context.Context, client *http.Client, target netip.AddrPort) (protocol.Hello, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeurl(target, "/info"), nil)
+	if err != nil {
+		return protocol.Hello{}, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return protocol.Hello{}, nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := readproblem(resp); err != nil {
+		return protocol.Hello{}, nil, err
+	}
+
+	// Learning: The tee keeps every byte the decoder read, which is the whole signed envelope
+	raw := &bytes.Buffer{}
+	m, origin, err := protocol.DecodeFrom(io.TeeReader(resp.Body, raw), protocol.MaxMessageSize)
+	if err != nil {
+		return protocol.Hello{}, nil, err
+	}
+	if err := getguard().Fresh(origin.Time); err != nil {
+		return protocol.Hello{}, nil, err
+	}
+
+	info, err := checkhello(m, origin)
+	if err != nil {
+		return info, nil, fmt.Errorf("%s: %w", target, err)
+	}
+	return info, raw.Bytes(), nil
+}
+
+// A hello only counts when it's signed by the node and the key it tells us about
+func checkhello(m protocol.Message, origin protocol.Origin) (protocol.Hello, error) {
+	info, ok := m.(protocol.Hello)
+	if !ok {
+		return info, fmt.Errorf("answered with a %s", m.Type())
+	}
+
+	if origin.NodeID != info.NodeID || base64.StdEncoding.EncodeToString(origin.Key) != info.Keys.Sign {
+		return info, fmt.Errorf("%w: hello from %s signed by %s", protocol.ErrSignature, info.NodeID, origin.NodeID)
+	}
+
+	if info.Service != servicename {
+		return info, errors.New("not a QFServer node")
+	}
+
+	return info, nil
+}
+
+// Probe every host at a bounded rate and report each node we find
+// Kept away from the server instance so it can be pointed at loopback listeners on any port
+func scanprefix(ctx context.Context, hosts []netip.Addr, port uint16, job *scanjob, found func(netip.AddrPort, protocol.Hello, []byte)) {
+	client := &http.Client{Timeout: scantimeout}
+
+	// Learning: A ticker paces how fast probes start, the buffered channel caps how many run at once
+	ticker := time.NewTicker(time.Second / scanrate)
+	defer ticker.Stop()
+	inflight := make(chan struct{}, scanworkers)
+
+	wg := sync.WaitGroup{}
+	for _, host := range hosts {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func(target netip.AddrPort) {
+			defer wg.Done()
+			defer func() { <-inflight }()
+
+			info, hello, err := probehello(ctx, client, target)
+			if err == nil {
+				job.found.Add(1)
+				found(target, info, hello)
+			}
+			job.done.Add(1)
+		}(netip.AddrPortFrom(host, port))
+	}
+
+	wg.Wait()
+}
+
+// The subnets on our own interfaces that are small enough to walk
+func localprefixes(config *serverconfig) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0)
+	for _, di := range discoveryinterfaces(config) {
+		for _, prefix := range di.prefixes {
+			if prefix.Addr().Is4() && 32-prefix.Bits() <= 16 {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
+// Scan a subnet (or all of ours when cidr is empty) and put every node we find in the pool
+// Blocks until the scan is done or cancelled, progress gets called about once a second
+func (si *ServerInstance) Scan(cidr string, progress func(done int, total int, found int)) error {
+	logger := log.GetInstance()
+
+	prefixes := make([]netip.Prefix, 0)
+	if cidr == "" {
+		prefixes = localprefixes(si.config)
+	} else {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			// A single address is a /32 or /128
+			addr, errAddr := netip.ParseAddr(cidr)
+			if errAddr != nil {
+				return fmt.Errorf("%s is not a subnet: %v", cidr, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	hosts := make([]netip.Addr, 0)
+	for _, prefix := range prefixes {
+		found, err := scanhosts(prefix)
+		if err != nil {
+			return err
+		}
+		hosts = append(hosts, found...)
+	}
+	if len(hosts) == 0 {
+		return errors.New("nothing to scan")
+	}
+	if len(hosts) > maxscanhosts {
+		return fmt.Errorf("%d hosts is too many to scan", len(hosts))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	job := &scanjob{cancel: cancel, total: len(hosts)}
+
+	scanmu.Lock()
+	if currentscan != nil {
+		scanmu.Unlock()
+		return errors.New("a scan is already running")
+	}
+	currentscan = job
+	scanmu.Unlock()
+
+	defer func() {
+		scanmu.Lock()
+		currentscan = nil
+		scanmu.Unlock()
+	}()
+
+	// Progress display
+	stopprogress := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				progress(int(job.done.Load()), job.total, int(job.found.Load()))
+			case <-stopprogress:
+				return
+			}
+		}
+	}()
+
+	self := getidentity().nodeid()
+	scanprefix(ctx, hosts, serverport, job, func(target netip.AddrPort, info protocol.Hello, hello []byte) {
+		if info.NodeID == self {
+			return
+		}
+		logger.Debug("SCAN", fmt.Sprintf("Found %s (%s) at %s", info.Hostname, info.NodeID, target))
+		si.addscanned(target, info, hello)
+	})
+
+	close(stopprogress)
+	progress(int(job.done.Load()), job.total, int(job.found.Load()))
+
+	if ctx.Err() != nil {
+		return errors.New("scan cancelled")
+	}
+	return nil
+}
+
+// Stop the running scan, false when there wasn't one
+func CancelScan() bool {
+	scanmu.Lock()
+	defer scanmu.Unlock()
+
+	if currentscan == nil {
+		return false
+	}
+
+	currentscan.cancel()
+	return true
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QFServer/protocol"
+)
+
+// Nodes answering /info on 127.0.0.2 to .4, all on the same port like real ones on serverport
+func startinfo(t *testing.T) uint16 {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+
+	si := &ServerInstance{clienthostname: "scanned"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /info", si.handleinfo)
+
+	port := ""
+	for i := 2; i <= 4; i++ {
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0."+strconv.Itoa(i), port))
+		if err != nil {
+			t.Skipf("no loopback listener: %v", err)
+		}
+		if port == "" {
+			_, port, _ = net.SplitHostPort(listener.Addr().String())
+		}
+
+		server := httptest.NewUnstartedServer(mux)
+		server.Listener.Close()
+		server.Listener = listener
+		server.Start()
+		t.Cleanup(server.Close)
+	}
+
+	number, _ := strconv.Atoi(port)
+	return uint16(number)
+}
+
+func TestScanFindsNodes(t *testing.T) {
+	port := startinfo(t)
+
+	hosts, err := scanhosts(netip.MustParsePrefix("127.0.0.0/29"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &scanjob{total: len(hosts)}
+
+	mu := sync.Mutex{}
+	found := make(map[netip.AddrPort]protocol.Hello)
+	scanprefix(context.Background(), hosts, port, job, func(target netip.AddrPort, info protocol.Hello, _ []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		found[target] = info
+	})
+
+	if len(found) != 3 || job.found.Load() != 3 {
+		t.Fatalf("found %d (%d counted), want 3: %v", len(found), job.found.Load(), found)
+	}
+	for i := 2; i <= 4; i++ {
+		target := netip.AddrPortFrom(netip.MustParseAddr("127.0.0."+strconv.Itoa(i)), port)
+		info, ok := found[target]
+		if !ok {
+			t.Fatalf("missed %s", target)
+		}
+		if info.NodeID != getidentity().nodeid() || info.Hostname != "scanned" {
+			t.Fatalf("%s said %+v", target, info)
+		}
+	}
+	if job.done.Load() != int64(len(hosts)) {
+		t.Fatalf("%d of %d probed", job.done.Load(), len(hosts))
+	}
+}
+
+func TestScanCancel(t *testing.T) {
+	port := startinfo(t)
+
+	// At scanrate this takes seconds to walk
+	hosts, err := scanhosts(netip.MustParsePrefix("127.0.0.0/22"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &scanjob{total: len(hosts)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	start := time.Now()
+	scanprefix(ctx, hosts, port, job, func(netip.AddrPort, protocol.Hello, []byte) {})
+
+	if took := time.Since(start); took > 200*time.Millisecond+2*scantimeout {
+		t.Fatalf("scan took %s after being cancelled", took)
+	}
+	if done := job.done.Load(); done >= int64(len(hosts)) {
+		t.Fatalf("all %d hosts probed, the scan didn't stop", done)
+	}
+}
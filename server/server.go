@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/QFServer/log"
@@ -16,25 +18,42 @@ import (
 // The server struct
 type ServerInstance struct {
 	// TLS section
-	pingpool map[string]string
-	reqpool  map[string]conn
+	pingpool map[string]Peer
+	reqpool  map[string]*conn // Requests made to us, by transfer id
 	pingopen bool
 	reqopen  bool
 	srv      *http.Server
 
 	handlerInterface *http.ServeMux
 
+	// Guards the pools, handlers and udp readers all run on their own goroutines
+	poolmu sync.RWMutex
+
 	// This is the UDP section
 	broadcasting bool
-	buffer       []byte
+
+	// Relay mode, and when we last asked each relay for its peers
+	relaying     bool
+	relayfetched map[string]time.Time
+	relaystore   sync.Once // The relay routes only exist once they're needed, see relay.go
+	relaydeliver sync.Once
 
 	// Hostname + Address
 	clienthostname string
 
-	// A connection that the user may have to a node
+	// Loaded from the config dir when the server opens
+	config *serverconfig
+
+	// Requests we made to other nodes, by transfer id
 	connection map[string]*conn
 	conKeyPriv map[*conn]*rsa.PrivateKey
 
+	// Token buckets every transfer goes through
+	limits *limiter
+
+	// What each peer's link did last time, picks the number of streams
+	tuner *streamtuner
+
 	// Alive Channel
 	maintainsignal chan bool
 }
@@ -63,30 +82,38 @@ func ServerRun(alive chan bool) {
 
 	logger := log.GetInstance()
 
+	// Load who we are before anything gets signed with it
+	getidentity()
+
 	// LEARNING: THIS INITIALIZES AND SETS, WE DONT NEED A LOCAL VARIABLE WE JUST NEED TO UPDATE THE GLOBAL VARIABLE
 	tempHandle := http.NewServeMux()
 	serverinstance = &ServerInstance{
-		pingpool: make(map[string]string),
-		reqpool:  make(map[string]conn),
+		pingpool: make(map[string]Peer),
+		reqpool:  make(map[string]*conn),
 		pingopen: false,
 		reqopen:  false,
 		// Learning: I need to assign the handler here, otherwise we will get a panic when http tries to handle the requests
 		handlerInterface: tempHandle,
 		srv: &http.Server{
-			Addr: ":8080", // Set the address and port
+			// Learning: "[::]" with plain tcp is a dual-stack socket, IPv4 clients show up as ::ffff:a.b.c.d
+			Addr: netip.AddrPortFrom(netip.IPv6Unspecified(), serverport).String(), // Set the address and port
 			// ANOTHER LEARNING: Handler is just the interface, but ServeMux actually implements it. That's why you should assign newservemux seperately and then get
 			// handlers on it.
 			Handler: tempHandle, // Use a new ServeMux LEARNING, this is important to the shutdowns and everything
 		},
 		broadcasting:   false,
-		buffer:         make([]byte, 1024),
 		maintainsignal: alive,
 		connection:     make(map[string]*conn),
 		conKeyPriv:     make(map[*conn]*rsa.PrivateKey),
+		config:         loadconfig(),
+		relayfetched:   make(map[string]time.Time),
 	}
+	serverinstance.relaying = serverinstance.config.Relay
+	serverinstance.limits = newlimiter(serverinstance.config.LimitGlobal, serverinstance.config.LimitPeer)
+	serverinstance.tuner = newstreamtuner()
 
 	hostget, errhost := os.Hostname()
-	if errhost != nil {
+	if errhost == nil {
 		serverinstance.clienthostname = hostget
 	} else {
 		logger.Debug("DEBUG", "Error in getting hostname!")
@@ -99,7 +126,21 @@ func ServerRun(alive chan bool) {
 	// The rest of the program from running. Well technically it's just blocking the goroutine but still the same issue.
 	serverinstance.handlerInterface.HandleFunc("/", serverinstance.handleping)
 	serverinstance.handlerInterface.HandleFunc("/req", serverinstance.handlereq)
-	serverinstance.handlerInterface.HandleFunc("/conn", serverinstance.handleconn) // THis should be a mutext protected handler
+	serverinstance.handlerInterface.HandleFunc("POST /reply", serverinstance.handlereply)
+	serverinstance.handlerInterface.HandleFunc("POST /transfer/{id}/{stream}", serverinstance.handletransfer)
+	serverinstance.handlerInterface.HandleFunc("POST /control", serverinstance.handlecontrol)
+	serverinstance.handlerInterface.HandleFunc("GET /conn/{id}", serverinstance.handleconn) // THis should be a mutext protected handler
+	serverinstance.handlerInterface.HandleFunc("GET /info", serverinstance.handleinfo)
+	serverinstance.handlerInterface.HandleFunc("POST /note", serverinstance.handlenote)
+	serverinstance.handlerInterface.HandleFunc("POST /chat", serverinstance.handlechat)
+	serverinstance.handlerInterface.HandleFunc("POST /receipt", serverinstance.handlereceipt)
+	serverinstance.handlerInterface.HandleFunc("POST /retract", serverinstance.handleretract)
+	serverinstance.handlerInterface.HandleFunc("GET /wormhole/{nameplate}", serverinstance.handlewormholeprobe)
+	serverinstance.handlerInterface.HandleFunc("POST /wormhole", serverinstance.handlewormhole)
+	serverinstance.handlerInterface.HandleFunc("GET /relay/peers", serverinstance.handlerelaypeers)
+	if serverinstance.relaying {
+		serverinstance.routerelaystore()
+	}
 
 	logger.Debug("DEBUG", "Setup the handlers!")
 
@@ -126,29 +167,42 @@ func ServerRun(alive chan bool) {
 	go createudplistener()    // Create a udp listener
 	go servershutdownflag()   // Do shutdown work when closing
 	go broadcasttonodes()     // Listener to broadcast to nodes
+	go relayadvertise()       // Beacon as a relay when relay mode is on
+	go relayforwarder()       // Pass on what we hold as a relay
+	go connectionreaper()     // Expire requests nobody answered
+	go outboxsender()         // Try again what couldn't go out
 
 	logger.Debug("DEBUG", "Server has started!")
 }
 
-func createudpcon(port int, ip string, listen bool) *net.UDPConn {
-	addr := net.UDPAddr{
-		Port: port,
-		IP:   net.ParseIP(ip),
-	}
+func createudpcon(network string, addr netip.AddrPort, listen bool) *net.UDPConn {
+	udpAddr := net.UDPAddrFromAddrPort(addr)
 
 	var conCreate *net.UDPConn = nil
 	var err error = nil
 
 	if !listen {
-		conCreate, err = net.DialUDP("udp", nil, &addr)
+		conCreate, err = net.DialUDP(network, nil, udpAddr)
 	} else {
-		conCreate, err = net.ListenUDP("udp", &addr)
+		conCreate, err = net.ListenUDP(network, udpAddr)
 	}
 
 	if err != nil {
 		fmt.Printf("%v", err)
-	} else {
-		serverinstance.buffer = make([]byte, 1024)
+	}
+
+	return conCreate
+}
+
+// Join the IPv6 all-nodes group on one interface
+// Learning: ListenMulticastUDP sets SO_REUSEADDR so one socket per interface can all sit on [ff02::1]:8080
+func createmulticastcon(ifi *net.Interface) *net.UDPConn {
+	group := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ipv6allnodes, serverport))
+
+	conCreate, err := net.ListenMulticastUDP("udp6", ifi, group)
+	if err != nil {
+		fmt.Printf("%v", err)
+		return nil
 	}
 
 	return conCreate
@@ -157,33 +211,73 @@ func createudpcon(port int, ip string, listen bool) *net.UDPConn {
 func createudplistener() {
 
 	logger := log.GetInstance()
-	con := createudpcon(8080, "0.0.0.0", true)
+
+	// IPv6 discovery goes through the all-nodes group on every interface
+	for _, di := range discoveryinterfaces(serverinstance.config) {
+		if !di.multicast {
+			continue
+		}
+
+		con6 := createmulticastcon(&di.ifi)
+		if con6 == nil {
+			logger.Debug("SERVER | ERROR", "Could not join the IPv6 group on "+di.ifi.Name)
+			continue
+		}
+		go readbeacons(con6)
+	}
+
+	con := createudpcon("udp4", netip.AddrPortFrom(netip.IPv4Unspecified(), serverport), true)
 	if con == nil { // TODO: Add handler for this
 		logger.Debug("SERVER | ERROR", "Connection could not be created!")
 		return
 	}
+
+	readbeacons(con)
+}
+
+// Read beacons off of a udp connection and store who sent them
+// Learning: Every reader gets its own buffer, sharing one between goroutines is a data race
+func readbeacons(con *net.UDPConn) {
 	defer con.Close()
 
+	buffer := make([]byte, 1024)
 	for serverinstance != nil {
-		n, addr, err := con.ReadFromUDP(serverinstance.buffer)
+		n, addr, err := con.ReadFromUDPAddrPort(buffer)
 		if err != nil {
 			fmt.Println("ERROR: Could not read from UDP: " + err.Error())
 		} else {
+			sender := unmapped(addr).Addr()
+
+			// Only take beacons from the interfaces we were told to use
+			iface := interfacefor(discoveryinterfaces(nil), sender)
+			if iface != "" && !serverinstance.config.interfaceallowed(iface) {
+				continue
+			}
+
+			// Anything waiting for them can go now
+			getoutbox().seen(sender)
+
+			// A relay is telling us it can reach another network
+			if strings.HasPrefix(string(buffer[:n]), relaybeacon) {
+				go serverinstance.fetchrelayed(sender)
+			}
+
 			// Check duplicates
-			_, exists := serverinstance.pingpool[strings.Split(addr.String(), ":")[0]]
-			senderhostname, errhostname := net.LookupHost(addr.IP.String())
-			if !exists {
+			if !serverinstance.inpingpool(sender) {
+				senderhostname, errhostname := net.LookupAddr(sender.WithZone("").String())
 
-				if errhostname != nil {
+				if errhostname == nil {
 					// Store [address] = hostname
-					serverinstance.pingpool[strings.Split(addr.String(), ":")[0]] = strings.Join(senderhostname, " ")
+					serverinstance.addtopingpool(sender, strings.Join(senderhostname, " "))
 				} else {
 					fmt.Printf("Could not resolve hostname!\n")
-					serverinstance.pingpool[strings.Split(addr.String(), ":")[0]] = ""
+					serverinstance.addtopingpool(sender, "")
 				}
+
+				go serverinstance.learnpeer(sender)
 			}
 
-			fmt.Printf("Received response from %s: %s\n", addr.String(), string(serverinstance.buffer[:n]))
+			log.GetInstance().Debug("DISCOVERY", fmt.Sprintf("Received response from %s: %s", unmapped(addr).String(), string(buffer[:n])))
 		}
 	}
 }
@@ -193,6 +287,9 @@ func servershutdownflag() {
 	waitState := <-serverinstance.maintainsignal
 	if !waitState {
 
+		// Chats keep their handlers running, Shutdown would wait on them forever
+		getchats().endall("the server closed")
+
 		// Shutdown the server
 		if err := serverinstance.srv.Shutdown(context.Background()); err != nil { //CTX in this case is not a copy
 			logger.Debug("DEBUG", fmt.Sprintf("Server Shutdown Failed:%+v", err))
@@ -200,6 +297,9 @@ func servershutdownflag() {
 
 		logger.Debug("DEBUG", "Server has been stopped")
 
+		// Whatever finished since the reaper last ran still goes in the history
+		serverinstance.recordhistory()
+
 		serverinstance = nil
 		//delete(http.DefaultServeMux.Handle(), "/") Interesting implementation in this method though
 	}
@@ -216,20 +316,20 @@ func createserverinstance() {
 
 func broadcasttonodes() {
 	logger := log.GetInstance()
-	con := createudpcon(8080, "255.255.255.255", false)
+
+	// Unbound sockets, the destination of every write picks the interface
+	// Learning: Go sets SO_BROADCAST on udp sockets by default so directed broadcasts just work
+	con := createudpcon("udp4", netip.AddrPort{}, true)
+	con6 := createudpcon("udp6", netip.AddrPort{}, true)
 
 	for serverinstance != nil {
 		for serverinstance.broadcasting {
-			if con == nil {
+			if con == nil && con6 == nil {
 				logger.Debug("SERVER | ERROR", "Connection could not be created!")
 			}
 
 			message := []byte("[QFSERVER]ALIVEPING")
-			_, err := con.Write(message)
-
-			if err != nil {
-				fmt.Printf("Error: %v", err)
-			}
+			beaconall(con, con6, message)
 
 			time.Sleep(time.Second * 2)
 			fmt.Println("BROADCAST: Sending a broadcast")
@@ -238,5 +338,33 @@ func broadcasttonodes() {
 		time.Sleep(time.Second * 2)
 	}
 
-	con.Close()
+	if con != nil {
+		con.Close()
+	}
+	if con6 != nil {
+		con6.Close()
+	}
+}
+
+// Send a beacon out of every interface we're allowed to use
+func beaconall(con *net.UDPConn, con6 *net.UDPConn, message []byte) {
+	logger := log.GetInstance()
+
+	// Interfaces come and go (VPNs, docker), so look them up again every round
+	for _, di := range discoveryinterfaces(serverinstance.config) {
+		if con != nil {
+			for _, broadcast := range di.broadcasts {
+				if _, err := con.WriteToUDPAddrPort(message, netip.AddrPortFrom(broadcast, serverport)); err != nil {
+					logger.Debug("SERVER | ERROR", fmt.Sprintf("Broadcast on %s: %v", di.ifi.Name, err))
+				}
+			}
+		}
+
+		if con6 != nil && di.multicast {
+			group := netip.AddrPortFrom(ipv6allnodes.WithZone(di.ifi.Name), serverport)
+			if _, err := con6.WriteToUDPAddrPort(message, group); err != nil {
+				logger.Debug("SERVER | ERROR", fmt.Sprintf("IPv6 beacon on %s: %v", di.ifi.Name, err))
+			}
+		}
+	}
 }
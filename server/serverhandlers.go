@@ -1,96 +1,322 @@
 package server
 
 import (
-	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"math/big"
 	"net/http"
-	"strconv"
-	"strings"
+	"time"
+
+	Crypt "github.com/QFServer/crypt"
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
 )
 
+// Pull instead of push. The node we made an accepted request to can fetch the files from here.
+// A share can be fetched as often as it allows, see share.go
 func (si *ServerInstance) handleconn(w http.ResponseWriter, r *http.Request) {
-	// Get the string which correlates to this item you want to handle in this
-	specHandle, ok := si.reqpool[strings.Split(r.RemoteAddr, ":")[0]]
+	address, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
 
-	if ok {
+	// Get the string which correlates to this item you want to handle in this
+	si.poolmu.Lock()
+	// Learning: Someone else's transfer gets the same answer as one that doesn't exist, no probing for ids
+	specHandle, ok := si.connection[r.PathValue("id")]
+	if !ok || specHandle.target.Addr() != address.Addr() {
+		si.poolmu.Unlock()
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, "no transfer "+r.PathValue("id"))
+		return
+	}
+	shared := specHandle.shared()
+	if shared {
+		if status, code, err := si.startpull(specHandle); err != nil {
+			si.poolmu.Unlock()
+			writeproblem(w, status, code, err.Error())
+			return
+		}
+	} else {
+		if specHandle.sessionkey == nil {
+			si.poolmu.Unlock()
+			writeproblem(w, http.StatusForbidden, protocol.CodeBadKey, "there is no session key for it, it was never accepted or it was cancelled")
+			return
+		}
+		if err := specHandle.transition(statetransferring); err != nil {
+			si.poolmu.Unlock()
+			writeproblem(w, http.StatusConflict, protocol.CodeWrongState, err.Error())
+			return
+		}
+	}
+	key := specHandle.sessionkey
+	si.poolmu.Unlock()
 
-		// Get a key I can use for this connection
-		token := make([]byte, 4)
-		rand.Read(token)
+	finish := si.finishoutgoing
+	if shared {
+		finish = si.finishpull
+	}
 
-		encryptedMessage, error := rsa.EncryptOAEP(sha256.New(), rand.Reader, &specHandle.masterPublic, specHandle.data, token)
-		if error == nil {
-			w.Write(encryptedMessage)
+	// Every pull of a share is sealed with a key of its own, see pullkey
+	if shared {
+		salt := make([]byte, pullsaltsize)
+		_, err = rand.Read(salt)
+		if err == nil {
+			key, err = pullkey(key, salt)
+		}
+		if err != nil {
+			finish(specHandle, err)
+			writeproblem(w, http.StatusInternalServerError, protocol.CodeEncryption, err.Error())
+			return
 		}
+		w.Header().Set(pullsaltheader, hex.EncodeToString(salt))
+	}
 
+	aead, err := Crypt.NewAEAD(key)
+	if err != nil {
+		finish(specHandle, err)
+		writeproblem(w, http.StatusInternalServerError, protocol.CodeEncryption, err.Error())
+		return
 	}
 
+	w.Header().Set("Content-Type", "application/octet-stream")
+	finish(specHandle, si.writechunks(&throttled{si: si, c: specHandle, w: w}, specHandle, aead, buildmanifest(specHandle.files)))
+}
+
+// Offers nobody answered yet that one peer can have with us. An address can hold a few nodes (NAT, a relay),
+// so it gets more room than a single node id
+const (
+	maxpendingnode    = 16
+	maxpendingaddress = 32
+)
+
+// Offers from a node and from an address still waiting for an answer. Must hold the pool lock
+func (si *ServerInstance) pendingfrom(node string, address string) (int, int) {
+	bynode, byaddress := 0, 0
+	for _, c := range si.reqpool {
+		if c.state != statepending {
+			continue
+		}
+		if c.peerid == node {
+			bynode++
+		}
+		if c.sourceCON == address {
+			byaddress++
+		}
+	}
+	return bynode, byaddress
 }
 
 // Functions to pool everything
 func (si *ServerInstance) handlereq(w http.ResponseWriter, r *http.Request) {
-	address := strings.Split(r.RemoteAddr, ":")[0]
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+	address := poolkey(remote.Addr())
 
-	// Check duplicates
-	_, exists := si.reqpool[address]
-	if !exists {
-		newConn := new(conn)
-		requestBody := r.Body
+	// Interpret the request data
+	// Learning: A bad body used to panic here on content[1]. The protocol package checks everything
+	// before we touch it, so all that's left is to say no
+	m, origin, err := getguard().Expect(r.Body, protocol.MaxMessageSize, protocol.TypeOffer)
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+	offer := m.(protocol.Offer)
 
-		buf := new(bytes.Buffer)
-		_, err := buf.ReadFrom(requestBody)
+	// The offer has to be signed by the node it says it's from
+	if origin.NodeID != offer.Sender.NodeID {
+		rejectmessage(w, r, fmt.Errorf("%w: offer for %s signed by %s", protocol.ErrSignature, offer.Sender.NodeID, origin.NodeID))
+		return
+	}
 
-		// Interpret the request data
-		if err == nil {
-			content := strings.Split(buf.String(), "||")
+	// Nobody gets to fill the inbox by themselves
+	if getinbox().full(origin.NodeID, address) {
+		writeproblem(w, http.StatusTooManyRequests, protocol.CodeBusy, fmt.Sprintf("%d unread items from you already", inboxperpeer))
+		return
+	}
 
-			// Get the bigint conversion
-			bigIntN := new(big.Int)
-			bigIntN, ok := bigIntN.SetString(content[1], 10)
+	// Check duplicates. A peer can have several requests going, each with its own id, up to maxpendingnode
+	si.poolmu.RLock()
+	_, exists := si.reqpool[offer.ID]
+	si.poolmu.RUnlock()
+	if exists {
+		writeproblem(w, http.StatusConflict, protocol.CodeDuplicate, "request "+offer.ID)
+		return
+	}
 
-			if !ok { // TODO: CHANGE TO BETTER ERROR
-				fmt.Println("ERROR")
-			}
+	// Setup the connection object
+	now := time.Now()
+	newConn := &conn{
+		id:           offer.ID,
+		endpointCON:  offer.Endpoint,
+		sourceCON:    address,
+		target:       si.peeraddr(remote.Addr(), origin.NodeID),
+		masterPublic: rsa.PublicKey{N: new(big.Int).SetBytes(offer.Key.N), E: offer.Key.E},
+		sender:       offer.Sender,
+		peerid:       origin.NodeID,
+		files:        offer.Files,
+		totalsize:    offer.TotalSize,
+		message:      offer.Message,
+		priority:     defaultpriority(offer.TotalSize),
+		streams:      offer.Streams,
+		downloads:    offer.Downloads,
+		state:        statepending,
+		created:      now,
+		updated:      now,
+	}
 
-			// Get the E conversion
-			eInt, err := strconv.Atoi(content[2])
+	if offer.Expires != 0 {
+		newConn.expires = time.UnixMilli(offer.Expires)
+	}
+
+	// Learning: Lock, check and store in one go, two offers with the same id could both pass the check above
+	si.poolmu.Lock()
+	if _, exists := si.reqpool[newConn.id]; exists {
+		si.poolmu.Unlock()
+		writeproblem(w, http.StatusConflict, protocol.CodeDuplicate, "request "+offer.ID)
+		return
+	}
+	if bynode, byaddress := si.pendingfrom(origin.NodeID, address); bynode >= maxpendingnode || byaddress >= maxpendingaddress {
+		si.poolmu.Unlock()
+		writeproblem(w, http.StatusTooManyRequests, protocol.CodeBusy, fmt.Sprintf("%d of your requests are waiting for an answer already", max(bynode, byaddress)))
+		return
+	}
+	si.reqpool[newConn.id] = newConn
+	si.poolmu.Unlock()
+
+	// It goes in the inbox too, so it's still there to look at after the server closes
+	if err := getinbox().add(InboxItem{
+		ID:       newConn.id,
+		Kind:     KindOffer,
+		From:     newConn.sender,
+		Address:  address,
+		ReplyTo:  peername(newConn.target),
+		Sent:     origin.Time,
+		Received: now,
+		Text:     newConn.message,
+		Files:    newConn.files,
+		Total:    newConn.totalsize,
+	}); err != nil {
+		log.GetInstance().Debug("INBOX", "Could not keep the request: "+err.Error())
+	}
+
+	// Accepted as in "it's in the pool", the user still has to answer it
+	w.WriteHeader(http.StatusAccepted)
+	// The sender we just went through a wormhole with, receive already said yes to this, see wormhole.go
+	if getwormholes().expected(origin.NodeID, remote.Addr()) {
+		log.GetInstance().Output("WORMHOLE", fmt.Sprintf("%s sent %s through the wormhole", address, newConn.summary()))
+		go si.answerrequest(newConn.id, true, "")
+		return
+	}
+
+	message := fmt.Sprintf("New request from %s (%s), util server request to answer it", address, newConn.summary())
+	if newConn.shared() {
+		message = fmt.Sprintf("New share from %s (%s, %s), util server request to answer it", address, newConn.summary(), newConn.sharesummary())
+	}
+	log.GetInstance().Output("REQ", message)
+}
+
+// The node we made a request to is answering it
+func (si *ServerInstance) handlereply(w http.ResponseWriter, r *http.Request) {
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+
+	m, origin, err := getguard().Decode(r.Body, protocol.MaxMessageSize)
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
 
-			if err != nil { // TODO: CHANGE TO BETTER ERROR
-				fmt.Println("ERROR")
+	id, to, reason := "", statepending, ""
+	switch reply := m.(type) {
+	case protocol.Accept:
+		id, to = reply.ID, stateaccepted
+	case protocol.Reject:
+		id, to, reason = reply.ID, staterejected, reply.Reason
+	default:
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, "expected accept or reject, got "+string(m.Type()))
+		return
+	}
+
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	// Only the node we asked gets to answer
+	if c, ok := si.connection[id]; ok && c.target.Addr() == remote.Addr() {
+		if accept, ok := m.(protocol.Accept); ok {
+			if err := opensessionkey(c, si.conKeyPriv[c], accept.Key); err != nil {
+				writeproblem(w, http.StatusBadRequest, protocol.CodeBadKey, "could not open the session key")
+				return
 			}
+			c.streams = max(min(accept.Streams, maxstreams), 1)
+		}
 
-			// Setup the public key object
-			pubKey := new(rsa.PublicKey)
-			pubKey.N = bigIntN
-			pubKey.E = eInt
+		if err := c.transition(to); err != nil {
+			writeproblem(w, http.StatusConflict, protocol.CodeWrongState, err.Error())
+			return
+		}
+		c.reason = reason
+		c.peerid = origin.NodeID
 
-			// Setup the connection object
-			newConn.endpointCON = content[0]
-			newConn.sourceCON = address
-			newConn.masterPublic = *pubKey
+		// From now on this node can send receipts for it, see receipts.go
+		if c.state == stateaccepted {
+			getreceipts().remember(sentitem{About: c.id, Kind: KindOffer, To: c.endpointCON, Node: c.peerid, Sent: c.created})
+		}
 
-			// Store the request
-			si.reqpool[address] = *newConn
+		// Accepted, start pushing. The reply goes back first so they know we heard them.
+		// A share isn't pushed, the receiver pulls it when it likes
+		if c.state == stateaccepted && !c.shared() {
+			go si.pushtransfer(c)
+		}
 
-			fmt.Println("Secured the connection object")
+		message := fmt.Sprintf("%s %s your request", c.endpointCON, c.state)
+		if c.state == stateaccepted && c.shared() {
+			message = fmt.Sprintf("%s accepted your share, it can be pulled %d times until %s", c.endpointCON, c.downloads, c.expires.Format("15:04"))
 		}
+		if reason != "" {
+			message += ": " + reason
+		}
+		log.GetInstance().Output("REQ", message)
+		return
 	}
+
+	writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, "no request "+id)
 }
 
 // Ping response and receive
 func (si *ServerInstance) handleping(w http.ResponseWriter, r *http.Request) {
+	// "/" catches every path nobody registered, those get a 404 instead of counting as a ping
+	if r.URL.Path != "/" {
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnavailable, "nothing at "+r.URL.Path)
+		return
+	}
+
 	// Store ping in the pool
-	address := strings.Split(r.RemoteAddr, ":")[0]
+	address, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
 	hostname := r.Host
 
 	// Check duplicates
-	_, exists := si.pingpool[address]
-	if !exists {
-		// Store [address] = hostname
-		si.pingpool[address] = hostname
+	if !si.inpingpool(address.Addr()) {
+		si.addtopingpool(address.Addr(), hostname)
 	}
+	getoutbox().seen(address.Addr())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Who are we. Used by scans, kept small and cheap
+func (si *ServerInstance) handleinfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	protocol.Encode(w, si.hello())
 }
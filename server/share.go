@@ -0,0 +1,329 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Shares
+// An offer can be published for pull instead of pushed: it gets a time to live and a number of downloads.
+// The receiver accepts as usual and then fetches the files from /conn/{id}, as often as it's allowed to.
+// Once either runs out the sender forgets the paths, the session key and the RSA key in conKeyPriv, and
+// asking again gets an expired problem. The receiver throws its key away at the same time.
+// Without ttl= or downloads= nothing changes, the files are pushed like always
+
+const (
+	sharettl    = time.Hour          // When only downloads= was given
+	sharemaxttl = 7 * 24 * time.Hour // Nothing is kept around longer than a week
+)
+
+// How long and how often a share may be pulled. The zero value is a plain push
+type sharelimits struct {
+	TTL       time.Duration `json:"ttl,omitempty"`
+	Downloads int           `json:"downloads,omitempty"`
+}
+
+func (s sharelimits) shared() bool {
+	return s.TTL > 0 || s.Downloads > 0
+}
+
+// Take ttl=30m and downloads=3 out of the files of a send line. Giving one of them makes it a share,
+// the other one gets its default
+func parseshare(fields []string) (sharelimits, []string, error) {
+	share := sharelimits{}
+	paths := make([]string, 0, len(fields))
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "ttl":
+			ttl, err := time.ParseDuration(value)
+			if err != nil || ttl <= 0 || ttl > sharemaxttl {
+				return share, nil, fmt.Errorf("ttl=%s, it has to be a duration like 30m or 2h, at most %s", value, sharemaxttl)
+			}
+			share.TTL = ttl
+		case "downloads":
+			downloads, err := strconv.Atoi(value)
+			if err != nil || downloads < 1 || downloads > protocol.MaxDownloads {
+				return share, nil, fmt.Errorf("downloads=%s, it has to be between 1 and %d", value, protocol.MaxDownloads)
+			}
+			share.Downloads = downloads
+		default:
+			paths = append(paths, field)
+		}
+	}
+
+	if share.shared() {
+		if share.TTL == 0 {
+			share.TTL = sharettl
+		}
+		if share.Downloads == 0 {
+			share.Downloads = 1
+		}
+	}
+	return share, paths, nil
+}
+
+// "until 15:04, 1 of 3 downloads used", only for telling the user
+func (c *conn) sharesummary() string {
+	return fmt.Sprintf("until %s, %d of %d downloads used", c.expires.Format("15:04"), c.pulled, c.downloads)
+}
+
+func (c *conn) shared() bool {
+	return !c.expires.IsZero()
+}
+
+// Why a share can't be pulled anymore, empty while it still can
+func (c *conn) spent(now time.Time) string {
+	switch {
+	case !c.shared():
+		return ""
+	case now.After(c.expires):
+		return "its time ran out"
+	case c.downloads > 0 && c.pulled >= c.downloads:
+		return fmt.Sprintf("all %d downloads were used", c.downloads)
+	}
+	return ""
+}
+
+// Throw away everything a share needed to be pulled, the listing stays until the reaper drops it.
+// Must hold the pool lock, and nothing may be pulling it
+func (si *ServerInstance) forgetshare(c *conn, why string) {
+	switch c.state {
+	case statepending, stateaccepted:
+		c.transition(stateexpired)
+	case statetransferring, statepaused:
+		if c.fetched > 0 && c.state == statetransferring {
+			c.transition(statedone)
+		} else {
+			c.transition(statefailed)
+		}
+	}
+	if c.receiving != nil {
+		c.receiving.abort()
+	}
+
+	// Learning: clear zeroes the key bytes, setting it to nil alone would leave them to the garbage collector
+	clear(c.sessionkey)
+	c.sessionkey = nil
+	delete(si.conKeyPriv, c)
+	c.paths = nil
+	c.forgotten = true
+	c.reason = "share expired, " + why
+	c.updated = time.Now()
+}
+
+// Forget the shares that ran out. Must hold the pool lock, the reaper calls this for both pools.
+// A share lives by its own clock until it's forgotten, a received one stays to be pulled again.
+// False for anything else, the reaper handles those like always
+func (si *ServerInstance) reapshare(c *conn, now time.Time, peer string) bool {
+	if !c.shared() || c.forgotten {
+		return false
+	}
+
+	if why := c.spent(now); why != "" && c.pulling == 0 {
+		si.forgetshare(c, why)
+		log.GetInstance().Output("SHARE", fmt.Sprintf("Share %s with %s expired, %s", c.id, peer, why))
+	}
+	return true
+}
+
+// SENDER: A pull of a share is starting. Must hold the pool lock
+func (si *ServerInstance) startpull(c *conn) (int, string, error) {
+	why := c.spent(time.Now())
+	if why != "" && !c.forgotten && c.pulling == 0 {
+		si.forgetshare(c, why)
+	}
+	if c.forgotten || why != "" {
+		if why == "" {
+			why = c.reason
+		}
+		return http.StatusGone, protocol.CodeExpired, fmt.Errorf("share %s expired: %s", c.id, why)
+	}
+	if c.sessionkey == nil {
+		return http.StatusForbidden, protocol.CodeBadKey, errors.New("there is no session key for it, it was never accepted or it was cancelled")
+	}
+
+	switch c.state {
+	case stateaccepted:
+		c.transition(statetransferring)
+	case statetransferring:
+		// Pulled again after an earlier pull finished. Progress counts this pull only
+		if c.pulling == 0 {
+			c.started, c.done = time.Now(), 0
+		}
+	default:
+		return http.StatusConflict, protocol.CodeWrongState, errors.New("share " + c.id + " is " + c.state.String())
+	}
+
+	c.pulled++
+	c.pulling++
+	return 0, "", nil
+}
+
+// SENDER: A pull of a share ended. The last download takes the share with it
+func (si *ServerInstance) finishpull(c *conn, err error) {
+	logger := log.GetInstance()
+
+	si.poolmu.Lock()
+	c.pulling--
+	if err == nil {
+		c.fetched++
+	}
+	state, pulled, downloads := c.state, c.pulled, c.downloads
+	why := ""
+	if c.pulling == 0 && !c.forgotten {
+		why = c.spent(time.Now())
+		if why != "" {
+			si.forgetshare(c, why)
+		}
+	}
+	si.poolmu.Unlock()
+
+	switch {
+	case state == statecancelled:
+		logger.Output("TRANSFER", fmt.Sprintf("Share %s to %s was cancelled", c.id, c.endpointCON))
+	case err != nil:
+		logger.Output("TRANSFER", fmt.Sprintf("%s could not pull share %s: %v", c.endpointCON, c.id, err))
+	default:
+		logger.Output("TRANSFER", fmt.Sprintf("%s pulled share %s (%s), download %d of %d", c.endpointCON, c.id, humansize(c.totalsize), pulled, downloads))
+	}
+	if why != "" {
+		logger.Output("SHARE", fmt.Sprintf("Share %s to %s expired, %s", c.id, c.endpointCON, why))
+	}
+}
+
+// RECEIVER: Fetch an accepted share from the sender. A failed pull can be tried again with PullShare
+// while the share lasts
+func (si *ServerInstance) pulltransfer(c *conn) {
+	si.poolmu.Lock()
+	c.pulled++
+	c.pulling++
+	si.poolmu.Unlock()
+
+	err := si.pull(c)
+
+	// The sender forgot it already, so can we
+	var remote *RemoteError
+	expired := errors.As(err, &remote) && remote.Problem.Code == protocol.CodeExpired
+
+	si.poolmu.Lock()
+	c.pulling--
+	failed := false
+	if expired {
+		si.forgetshare(c, "the sender says so")
+		failed = true
+	} else if err != nil && c.transition(statefailed) == nil {
+		c.reason = err.Error()
+		failed = true
+	}
+	si.poolmu.Unlock()
+
+	// receivestream already said why when it was the one failing
+	if failed {
+		log.GetInstance().Output("TRANSFER", fmt.Sprintf("Pulling %s from %s failed: %v", c.id, c.sourceCON, err))
+	}
+}
+
+// RECEIVER: One GET of /conn/{id}, the whole share comes back as a single stream
+func (si *ServerInstance) pull(c *conn) error {
+	client := &http.Client{Timeout: transfertimeout}
+	resp, err := client.Get(nodeurl(c.target, "/conn/"+c.id))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := readproblem(resp); err != nil {
+		return err
+	}
+
+	si.poolmu.RLock()
+	sessionkey := c.sessionkey
+	si.poolmu.RUnlock()
+	salt, err := hex.DecodeString(resp.Header.Get(pullsaltheader))
+	if err != nil {
+		return fmt.Errorf("the sender didn't say how to open this pull: %v", err)
+	}
+	key, err := pullkey(sessionkey, salt)
+	if err != nil {
+		return err
+	}
+
+	rc, _, _, err := si.beginreceiving(c)
+	if err != nil {
+		return err
+	}
+	if err := rc.open(0); err != nil {
+		return err
+	}
+	_, _, err = si.receivestream(c, rc, key, resp.Body)
+	return err
+}
+
+// Pull a share that came to us again, after a pull failed or to get a fresh copy. Each pull
+// uses up one of the downloads the sender allowed
+func (si *ServerInstance) PullShare(id string) error {
+	if !CheckServerAlive() {
+		return errors.New("the server isn't alive")
+	}
+
+	// The last pull goes in the history before its entry is replaced
+	si.recordhistory()
+
+	now := time.Now()
+	si.poolmu.Lock()
+	c, ok := si.reqpool[id]
+	switch {
+	case !ok:
+		si.poolmu.Unlock()
+		return errors.New("no transfer with id " + id)
+	case !c.shared():
+		si.poolmu.Unlock()
+		return errors.New(id + " was pushed, there is nothing to pull")
+	case c.forgotten || c.sessionkey == nil:
+		si.poolmu.Unlock()
+		return errors.New("share " + id + " expired")
+	case c.spent(now) != "":
+		si.poolmu.Unlock()
+		return fmt.Errorf("share %s expired, %s", id, c.spent(now))
+	case c.state != statedone && c.state != statefailed:
+		si.poolmu.Unlock()
+		return errors.New("share " + id + " is " + c.state.String())
+	}
+
+	// Learning: done and failed have no way out, so a new pull is a new connection with the same id and key
+	again := &conn{
+		id:           c.id,
+		endpointCON:  c.endpointCON,
+		sourceCON:    c.sourceCON,
+		target:       c.target,
+		peerid:       c.peerid,
+		state:        stateaccepted,
+		created:      c.created,
+		updated:      now,
+		priority:     c.priority,
+		streams:      1,
+		sessionkey:   c.sessionkey,
+		sender:       c.sender,
+		files:        c.files,
+		totalsize:    c.totalsize,
+		message:      c.message,
+		expires:      c.expires,
+		downloads:    c.downloads,
+		pulled:       c.pulled,
+		masterPublic: c.masterPublic,
+	}
+	si.reqpool[id] = again
+	si.poolmu.Unlock()
+
+	go si.pulltransfer(again)
+	return nil
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	Crypt "github.com/QFServer/crypt"
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// A sender with one share of a single file, allowed two downloads
+func startshare(t *testing.T) (*ServerInstance, *conn, string) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	log.GetInstance().BeginDebugLogger()
+	getidentity()
+
+	path := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("a"), 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sessionkey := make([]byte, sessionkeysize)
+	rand.Read(sessionkey)
+
+	now := time.Now()
+	c := &conn{
+		id:         "0123456789abcdef0123456789abcdef",
+		target:     netip.MustParseAddrPort("127.0.0.1:8080"),
+		state:      stateaccepted,
+		created:    now,
+		updated:    now,
+		streams:    1,
+		sessionkey: sessionkey,
+		paths:      []string{path},
+		files:      []protocol.FileMeta{{Name: "notes.txt", Size: 1000, Hash: strings.Repeat("0", 64)}},
+		totalsize:  1000,
+		expires:    now.Add(time.Hour),
+		downloads:  2,
+	}
+
+	si := &ServerInstance{
+		pingpool:   make(map[string]Peer),
+		reqpool:    make(map[string]*conn),
+		connection: map[string]*conn{c.id: c},
+		conKeyPriv: make(map[*conn]*rsa.PrivateKey),
+		config:     &serverconfig{},
+		limits:     newlimiter(0, 0),
+		tuner:      newstreamtuner(),
+	}
+	return si, c, path
+}
+
+// One GET of the share as the receiver at 127.0.0.1 would make it
+func pullonce(si *ServerInstance, id string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/conn/"+id, nil)
+	r.RemoteAddr = "127.0.0.1:40000"
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	si.handleconn(w, r)
+	return w
+}
+
+// The first chunk of a pull, still sealed, and the salt it came with
+func firstchunk(t *testing.T, w *httptest.ResponseRecorder) ([]byte, []byte) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("pull got %d: %s", w.Code, w.Body.String())
+	}
+	salt, err := hex.DecodeString(w.Header().Get(pullsaltheader))
+	if err != nil || len(salt) != pullsaltsize {
+		t.Fatalf("salt %q", w.Header().Get(pullsaltheader))
+	}
+	m, err := protocol.ReadFrame(w.Body, protocol.MaxChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk, ok := m.(protocol.Chunk)
+	if !ok {
+		t.Fatalf("got a %s first", m.Type())
+	}
+	return chunk.Data, salt
+}
+
+func TestSharePullKeys(t *testing.T) {
+	si, c, path := startshare(t)
+	// The last download wipes the session key, keep a copy to check with
+	sessionkey := append([]byte(nil), c.sessionkey...)
+
+	first, firstsalt := firstchunk(t, pullonce(si, c.id))
+
+	// Edited in place between pulls, same size so the sender doesn't notice
+	if err := os.WriteFile(path, bytes.Repeat([]byte("b"), 1000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	second, secondsalt := firstchunk(t, pullonce(si, c.id))
+
+	if bytes.Equal(firstsalt, secondsalt) {
+		t.Fatal("both pulls got the same salt")
+	}
+
+	// Each opens with its own pull key and nothing else
+	for _, pull := range []struct {
+		sealed []byte
+		salt   []byte
+		want   byte
+	}{{first, firstsalt, 'a'}, {second, secondsalt, 'b'}} {
+		key, err := pullkey(sessionkey, pull.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, _ := Crypt.NewAEAD(key)
+		plaintext, err := aead.Open(nil, chunknonce(0, 0), pull.sealed, []byte(c.id))
+		if err != nil {
+			t.Fatalf("pull didn't open with its key: %v", err)
+		}
+		if !bytes.Equal(plaintext, bytes.Repeat([]byte{pull.want}, 1000)) {
+			t.Fatal("pull opened to something else")
+		}
+
+		plain, _ := Crypt.NewAEAD(sessionkey)
+		if _, err := plain.Open(nil, chunknonce(0, 0), pull.sealed, []byte(c.id)); err == nil {
+			t.Fatal("pull opened with the session key itself")
+		}
+	}
+
+	// Same key and nonce would leave the XOR of the plaintexts, 'a'^'b', in the XOR of the ciphertexts
+	same := true
+	for i := range 1000 {
+		same = same && first[i]^second[i] == 'a'^'b'
+	}
+	if same {
+		t.Fatal("both pulls used the same keystream")
+	}
+
+	// Both downloads are used up
+	if w := pullonce(si, c.id); w.Code != http.StatusGone {
+		t.Fatalf("third pull got %d", w.Code)
+	}
+	if c.sessionkey != nil || c.paths != nil || !c.forgotten {
+		t.Fatal("the spent share still has its key or paths")
+	}
+}
+
+func TestSharePullExpired(t *testing.T) {
+	si, c, _ := startshare(t)
+	c.expires = time.Now().Add(-time.Second)
+
+	w := pullonce(si, c.id)
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), protocol.CodeExpired) {
+		t.Fatalf("expired share got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPullKey(t *testing.T) {
+	sessionkey := bytes.Repeat([]byte{1}, sessionkeysize)
+	one, err := pullkey(sessionkey, bytes.Repeat([]byte{2}, pullsaltsize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := pullkey(sessionkey, bytes.Repeat([]byte{2}, pullsaltsize))
+	other, _ := pullkey(sessionkey, bytes.Repeat([]byte{3}, pullsaltsize))
+	if !bytes.Equal(one, again) || bytes.Equal(one, other) || len(one) != sessionkeysize {
+		t.Fatal("pull keys don't follow their salt")
+	}
+	if _, err := pullkey(sessionkey, []byte{2}); err == nil {
+		t.Fatal("took a short salt")
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/QFServer/log"
+)
+
+// Where a connection is in its life
+//
+//	pending -> accepted -> transferring <-> paused
+//	   |          |             |
+//	   v          v             v
+//	rejected   expired    done or failed
+//	retracted
+//
+// A pending or accepted connection that sits too long expires, anything can fail.
+// The user can cancel anything that isn't finished yet, the sender can retract an offer that's still pending
+type connstate int
+
+const (
+	statepending connstate = iota
+	stateaccepted
+	staterejected
+	statetransferring
+	statedone
+	statefailed
+	stateexpired
+	statepaused
+	statecancelled
+	stateretracted
+)
+
+const (
+	pendingtimeout  = 5 * time.Minute  // How long a request waits for C/R
+	acceptedtimeout = 2 * time.Minute  // How long an accepted request waits for the data to start
+	stalltimeout    = 1 * time.Minute  // A transfer that makes no progress for this long fails
+	finishedkeep    = 10 * time.Minute // Finished connections stay listed this long
+	reaperinterval  = 10 * time.Second
+)
+
+func (s connstate) String() string {
+	switch s {
+	case statepending:
+		return "pending"
+	case stateaccepted:
+		return "accepted"
+	case staterejected:
+		return "rejected"
+	case statetransferring:
+		return "transferring"
+	case statedone:
+		return "done"
+	case statefailed:
+		return "failed"
+	case stateexpired:
+		return "expired"
+	case statepaused:
+		return "paused"
+	case statecancelled:
+		return "cancelled"
+	case stateretracted:
+		return "retracted"
+	}
+	return "unknown"
+}
+
+// The moves each state is allowed to make
+var transitions = map[connstate][]connstate{
+	statepending:      {stateaccepted, staterejected, stateexpired, statefailed, statecancelled, stateretracted},
+	stateaccepted:     {statetransferring, statedone, stateexpired, statefailed, statecancelled},
+	statetransferring: {statedone, statefailed, statepaused, statecancelled},
+	statepaused:       {statetransferring, statefailed, statecancelled},
+}
+
+// Nothing else happens once a connection gets here
+func (s connstate) finished() bool {
+	return len(transitions[s]) == 0
+}
+
+// Move a connection to a new state. Illegal moves are refused so a late reply can't resurrect anything
+func (c *conn) transition(to connstate) error {
+	for _, allowed := range transitions[c.state] {
+		if allowed == to {
+			from := c.state
+			c.state = to
+			c.updated = time.Now()
+			if from == stateaccepted && to == statetransferring {
+				c.started = c.updated
+				c.done = 0
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("connection %s can't go from %s to %s", c.id, c.state, to)
+}
+
+// Has the connection been sitting in its state for too long
+func (c *conn) timedout(now time.Time) bool {
+	switch c.state {
+	case statepending:
+		return now.Sub(c.updated) > pendingtimeout
+	case stateaccepted:
+		return now.Sub(c.updated) > acceptedtimeout
+	case statetransferring:
+		return now.Sub(c.updated) > stalltimeout
+	}
+	return false
+}
+
+// Expire what timed out and forget what finished a while ago. Runs for as long as the server does
+func connectionreaper() {
+	logger := log.GetInstance()
+
+	for serverinstance != nil {
+		time.Sleep(reaperinterval)
+
+		si := serverinstance
+		if si == nil {
+			return
+		}
+		now := time.Now()
+
+		si.poolmu.Lock()
+		for key, c := range si.reqpool {
+			if si.reapshare(c, now, c.sourceCON) {
+				continue
+			}
+			if c.timedout(now) {
+				to, reason := stateexpired, "nobody answered in time"
+				if c.state == statetransferring {
+					to, reason = statefailed, "stalled"
+				}
+				c.transition(to)
+				c.reason = reason
+				if c.receiving != nil {
+					c.receiving.abort()
+				}
+				logger.Output("REQ", fmt.Sprintf("Request from %s %s", c.sourceCON, c.state))
+			} else if c.state.finished() && now.Sub(c.updated) > finishedkeep {
+				delete(si.reqpool, key)
+			}
+		}
+
+		for key, c := range si.connection {
+			// Shares run by their own clock, see share.go
+			if si.reapshare(c, now, c.endpointCON) {
+				continue
+			}
+			if c.timedout(now) {
+				to, reason := stateexpired, "nobody answered in time"
+				if c.state == statetransferring {
+					to, reason = statefailed, "stalled"
+				}
+				c.transition(to)
+				c.reason = reason
+				logger.Output("REQ", fmt.Sprintf("Request to %s %s", c.endpointCON, c.state))
+			} else if c.state.finished() && now.Sub(c.updated) > finishedkeep {
+				delete(si.conKeyPriv, c)
+				delete(si.connection, key)
+			}
+		}
+		si.poolmu.Unlock()
+
+		si.recordhistory()
+	}
+}
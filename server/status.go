@@ -0,0 +1,87 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// What the client gets to see about a transfer
+type TransferStatus struct {
+	ID        string
+	Direction string // "in" for requests to us, "out" for ours
+	Peer      string
+	State     string
+	Priority  string
+	Files     int
+	Done      int64
+	Total     int64
+	Speed     float64       // Bytes per second since the data started
+	ETA       time.Duration // Zero when we can't tell
+	Share     string        // "until 15:04, 1 of 3 downloads used", empty when it's pushed
+	Created   time.Time
+}
+
+func (c *conn) status(direction string, peer string, now time.Time) TransferStatus {
+	status := TransferStatus{
+		ID:        c.id,
+		Direction: direction,
+		Peer:      peer,
+		State:     c.state.String(),
+		Priority:  c.priority.String(),
+		Files:     len(c.files),
+		Done:      c.done,
+		Total:     c.totalsize,
+		Created:   c.created,
+	}
+	if c.shared() && !c.forgotten {
+		status.Share = c.sharesummary()
+	}
+
+	if c.started.IsZero() {
+		return status
+	}
+
+	// Learning: A finished transfer stops its clock at the last update, otherwise the speed keeps dropping
+	end := now
+	if c.state.finished() {
+		end = c.updated
+	}
+	if elapsed := end.Sub(c.started).Seconds(); elapsed > 0 {
+		status.Speed = float64(c.done) / elapsed
+	}
+	if c.state == statetransferring && status.Speed > 0 && c.totalsize > c.done {
+		status.ETA = time.Duration(float64(c.totalsize-c.done) / status.Speed * float64(time.Second))
+	}
+
+	return status
+}
+
+// Every transfer we know about, both ways, oldest first
+func (si *ServerInstance) Transfers() []TransferStatus {
+	if !CheckServerAlive() {
+		return nil
+	}
+
+	now := time.Now()
+
+	si.poolmu.RLock()
+	transfers := make([]TransferStatus, 0, len(si.reqpool)+len(si.connection))
+	for _, c := range si.reqpool {
+		transfers = append(transfers, c.status("in", c.sourceCON, now))
+	}
+	for _, c := range si.connection {
+		transfers = append(transfers, c.status("out", c.endpointCON, now))
+	}
+	si.poolmu.RUnlock()
+
+	sort.Slice(transfers, func(a, b int) bool {
+		return transfers[a].Created.Before(transfers[b].Created)
+	})
+
+	return transfers
+}
+
+// Sizes the way the server prints them, for the client
+func HumanSize(size int64) string {
+	return humansize(size)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/QFServer/protocol"
+)
+
+// Parallel streams
+// One HTTP stream doesn't fill a fast link, so big transfers are cut into ranges of chunks and
+// every range goes over its own POST to /transfer/{id}/{stream}.
+// 1. The offer says how many streams the sender is willing to open
+// 2. The receiver picks how many it wants from what it measured last time and says so in the accept
+// 3. Every chunk carries its index in the manifest, the receiver ticks them off as they land with
+//    WriteAt and only checks the hashes once every chunk of every stream is in
+
+const (
+	maxstreams     = 8        // What we offer
+	multistreammin = 64 << 20 // Smaller transfers aren't worth more than one stream
+	defaultstreams = 2        // First transfer to a peer we know nothing about
+	fastlink       = 32 << 20 // Bytes per second per stream where adding streams starts to pay off
+)
+
+// One chunk in the manifest
+type chunkref struct {
+	index  int
+	file   int
+	offset int64
+	length int
+}
+
+// Every chunk of every file, in order. Both sides build the same one from the offer
+func buildmanifest(files []protocol.FileMeta) []chunkref {
+	manifest := make([]chunkref, 0)
+	for fileindex, f := range files {
+		for offset := int64(0); offset < f.Size; offset += chunksize {
+			manifest = append(manifest, chunkref{
+				index:  len(manifest),
+				file:   fileindex,
+				offset: offset,
+				length: int(min(chunksize, f.Size-offset)),
+			})
+		}
+	}
+	return manifest
+}
+
+// Cut the manifest into n ranges of about the same number of chunks. Always n of them, even if
+// some are empty, the receiver waits for every stream it asked for
+func splitranges(manifest []chunkref, n int) [][]chunkref {
+	n = max(n, 1)
+
+	ranges := make([][]chunkref, 0, n)
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(manifest)-start)/(n-i)
+		ranges = append(ranges, manifest[start:end])
+		start = end
+	}
+	return ranges
+}
+
+// RECEIVER: Which chunks have landed
+type manifestcheck struct {
+	chunks    []chunkref
+	seen      []bool
+	remaining int
+}
+
+func newmanifestcheck(files []protocol.FileMeta) *manifestcheck {
+	chunks := buildmanifest(files)
+	return &manifestcheck{chunks: chunks, seen: make([]bool, len(chunks)), remaining: len(chunks)}
+}
+
+// Tick a chunk off. Anything that isn't in the manifest, or shows up twice, is refused
+func (m *manifestcheck) mark(index int, file int, offset int64, length int) error {
+	if index >= len(m.chunks) {
+		return fmt.Errorf("chunk %d isn't in the manifest", index)
+	}
+
+	want := m.chunks[index]
+	if want.file != file || want.offset != offset || want.length != length {
+		return fmt.Errorf("chunk %d doesn't match the manifest", index)
+	}
+	if m.seen[index] {
+		return fmt.Errorf("chunk %d came twice", index)
+	}
+
+	m.seen[index] = true
+	m.remaining--
+	return nil
+}
+
+// How a peer did last time, so the next transfer can pick its stream count
+type streamrecord struct {
+	next        int     // Streams to ask for next time
+	best        float64 // Best throughput seen, bytes per second
+	beststreams int
+}
+
+type streamtuner struct {
+	mu    sync.Mutex
+	peers map[string]streamrecord
+}
+
+func newstreamtuner() *streamtuner {
+	return &streamtuner{peers: make(map[string]streamrecord)}
+}
+
+// How many streams to ask a peer for, never more than it offered
+func (st *streamtuner) suggest(peer string, size int64, offered int) int {
+	if size < multistreammin || offered <= 1 {
+		return 1
+	}
+
+	st.mu.Lock()
+	record, ok := st.peers[peer]
+	st.mu.Unlock()
+
+	want := defaultstreams
+	if ok {
+		want = record.next
+	}
+	return max(min(want, offered), 1)
+}
+
+// Learn from a finished transfer. Every stream still running flat out means the link has room,
+// so double up. If more streams made it slower, go back to what was best
+func (st *streamtuner) record(peer string, streams int, throughput float64) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	record := st.peers[peer]
+	switch {
+	case record.best > 0 && throughput < record.best*0.9:
+		record.next = record.beststreams
+	case throughput/float64(streams) >= fastlink:
+		record.next = min(streams*2, protocol.MaxStreams)
+	default:
+		record.next = streams
+	}
+
+	if throughput > record.best {
+		record.best = throughput
+		record.beststreams = streams
+	}
+	st.peers[peer] = record
+}
@@ -0,0 +1,548 @@
+package server
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Crypt "github.com/QFServer/crypt"
+	FR "github.com/QFServer/fr"
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Pushing files
+// 1. The receiver accepts and sends back a fresh AES key, encrypted to the RSA key from the offer
+// 2. The sender streams frames to /transfer/{id}/{stream}: one Chunk per piece of a file, then a Close
+// 3. The receiver writes every chunk to disk before reading the next one and checks the hashes at the end
+// Big transfers use more than one stream, see streams.go
+// Learning: Since the handler only reads when the disk write is done, TCP flow control slows the
+// sender down to whatever our disk can take. That's the backpressure, no extra messages needed
+
+const (
+	chunksize       = 256 << 10 // Plaintext bytes per chunk
+	sessionkeysize  = 32
+	pullsaltsize    = 16
+	pullsaltheader  = "X-Pull-Salt" // Hex, on the answer to a pull of a share
+	transfertimeout = 12 * time.Hour
+)
+
+// GCM nonce for a chunk. File and offset never repeat within a transfer, so neither does the nonce.
+// A share is sent again for every pull, maybe after a file was edited, so each pull gets its own key (pullkey)
+func chunknonce(file int, offset int64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint32(nonce[:4], uint32(file))
+	binary.BigEndian.PutUint64(nonce[4:], uint64(offset))
+	return nonce
+}
+
+// The key for one pull of a share. The sender picks the salt for every pull and tells the receiver in the
+// pullsaltheader, a GET that's replayed still gets a new one
+// Learning: Same key, same nonce and different plaintext gives away the XOR of both and GCM's hash key with it
+func pullkey(sessionkey []byte, salt []byte) ([]byte, error) {
+	if len(salt) != pullsaltsize {
+		return nil, fmt.Errorf("pull salt of %d bytes", len(salt))
+	}
+	return hkdf.Key(sha256.New, sessionkey, salt, "QFServer share pull", sessionkeysize)
+}
+
+// RECEIVER: Make the session key for an accepted request, returned encrypted for the Accept
+func newsessionkey(c *conn) ([]byte, []byte, error) {
+	key := make([]byte, sessionkeysize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+
+	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, &c.masterPublic, key, []byte(c.id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, encrypted, nil
+}
+
+// SENDER: Get the session key out of an Accept
+func opensessionkey(c *conn, priv *rsa.PrivateKey, encrypted []byte) error {
+	if priv == nil {
+		return errors.New("no private key for this request")
+	}
+
+	key, err := rsa.DecryptOAEP(sha256.New(), nil, priv, encrypted, []byte(c.id))
+	if err != nil {
+		return err
+	}
+	if len(key) != sessionkeysize {
+		return errors.New("session key has the wrong size")
+	}
+
+	c.sessionkey = key
+	return nil
+}
+
+// Count bytes through a transfer. Also keeps the reaper from calling it stalled
+func (si *ServerInstance) addprogress(c *conn, n int64) {
+	si.poolmu.Lock()
+	c.done += n
+	c.updated = time.Now()
+	si.poolmu.Unlock()
+}
+
+// Write a range of the manifest as encrypted chunks, then a Close
+func (si *ServerInstance) writechunks(w io.Writer, c *conn, aead cipher.AEAD, chunks []chunkref) error {
+	buffer := make([]byte, chunksize)
+
+	var file *os.File
+	current := -1
+	defer func() {
+		if file != nil {
+			file.Close()
+		}
+	}()
+
+	for _, ref := range chunks {
+		if ref.file != current {
+			if file != nil {
+				file.Close()
+			}
+
+			var err error
+			file, err = os.Open(c.paths[ref.file])
+			if err != nil {
+				return err
+			}
+			current = ref.file
+		}
+
+		// Learning: ReadAt doesn't move a shared offset, so every stream can read its own range
+		n, err := file.ReadAt(buffer[:ref.length], ref.offset)
+		if n != ref.length {
+			return fmt.Errorf("%s changed since it was offered: %v", c.paths[ref.file], err)
+		}
+
+		sealed := aead.Seal(nil, chunknonce(ref.file, ref.offset), buffer[:n], []byte(c.id))
+		if err := protocol.WriteFrame(w, protocol.Chunk{ID: c.id, Index: ref.index, File: ref.file, Offset: ref.offset, Data: sealed}); err != nil {
+			return err
+		}
+		si.addprogress(c, int64(n))
+	}
+
+	return protocol.WriteFrame(w, protocol.Close{ID: c.id})
+}
+
+// SENDER: Stream an accepted request to the receiver over as many streams as it asked for
+func (si *ServerInstance) pushtransfer(c *conn) {
+	logger := log.GetInstance()
+
+	si.poolmu.Lock()
+	err := c.transition(statetransferring)
+	streams := c.streams
+	si.poolmu.Unlock()
+	if err != nil {
+		logger.Debug("TRANSFER", err.Error())
+		return
+	}
+
+	// One stream failing takes the others down with it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ranges := splitranges(buildmanifest(c.files), streams)
+	errs := make(chan error, len(ranges))
+	for stream, chunks := range ranges {
+		go func() {
+			err := si.pushstream(ctx, c, stream, chunks)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}()
+	}
+
+	// Keep the error that started it, not the cancels it caused
+	var first error
+	for range ranges {
+		if err := <-errs; err != nil && (first == nil || errors.Is(first, context.Canceled)) {
+			first = err
+		}
+	}
+
+	si.finishoutgoing(c, first)
+}
+
+// SENDER: One stream of a transfer
+func (si *ServerInstance) pushstream(ctx context.Context, c *conn, stream int, chunks []chunkref) error {
+	aead, err := Crypt.NewAEAD(c.sessionkey)
+	if err != nil {
+		return err
+	}
+
+	// Learning: A request body with no length goes out with chunked transfer encoding, so the
+	// pipe lets us produce the stream while http sends it
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(si.writechunks(&throttled{si: si, c: c, w: writer}, c, aead, chunks))
+	}()
+	defer reader.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, nodeurl(c.target, fmt.Sprintf("/transfer/%s/%d", c.id, stream)), reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	client := &http.Client{Timeout: transfertimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := readproblem(resp); err != nil {
+		return fmt.Errorf("stream %d: %w", stream, err)
+	}
+	return nil
+}
+
+// SENDER: Mark an outgoing transfer as done or failed
+func (si *ServerInstance) finishoutgoing(c *conn, err error) {
+	logger := log.GetInstance()
+
+	si.poolmu.Lock()
+	if c.state == statecancelled {
+		si.poolmu.Unlock()
+		logger.Output("TRANSFER", fmt.Sprintf("Transfer %s to %s was cancelled", c.id, c.endpointCON))
+		return
+	}
+	if err != nil {
+		c.transition(statefailed)
+		c.reason = err.Error()
+	} else {
+		c.transition(statedone)
+	}
+	si.poolmu.Unlock()
+
+	if err != nil {
+		logger.Output("TRANSFER", fmt.Sprintf("Sending to %s failed: %v", c.endpointCON, err))
+	} else {
+		logger.Output("TRANSFER", fmt.Sprintf("Sent %d files (%s) to %s", len(c.files), humansize(c.totalsize), c.endpointCON))
+	}
+}
+
+// Where received files go
+func (si *ServerInstance) downloaddir() (string, error) {
+	if si.config.DownloadDir != "" {
+		return si.config.DownloadDir, os.MkdirAll(si.config.DownloadDir, 0700)
+	}
+	return datadir("received")
+}
+
+// A file name in the download dir that isn't taken yet
+func freename(dir string, name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	path := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+	}
+}
+
+// RECEIVER: The files of one transfer while they're being written. Every stream shares it
+type receiving struct {
+	mu       sync.Mutex
+	c        *conn
+	dir      string
+	files    []*os.File
+	manifest *manifestcheck
+	opened   []bool // Streams that have connected
+	closed   int    // Streams that sent their Close
+	failed   bool
+}
+
+func newreceiving(c *conn, dir string) (*receiving, error) {
+	rc := &receiving{
+		c:        c,
+		dir:      dir,
+		files:    make([]*os.File, len(c.files)),
+		manifest: newmanifestcheck(c.files),
+		opened:   make([]bool, max(c.streams, 1)),
+	}
+	for i, f := range c.files {
+		// Learning: Names were checked by the protocol package, Base is a second line of defence
+		part, err := os.OpenFile(filepath.Join(dir, "."+c.id+"-"+filepath.Base(f.Name)+".part"), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+		if err != nil {
+			rc.abort()
+			return nil, err
+		}
+		rc.files[i] = part
+	}
+
+	return rc, nil
+}
+
+// A stream connected, every stream may only do that once
+func (rc *receiving) open(stream int) error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if stream < 0 || stream >= len(rc.opened) {
+		return fmt.Errorf("stream %d, we asked for %d", stream, len(rc.opened))
+	}
+	if rc.opened[stream] {
+		return fmt.Errorf("stream %d is already running", stream)
+	}
+	rc.opened[stream] = true
+	return nil
+}
+
+// Decrypt a chunk, check it against the manifest and put it where it belongs
+func (rc *receiving) write(aead cipher.AEAD, chunk protocol.Chunk) (int, error) {
+	if chunk.File >= len(rc.files) {
+		return 0, fmt.Errorf("chunk for file %d, the offer has %d", chunk.File, len(rc.files))
+	}
+
+	plaintext, err := aead.Open(nil, chunknonce(chunk.File, chunk.Offset), chunk.Data, []byte(rc.c.id))
+	if err != nil {
+		return 0, errors.New("chunk did not decrypt")
+	}
+
+	rc.mu.Lock()
+	if rc.failed {
+		rc.mu.Unlock()
+		return 0, errors.New("transfer was stopped")
+	}
+	err = rc.manifest.mark(chunk.Index, chunk.File, chunk.Offset, len(plaintext))
+	rc.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	// Learning: WriteAt is fine from several goroutines at once, each stream writes its own ranges
+	if _, err := rc.files[chunk.File].WriteAt(plaintext, chunk.Offset); err != nil {
+		return 0, err
+	}
+
+	return len(plaintext), nil
+}
+
+// A stream is done, true when it was the last one
+func (rc *receiving) closestream() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.closed++
+	return rc.closed == len(rc.opened)
+}
+
+// Check every file against the manifest and the offer and move it into place
+func (rc *receiving) finish() ([]string, error) {
+	rc.mu.Lock()
+	remaining := rc.manifest.remaining
+	rc.mu.Unlock()
+	if remaining != 0 {
+		return nil, fmt.Errorf("%d chunks never arrived", remaining)
+	}
+
+	for i, f := range rc.c.files {
+		rc.files[i].Close()
+
+		_, hash, err := FR.HashFile(rc.files[i].Name())
+		if err != nil {
+			return nil, err
+		}
+		if hash != f.Hash {
+			return nil, fmt.Errorf("%s doesn't match its hash", f.Name)
+		}
+	}
+
+	saved := make([]string, 0, len(rc.files))
+	for i, f := range rc.c.files {
+		final := freename(rc.dir, filepath.Base(f.Name))
+		if err := os.Rename(rc.files[i].Name(), final); err != nil {
+			return saved, err
+		}
+		saved = append(saved, final)
+	}
+
+	return saved, nil
+}
+
+// Throw away the partial files. Safe to call from every stream
+func (rc *receiving) abort() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.failed {
+		return
+	}
+	rc.failed = true
+
+	for _, file := range rc.files {
+		if file != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}
+}
+
+// RECEIVER: The sender pushes one stream of an accepted request here
+func (si *ServerInstance) handletransfer(w http.ResponseWriter, r *http.Request) {
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+	address := poolkey(remote.Addr())
+	id := r.PathValue("id")
+	stream, err := strconv.Atoi(r.PathValue("stream"))
+	if err != nil {
+		writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, "bad stream "+r.PathValue("stream"))
+		return
+	}
+
+	// Only the requester can push, and only once we accepted
+	si.poolmu.RLock()
+	c, ok := si.reqpool[id]
+	si.poolmu.RUnlock()
+	if !ok || c.sourceCON != address {
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, "no transfer "+id)
+		return
+	}
+
+	rc, status, code, err := si.beginreceiving(c)
+	if err != nil {
+		writeproblem(w, status, code, err.Error())
+		return
+	}
+	if err := rc.open(stream); err != nil {
+		writeproblem(w, http.StatusConflict, protocol.CodeWrongState, err.Error())
+		return
+	}
+
+	if status, code, err := si.receivestream(c, rc, c.sessionkey, r.Body); err != nil {
+		writeproblem(w, status, code, err.Error())
+	}
+}
+
+// RECEIVER: The files of an accepted request, the first stream (or pull) starts the transfer
+func (si *ServerInstance) beginreceiving(c *conn) (*receiving, int, string, error) {
+	si.poolmu.Lock()
+	defer si.poolmu.Unlock()
+
+	if c.state == stateaccepted {
+		dir, err := si.downloaddir()
+		if err == nil {
+			c.receiving, err = newreceiving(c, dir)
+		}
+		if err != nil {
+			c.transition(statefailed)
+			return nil, http.StatusInternalServerError, protocol.CodeStorage, err
+		}
+		c.transition(statetransferring)
+	}
+	if c.state != statetransferring && c.state != statepaused {
+		return nil, http.StatusConflict, protocol.CodeWrongState, errors.New("transfer is " + c.state.String())
+	}
+	return c.receiving, 0, "", nil
+}
+
+// RECEIVER: Read the frames of one stream into the files. Whatever goes wrong stops the whole transfer,
+// the status and code are for telling the sender
+func (si *ServerInstance) receivestream(c *conn, rc *receiving, key []byte, stream io.Reader) (int, string, error) {
+	logger := log.GetInstance()
+
+	fail := func(status int, code string, err error) (int, string, error) {
+		rc.abort()
+
+		si.poolmu.Lock()
+		failed := c.transition(statefailed) == nil
+		if failed {
+			c.reason = err.Error()
+		}
+		si.poolmu.Unlock()
+
+		// Only the stream that failed first has something to say
+		if failed {
+			logger.Output("TRANSFER", fmt.Sprintf("Receiving %s from %s failed: %v", c.id, c.sourceCON, err))
+		}
+		return status, code, err
+	}
+
+	aead, err := Crypt.NewAEAD(key)
+	if err != nil {
+		return fail(http.StatusInternalServerError, protocol.CodeEncryption, err)
+	}
+
+	body := &throttled{si: si, c: c, r: stream}
+	for {
+		m, origin, err := getguard().ReadFrame(body, protocol.MaxChunkSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("stream ended without a close")
+			}
+			return fail(http.StatusBadRequest, protocol.ProblemCode(err), err)
+		}
+		if origin.NodeID != c.peerid {
+			return fail(http.StatusUnauthorized, protocol.CodeBadSignature, fmt.Errorf("frame signed by %s, the transfer is with %s", origin.NodeID, c.peerid))
+		}
+
+		switch msg := m.(type) {
+		case protocol.Chunk:
+			if msg.ID != c.id {
+				return fail(http.StatusBadRequest, protocol.CodeBadMessage, errors.New("chunk for another transfer"))
+			}
+			n, err := rc.write(aead, msg)
+			if err != nil {
+				return fail(http.StatusBadRequest, protocol.CodeBadMessage, err)
+			}
+			si.addprogress(c, int64(n))
+
+		case protocol.Close:
+			if !rc.closestream() {
+				return 0, "", nil
+			}
+
+			saved, err := rc.finish()
+			if err != nil {
+				return fail(http.StatusUnprocessableEntity, protocol.CodeBadMessage, err)
+			}
+
+			si.poolmu.Lock()
+			c.transition(statedone)
+			elapsed := c.updated.Sub(c.started).Seconds()
+			si.poolmu.Unlock()
+
+			if elapsed > 0 {
+				si.tuner.record(c.sourceCON, len(rc.opened), float64(c.totalsize)/elapsed)
+			}
+
+			for _, path := range saved {
+				logger.Output("TRANSFER", "Received "+path)
+			}
+
+			// Every hash matched, the sender gets that signed
+			go sendreceipt(peername(c.target), c.peerid, c.id, protocol.ReceiptDelivered)
+			return 0, "", nil
+
+		default:
+			return fail(http.StatusBadRequest, protocol.CodeBadMessage, fmt.Errorf("unexpected %s in a transfer", m.Type()))
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"crypto/ecdh"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	Crypt "github.com/QFServer/crypt"
+	"github.com/QFServer/log"
+)
+
+// Vault
+// Once a passphrase is set the inbox and outbox are encrypted on disk.
+// There's a vault key pair (X25519). The public half is stored as it is, so anything new can be sealed
+// to it at any time. A note that arrives while the inbox is locked still goes to disk encrypted.
+// The private half is stored encrypted with AES-GCM under a key made from the passphrase (PBKDF2-SHA256).
+// It's only in memory between inbox unlock and inbox lock, or until nobody touched the inbox for a while
+
+const (
+	vaultfile       = "vault.json"
+	vaultiterations = 600000
+	vaultsaltsize   = 16
+	vaultminpass    = 8
+	vaultautolock   = 10 * time.Minute
+)
+
+var ErrLocked = errors.New("the inbox is locked, inbox unlock opens it")
+
+// What's on disk
+type vaultfilecontent struct {
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+	Public     []byte `json:"public"`
+	Private    []byte `json:"private"` // Nonce + AES-GCM of the private key
+}
+
+type vault struct {
+	mu      sync.Mutex
+	stored  *vaultfilecontent // Nil until a passphrase is set
+	public  *ecdh.PublicKey
+	private *ecdh.PrivateKey // Nil while locked
+	timer   *time.Timer
+}
+
+var (
+	vaultinstance *vault
+	vaultonce     sync.Once
+)
+
+// The vault is a singleton, the inbox and outbox both need it with or without the server
+func getvault() *vault {
+	vaultonce.Do(func() {
+		vaultinstance = &vault{}
+
+		dir, err := configdir()
+		if err != nil {
+			return
+		}
+
+		content, err := os.ReadFile(filepath.Join(dir, vaultfile))
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.GetInstance().Output("VAULT", "Could not read the vault: "+err.Error())
+			}
+			return
+		}
+
+		stored := &vaultfilecontent{}
+		if err := json.Unmarshal(content, stored); err != nil {
+			log.GetInstance().Output("VAULT", "Vault is broken: "+err.Error())
+			return
+		}
+		public, err := ecdh.X25519().NewPublicKey(stored.Public)
+		if err != nil {
+			log.GetInstance().Output("VAULT", "Vault is broken: "+err.Error())
+			return
+		}
+
+		vaultinstance.stored = stored
+		vaultinstance.public = public
+	})
+
+	return vaultinstance
+}
+
+// Is there a passphrase, and is the vault open
+func (v *vault) status() (bool, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.stored != nil, v.private != nil
+}
+
+func (v *vault) configured() bool {
+	configured, _ := v.status()
+	return configured
+}
+
+// Seal something to the vault. Works locked or not
+func (v *vault) seal(plaintext []byte) ([]byte, error) {
+	v.mu.Lock()
+	public := v.public
+	v.mu.Unlock()
+
+	if public == nil {
+		return nil, errors.New("no passphrase set")
+	}
+	return Crypt.Seal(public, plaintext)
+}
+
+// Open something sealed to the vault. Only while it's unlocked
+func (v *vault) open(sealed []byte) ([]byte, error) {
+	v.mu.Lock()
+	private := v.private
+	v.mu.Unlock()
+
+	if private == nil {
+		return nil, ErrLocked
+	}
+	return Crypt.Open(private, sealed)
+}
+
+// The inbox was used, push the auto-lock back
+func (v *vault) touch() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.timer != nil {
+		v.timer.Reset(vaultautolock)
+	}
+}
+
+// AES-GCM under the key from the passphrase
+func passphraseaead(passphrase string, salt []byte, iterations int) (aeadwrap, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return aeadwrap{}, err
+	}
+	aead, err := Crypt.NewAEAD(key)
+	if err != nil {
+		return aeadwrap{}, err
+	}
+	return aeadwrap{aead}, nil
+}
+
+// Learning: Embedding the interface gives us Seal/Open plus the two helpers below without a new type for every call
+type aeadwrap struct {
+	aead interface {
+		NonceSize() int
+		Seal(dst, nonce, plaintext, additionalData []byte) []byte
+		Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+	}
+}
+
+func (a aeadwrap) wrap(plaintext []byte) []byte {
+	nonce := make([]byte, a.aead.NonceSize())
+	rand.Read(nonce)
+	return a.aead.Seal(nonce, nonce, plaintext, []byte(vaultfile))
+}
+
+func (a aeadwrap) unwrap(wrapped []byte) ([]byte, error) {
+	if len(wrapped) < a.aead.NonceSize() {
+		return nil, errors.New("vault key is damaged")
+	}
+	size := a.aead.NonceSize()
+	return a.aead.Open(nil, wrapped[:size], wrapped[size:], []byte(vaultfile))
+}
+
+// Open the vault and start the auto-lock. Must hold the lock
+func (v *vault) unlocked(private *ecdh.PrivateKey) {
+	v.private = private
+	if v.timer == nil {
+		v.timer = time.AfterFunc(vaultautolock, func() {
+			if InboxLock() == nil {
+				log.GetInstance().Output("VAULT", fmt.Sprintf("Inbox locked after %s without use", vaultautolock))
+			}
+		})
+	} else {
+		v.timer.Reset(vaultautolock)
+	}
+}
+
+// Pick the passphrase for the first time. Everything already on disk gets encrypted with it
+func InboxSetPassphrase(passphrase string) error {
+	if len(passphrase) < vaultminpass {
+		return fmt.Errorf("a passphrase needs at least %d characters", vaultminpass)
+	}
+
+	dir, err := configdir()
+	if err != nil {
+		return err
+	}
+
+	v := getvault()
+	v.mu.Lock()
+	if v.stored != nil {
+		v.mu.Unlock()
+		return errors.New("there already is a passphrase, inbox unlock opens the inbox")
+	}
+
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		v.mu.Unlock()
+		return err
+	}
+	stored := &vaultfilecontent{Salt: make([]byte, vaultsaltsize), Iterations: vaultiterations, Public: private.PublicKey().Bytes()}
+	rand.Read(stored.Salt)
+
+	aead, err := passphraseaead(passphrase, stored.Salt, stored.Iterations)
+	if err != nil {
+		v.mu.Unlock()
+		return err
+	}
+	stored.Private = aead.wrap(private.Bytes())
+
+	content, err := json.MarshalIndent(stored, "", "  ")
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, vaultfile), content, 0600)
+	}
+	if err != nil {
+		v.mu.Unlock()
+		return err
+	}
+
+	v.stored = stored
+	v.public = private.PublicKey()
+	v.unlocked(private)
+	v.mu.Unlock()
+
+	// Learning: The stores take their own locks and call back into the vault, so ours has to be let go first
+	if err := getinbox().rewrite(); err != nil {
+		return fmt.Errorf("passphrase set, but the inbox couldn't be encrypted yet: %v", err)
+	}
+	if err := getoutbox().rewrite(); err != nil {
+		return fmt.Errorf("passphrase set, but the outbox couldn't be encrypted yet: %v", err)
+	}
+	return nil
+}
+
+// Open the inbox and outbox with the passphrase
+func InboxUnlock(passphrase string) error {
+	v := getvault()
+	v.mu.Lock()
+	if v.stored == nil {
+		v.mu.Unlock()
+		return errors.New("no passphrase set yet")
+	}
+	stored := *v.stored
+	v.mu.Unlock()
+
+	// Learning: PBKDF2 is slow on purpose, don't hold the lock while it runs
+	aead, err := passphraseaead(passphrase, stored.Salt, stored.Iterations)
+	if err != nil {
+		return err
+	}
+	raw, err := aead.unwrap(stored.Private)
+	if err != nil {
+		return errors.New("wrong passphrase")
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return errors.New("vault key is damaged")
+	}
+
+	v.mu.Lock()
+	v.unlocked(private)
+	v.mu.Unlock()
+
+	getinbox().unseal()
+	getoutbox().unseal()
+	return nil
+}
+
+// Forget the key and what was opened with it. Outbox items already in memory keep going out,
+// after a restart they wait for an unlock
+func InboxLock() error {
+	v := getvault()
+	v.mu.Lock()
+	if v.private == nil {
+		v.mu.Unlock()
+		return errors.New("the inbox isn't unlocked")
+	}
+	v.private = nil
+	if v.timer != nil {
+		v.timer.Stop()
+	}
+	v.mu.Unlock()
+
+	getinbox().reseal()
+	return nil
+}
+
+// Is there a passphrase, and is the inbox locked
+func InboxVault() (bool, bool) {
+	configured, open := getvault().status()
+	return configured, configured && !open
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Crypt "github.com/QFServer/crypt"
+	"github.com/QFServer/log"
+	"github.com/QFServer/protocol"
+)
+
+// Wormhole codes
+// Picking a numbered address out of the request module is easy to get wrong. send <file> opens a wormhole
+// and prints a code like 7-crossword-apple, receive <code> on the other machine does the rest.
+// 1. The number is the nameplate. The receiver asks the peers it knows, then every host on its subnets,
+//    for GET /wormhole/{nameplate} and goes with the first one that has it open
+// 2. It posts its half of a SPAKE2 exchange made from the whole code (see crypt/pake.go), the sender answers
+//    with its half and a confirmation. Both node ids go into the key, so it also says who is who
+// 3. The receiver confirms back. Then the sender makes a normal offer, and the receiver accepts it because
+//    it's signed by the node that just proved it knew the code
+// Every code gets one guess, a wrong one closes the wormhole. Nothing has to be pinned or shared first
+
+const (
+	wormholetime  = 10 * time.Minute // How long a code stays open, and how long a receiver waits for the offer
+	wormholeprobe = time.Second      // For a peer to say if it has a nameplate open
+)
+
+// A wormhole we opened
+type wormhole struct {
+	nameplate int
+	code      string
+	pake      *Crypt.PAKE
+	paths     []string
+	files     []protocol.FileMeta
+	totalsize int64
+	created   time.Time
+
+	// Whoever claimed it, set by the first key exchange. Only they can confirm
+	claimant string
+	address  netip.Addr
+	key      []byte
+}
+
+// An offer a receive is waiting for
+type wormholewait struct {
+	address netip.Addr
+	until   time.Time
+}
+
+type wormholeregistry struct {
+	mu     sync.Mutex
+	open   map[int]*wormhole
+	expect map[string]wormholewait // Node id that went through a wormhole with us, its next offer is taken
+}
+
+var (
+	wormholeinstance *wormholeregistry
+	wormholeonce     sync.Once
+)
+
+func getwormholes() *wormholeregistry {
+	wormholeonce.Do(func() {
+		wormholeinstance = &wormholeregistry{open: make(map[int]*wormhole), expect: make(map[string]wormholewait)}
+	})
+	return wormholeinstance
+}
+
+// Close what nobody came for. Must hold the lock
+func (wr *wormholeregistry) prune(now time.Time) {
+	for nameplate, wh := range wr.open {
+		if now.Sub(wh.created) > wormholetime {
+			delete(wr.open, nameplate)
+			log.GetInstance().Output("WORMHOLE", fmt.Sprintf("Wormhole %s closed, nobody came for it", wh.code))
+		}
+	}
+	for node, wait := range wr.expect {
+		if now.After(wait.until) {
+			delete(wr.expect, node)
+		}
+	}
+}
+
+// Is this the node we went through a wormhole with. Only its first offer counts
+func (wr *wormholeregistry) expected(node string, address netip.Addr) bool {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	wr.prune(time.Now())
+	wait, ok := wr.expect[node]
+	if !ok || wait.address != address {
+		return false
+	}
+	delete(wr.expect, node)
+	return true
+}
+
+// Open a wormhole for some files and give back its code. The files are checked now, they're offered
+// once a receiver came through
+func (si *ServerInstance) SendCode(paths []string) (string, error) {
+	if !CheckServerAlive() {
+		return "", errors.New("the server isn't alive")
+	}
+
+	files, totalsize, err := describefiles(paths)
+	if err != nil {
+		return "", err
+	}
+
+	wr := getwormholes()
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.prune(time.Now())
+
+	nameplate := 0
+	for range 3 * protocol.MaxNameplate {
+		n, err := rand.Int(rand.Reader, big.NewInt(protocol.MaxNameplate))
+		if err != nil {
+			return "", err
+		}
+		if _, taken := wr.open[int(n.Int64())+1]; !taken {
+			nameplate = int(n.Int64()) + 1
+			break
+		}
+	}
+	if nameplate == 0 {
+		return "", errors.New("every nameplate is in use, wait for one to close")
+	}
+
+	// Learning: 256 words is one random byte each, so the code has about 16 bits besides the nameplate.
+	// That's plenty when every guess needs a whole exchange with us and closes the wormhole
+	pick := make([]byte, 2)
+	if _, err := rand.Read(pick); err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%d-%s-%s", nameplate, wormholewords[pick[0]], wormholewords[pick[1]])
+
+	pake, err := Crypt.NewPAKE(code, false)
+	if err != nil {
+		return "", err
+	}
+
+	wr.open[nameplate] = &wormhole{
+		nameplate: nameplate,
+		code:      code,
+		pake:      pake,
+		paths:     paths,
+		files:     files,
+		totalsize: totalsize,
+		created:   time.Now(),
+	}
+	return code, nil
+}
+
+// The nameplate of a code, checking the words on the way so a typo shows here and not as a wrong code
+func parsecode(code string) (int, error) {
+	parts := strings.Split(code, "-")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("%q isn't a code, they look like 7-crossword-apple", code)
+	}
+	nameplate, err := strconv.Atoi(parts[0])
+	if err != nil || nameplate < 1 || nameplate > protocol.MaxNameplate {
+		return 0, fmt.Errorf("%q isn't a code, it starts with a number from 1 to %d", code, protocol.MaxNameplate)
+	}
+	for _, word := range parts[1:] {
+		if !slices.Contains(wormholewords[:], word) {
+			return 0, fmt.Errorf("%s isn't one of the code words, check the spelling", word)
+		}
+	}
+	return nameplate, nil
+}
+
+// What both sides mix into the key. Sender first
+func wormholecontext(nameplate int, sender string, receiver string) []byte {
+	return fmt.Appendf(nil, "qfserver wormhole %d %s %s", nameplate, sender, receiver)
+}
+
+// Proof that we got the key, one per side so neither can be sent back as the other
+func wormholeconfirm(key []byte, side string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(side))
+	return mac.Sum(nil)
+}
+
+// Go through the wormhole for a code. Gives back where the sender is, its offer follows on its own and
+// is accepted as soon as it's here
+func (si *ServerInstance) ReceiveCode(code string) (string, error) {
+	logger := log.GetInstance()
+	if !CheckServerAlive() {
+		return "", errors.New("the server isn't alive")
+	}
+
+	code = strings.ToLower(strings.TrimSpace(code))
+	nameplate, err := parsecode(code)
+	if err != nil {
+		return "", err
+	}
+
+	target, err := si.findwormhole(nameplate)
+	if err != nil {
+		return "", err
+	}
+	logger.Output("WORMHOLE", fmt.Sprintf("Wormhole %d is at %s", nameplate, target.Addr()))
+
+	pake, err := Crypt.NewPAKE(code, true)
+	if err != nil {
+		return "", err
+	}
+	content, err := protocol.Marshal(protocol.Wormhole{Nameplate: nameplate, PAKE: pake.Message()})
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{Timeout: time.Second * 10}
+	resp, err := client.Post(nodeurl(target, "/wormhole"), "application/json", bytes.NewReader(content))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if err := readproblem(resp); err != nil {
+		return "", err
+	}
+
+	m, origin, err := getguard().Expect(resp.Body, protocol.MaxMessageSize, protocol.TypeWormhole)
+	if err != nil {
+		return "", err
+	}
+	answer := m.(protocol.Wormhole)
+
+	self := getidentity().nodeid()
+	key, err := pake.Key(answer.PAKE, wormholecontext(nameplate, origin.NodeID, self))
+	if err != nil {
+		return "", err
+	}
+	right := hmac.Equal(answer.Confirm, wormholeconfirm(key, "sender"))
+
+	// Waiting for the offer starts before the sender hears from us, it makes it as soon as it does
+	wr := getwormholes()
+	if right {
+		wr.mu.Lock()
+		wr.expect[origin.NodeID] = wormholewait{address: target.Addr(), until: time.Now().Add(wormholetime)}
+		wr.mu.Unlock()
+	}
+
+	// A wrong code gets confirmed too, so the sender closes the wormhole instead of waiting for us
+	err = postmessage(target, "/wormhole", protocol.Wormhole{Nameplate: nameplate, Confirm: wormholeconfirm(key, "receiver")})
+	if !right {
+		return "", fmt.Errorf("the code doesn't match the wormhole at %s, it's closed now", target.Addr())
+	}
+	if err != nil {
+		wr.mu.Lock()
+		delete(wr.expect, origin.NodeID)
+		wr.mu.Unlock()
+		return "", err
+	}
+
+	return target.Addr().String(), nil
+}
+
+// Who has the nameplate open. The pool first, then every host on our subnets
+func (si *ServerInstance) findwormhole(nameplate int) (netip.AddrPort, error) {
+	client := &http.Client{Timeout: wormholeprobe}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for address, peer := range si.GetPingPool() {
+		if peer.Relay != "" {
+			continue
+		}
+		target, err := resolvepeer(address)
+		if err == nil && probewormhole(ctx, client, target, nameplate) {
+			return target, nil
+		}
+	}
+
+	hosts := make([]netip.Addr, 0)
+	for _, prefix := range localprefixes(si.config) {
+		if found, err := scanhosts(prefix); err == nil {
+			hosts = append(hosts, found...)
+		}
+	}
+	log.GetInstance().Output("WORMHOLE", fmt.Sprintf("Nobody in the pool has wormhole %d, asking %d hosts", nameplate, len(hosts)))
+
+	// Learning: The scan stops as soon as one host says yes, cancelling the context ends the walk
+	result := make(chan netip.AddrPort, 1)
+	self := getidentity().nodeid()
+	scanprefix(ctx, hosts, serverport, &scanjob{cancel: cancel, total: len(hosts)}, func(target netip.AddrPort, info protocol.Hello, _ []byte) {
+		if info.NodeID == self || !probewormhole(ctx, client, target, nameplate) {
+			return
+		}
+		select {
+		case result <- target:
+			cancel()
+		default:
+		}
+	})
+
+	select {
+	case target := <-result:
+		return target, nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("nobody on the network has wormhole %d open", nameplate)
+	}
+}
+
+// Does this node have the nameplate open
+func probewormhole(ctx context.Context, client *http.Client, target netip.AddrPort, nameplate int) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, nodeurl(target, fmt.Sprintf("/wormhole/%d", nameplate)), nil)
+	if err != nil {
+		return false
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusNoContent
+}
+
+// SENDER: Tell a receiver looking for a nameplate whether we have it, as long as nobody claimed it
+func (si *ServerInstance) handlewormholeprobe(w http.ResponseWriter, r *http.Request) {
+	nameplate, err := strconv.Atoi(r.PathValue("nameplate"))
+
+	wr := getwormholes()
+	wr.mu.Lock()
+	wr.prune(time.Now())
+	wh, ok := wr.open[nameplate]
+	open := err == nil && ok && wh.claimant == ""
+	wr.mu.Unlock()
+
+	if !open {
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, "no wormhole "+r.PathValue("nameplate"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SENDER: A receiver goes through one of our wormholes. The first step claims it and gets our half of the
+// exchange back, the second one has to prove the receiver had the same code
+func (si *ServerInstance) handlewormhole(w http.ResponseWriter, r *http.Request) {
+	logger := log.GetInstance()
+
+	remote, err := remoteaddr(r)
+	if err != nil {
+		badaddress(w, err)
+		return
+	}
+
+	m, origin, err := getguard().Expect(r.Body, protocol.MaxMessageSize, protocol.TypeWormhole)
+	if err != nil {
+		rejectmessage(w, r, err)
+		return
+	}
+	msg := m.(protocol.Wormhole)
+
+	wr := getwormholes()
+	wr.mu.Lock()
+	wr.prune(time.Now())
+	wh, ok := wr.open[msg.Nameplate]
+	if !ok {
+		wr.mu.Unlock()
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, fmt.Sprintf("no wormhole %d", msg.Nameplate))
+		return
+	}
+
+	if len(msg.PAKE) != 0 {
+		if wh.claimant != "" {
+			wr.mu.Unlock()
+			writeproblem(w, http.StatusConflict, protocol.CodeWrongState, fmt.Sprintf("wormhole %d is taken", msg.Nameplate))
+			return
+		}
+		key, err := wh.pake.Key(msg.PAKE, wormholecontext(wh.nameplate, getidentity().nodeid(), origin.NodeID))
+		if err != nil {
+			wr.mu.Unlock()
+			writeproblem(w, http.StatusBadRequest, protocol.CodeBadMessage, err.Error())
+			return
+		}
+		wh.claimant, wh.address, wh.key = origin.NodeID, remote.Addr(), key
+		answer := protocol.Wormhole{Nameplate: wh.nameplate, PAKE: wh.pake.Message(), Confirm: wormholeconfirm(key, "sender")}
+		wr.mu.Unlock()
+
+		reply, err := protocol.Marshal(answer)
+		if err != nil {
+			writeproblem(w, http.StatusInternalServerError, protocol.CodeBadMessage, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(reply)
+		return
+	}
+
+	// Someone else's confirmation gets the same answer as a wormhole that isn't there
+	if wh.claimant != origin.NodeID || wh.address != remote.Addr() {
+		wr.mu.Unlock()
+		writeproblem(w, http.StatusNotFound, protocol.CodeUnknown, fmt.Sprintf("no wormhole %d", msg.Nameplate))
+		return
+	}
+
+	// Right or wrong, that was its one guess
+	delete(wr.open, wh.nameplate)
+	wr.mu.Unlock()
+
+	if !hmac.Equal(msg.Confirm, wormholeconfirm(wh.key, "receiver")) {
+		writeproblem(w, http.StatusForbidden, protocol.CodeBadKey, "wrong code")
+		logger.Output("WORMHOLE", fmt.Sprintf("%s came with the wrong code for wormhole %d, it's closed now", remote.Addr(), wh.nameplate))
+		return
+	}
+
+	logger.Output("WORMHOLE", fmt.Sprintf("%s came through wormhole %s", remote.Addr(), wh.code))
+	go si.wormholeoffer(wh)
+}
+
+// SENDER: Offer the files to whoever came through. They take it without asking
+func (si *ServerInstance) wormholeoffer(wh *wormhole) {
+	logger := log.GetInstance()
+
+	to := wh.address.String()
+	id, err := si.offerfiles(to, wh.paths, wh.files, wh.totalsize, fmt.Sprintf("through wormhole %d", wh.nameplate), sharelimits{})
+	if err != nil {
+		logger.Output("ERROR", fmt.Sprintf("%s didn't take the offer: %v", to, err))
+		return
+	}
+	logger.Output("REQ", fmt.Sprintf("Offered %s to %s as transfer %s", humansize(wh.totalsize), to, id))
+}
+
+// The words of a code, one byte each. Short, common and hard to mix up
+var wormholewords = [256]string{
+	"acorn", "adult", "album", "alpha", "amber", "anchor", "angle", "apple", "apron", "arena", "armor", "arrow", "atlas", "attic", "autumn", "avocado",
+	"bacon", "badge", "bagel", "baker", "balloon", "bamboo", "banana", "banjo", "barrel", "basket", "beacon", "beaver", "bicycle", "biscuit", "blanket", "blossom",
+	"bonnet", "border", "bottle", "bracket", "breeze", "bridge", "bronze", "bucket", "buffalo", "bullet", "butter", "button", "cabin", "cactus", "camera", "candle",
+	"canoe", "canvas", "canyon", "carbon", "carpet", "carrot", "castle", "cement", "cherry", "chimney", "circle", "citrus", "cobalt", "coconut", "comet", "compass",
+	"copper", "coral", "cotton", "cradle", "crayon", "cricket", "crossword", "crystal", "cushion", "dagger", "dancer", "delta", "denim", "desert", "diamond", "dinner",
+	"dolphin", "domino", "donkey", "dragon", "drawer", "dynamo", "eagle", "echo", "eclipse", "elbow", "ember", "emerald", "engine", "falcon", "feather", "fender",
+	"ferry", "fiddle", "finch", "flannel", "flute", "forest", "fossil", "fountain", "fox", "garden", "garlic", "gazelle", "gecko", "ginger", "glacier", "goblet",
+	"gopher", "granite", "grape", "gravel", "guitar", "hammer", "harbor", "harvest", "hazel", "helmet", "hermit", "honey", "hornet", "husky", "igloo", "iguana",
+	"island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw", "jungle", "kayak", "kernel", "kettle", "kiwi", "koala", "ladder", "lagoon", "lantern",
+	"laptop", "lava", "lemon", "leopard", "lettuce", "lily", "linen", "lizard", "lobster", "locket", "lotus", "magnet", "mango", "maple", "marble", "meadow",
+	"melon", "meteor", "mirror", "mitten", "monkey", "mosaic", "muffin", "mustard", "napkin", "nectar", "needle", "nickel", "noodle", "nutmeg", "oasis", "ocean",
+	"olive", "onion", "orbit", "orchid", "otter", "oyster", "paddle", "palace", "panda", "panther", "papaya", "parrot", "pebble", "pencil", "pepper", "piano",
+	"pickle", "pilot", "pine", "pirate", "planet", "plaster", "pocket", "pony", "poppy", "potato", "prism", "puffin", "pumpkin", "puzzle", "quartz", "quill",
+	"rabbit", "radar", "radish", "raven", "ribbon", "rocket", "rooster", "saddle", "salmon", "satin", "scarf", "shadow", "shovel", "silver", "skate", "sparrow",
+	"spider", "spinach", "sponge", "squash", "statue", "summer", "sunset", "swan", "tablet", "tango", "teapot", "temple", "thimble", "thunder", "tiger", "timber",
+	"toast", "tomato", "trumpet", "tulip", "tunnel", "turkey", "turnip", "umbrella", "unicorn", "valley", "velvet", "violin", "volcano", "waffle", "wagon", "walnut",
+}